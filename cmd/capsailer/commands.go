@@ -3,7 +3,9 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -14,16 +16,29 @@ import (
 	"strings"
 	"time"
 
+	"github.com/capsailer/capsailer-cli/pkg/helm"
+	"github.com/capsailer/capsailer-cli/pkg/image"
+	"github.com/capsailer/capsailer-cli/pkg/kube"
+	"github.com/capsailer/capsailer-cli/pkg/registry"
+	"github.com/capsailer/capsailer-cli/pkg/utils"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
-	"github.com/capsailer/capsailer-cli/pkg/registry"
 	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
 )
 
 // runRegistry handles the registry command
-func runRegistry(namespace, image, chartImage string, persistent bool, kubeconfigPath string) error {
+func runRegistry(opts registry.RegistryOptions, dryRun bool, output, caOut string) error {
+	if dryRun {
+		return printRegistryObjects(opts, output, caOut)
+	}
+	if output != "" {
+		return fmt.Errorf("--output can only be used with --dry-run")
+	}
+
 	fmt.Println("Deploying a standalone Docker registry and ChartMuseum")
 
 	// Air-gapped environment handling
@@ -35,7 +50,8 @@ func runRegistry(namespace, image, chartImage string, persistent bool, kubeconfi
 		fmt.Println("Checking for registry image in local bundle...")
 
 		// Check if we have the registry image in a local bundle
-		if _, err := os.Stat("images/registry_2.tar"); os.IsNotExist(err) {
+		bundled, found := findBundleImage(defaultBundleDir, opts.RegistryImage)
+		if !found {
 			fmt.Println("Registry image not found in local bundle.")
 			fmt.Println("Options for air-gapped registry deployment:")
 			fmt.Println("1. Pre-load the registry image on your cluster nodes")
@@ -61,7 +77,15 @@ func runRegistry(namespace, image, chartImage string, persistent bool, kubeconfi
 			fmt.Println("Registry image found in local bundle. It will be used for deployment.")
 			// Here we would load the image into the cluster nodes first
 			fmt.Println("Loading registry image from local bundle...")
-			err := loadImageToCluster("images/registry_2.tar", kubeconfigPath)
+			archive, temporary, err := dockerArchive(bundled)
+			if err == nil {
+				err = loadImageToCluster(archive, opts.KubeconfigPath)
+				if temporary {
+					if removeErr := os.Remove(archive); removeErr != nil {
+						fmt.Fprintf(os.Stderr, "Error removing temporary image archive: %v\n", removeErr)
+					}
+				}
+			}
 			if err != nil {
 				fmt.Printf("Warning: Failed to load image: %v\n", err)
 				fmt.Println("Will attempt to continue deployment assuming the image is available in the cluster.")
@@ -71,35 +95,172 @@ func runRegistry(namespace, image, chartImage string, persistent bool, kubeconfi
 		fmt.Println("Connected environment detected. Registry and ChartMuseum images will be pulled from their respective registries.")
 	}
 
-	// Create registry options
-	opts := registry.DefaultRegistryOptions()
-	opts.Namespace = namespace
-	if image != "" {
-		opts.RegistryImage = image
-	}
-	if chartImage != "" {
-		opts.ChartMuseumImage = chartImage
-	}
-	opts.PersistentPV = persistent
-	opts.KubeconfigPath = kubeconfigPath
-
 	// Setup the registry
-	registryURL, err := registry.SetupRegistry(opts)
+	registryURL, caBundle, err := registry.SetupRegistry(opts)
 	if err != nil {
 		return fmt.Errorf("failed to setup registry: %w", err)
 	}
 
 	fmt.Printf("\nRegistry deployed successfully at: %s\n", registryURL)
-	fmt.Printf("ChartMuseum deployed successfully at: chartmuseum.%s.svc.cluster.local:8080\n", namespace)
+	fmt.Printf("ChartMuseum deployed successfully at: chartmuseum.%s.svc.cluster.local:8080\n", opts.Namespace)
 	fmt.Println("\nYou can use this registry for your air-gapped deployments.")
 	fmt.Println("To push images to this registry:")
 	fmt.Printf("  docker tag myimage:tag %s/myimage:tag\n", registryURL)
 	fmt.Printf("  docker push %s/myimage:tag\n", registryURL)
 	fmt.Println("\nTo push Helm charts, use the 'capsailer push' command with your bundle.")
 
+	if opts.TLS {
+		return printRegistryCA(caBundle, registryURL, caOut)
+	}
 	return nil
 }
 
+// printRegistryCA writes the CA bundle of a TLS registry to caOut, or prints
+// it, with how to make nodes trust it
+func printRegistryCA(caBundle []byte, registryURL, caOut string) error {
+	fmt.Println("\nThe registry serves TLS. Container runtimes must trust its CA bundle,")
+	fmt.Println("for example on each node:")
+	fmt.Printf("  containerd: /etc/containerd/certs.d/%s/ca.crt\n", registryURL)
+	fmt.Printf("  docker:     /etc/docker/certs.d/%s/ca.crt\n", registryURL)
+	fmt.Printf("'capsailer push' reads the CA bundle from the %s secret.\n", registry.TLSSecretName)
+
+	if len(caBundle) == 0 {
+		fmt.Println("\nThe certificate was provided without a CA bundle; distribute the CA that signed it.")
+		return nil
+	}
+	if caOut != "" {
+		if err := writeCABundle(caBundle, caOut); err != nil {
+			return err
+		}
+		fmt.Printf("\nCA bundle written to %s\n", caOut)
+		return nil
+	}
+	fmt.Printf("\nCA bundle:\n%s", caBundle)
+	return nil
+}
+
+// writeCABundle writes a CA bundle to a file
+func writeCABundle(caBundle []byte, path string) error {
+	if err := os.WriteFile(path, caBundle, 0644); err != nil {
+		return fmt.Errorf("failed to write CA bundle: %w", err)
+	}
+	return nil
+}
+
+// printRegistryObjects prints the objects the registry command would apply
+func printRegistryObjects(opts registry.RegistryOptions, output, caOut string) error {
+	if output != "" && output != "yaml" {
+		return fmt.Errorf("unsupported output format '%s', only yaml is supported", output)
+	}
+
+	// Without a cluster to read an existing CA from, a new one is generated.
+	// Its key is not printed, and its bundle is only written to a file, so
+	// that the output stays YAML.
+	generated := opts.TLS && opts.TLSCertificate == nil
+	if err := registry.PrepareTLS(context.Background(), nil, &opts); err != nil {
+		return fmt.Errorf("failed to prepare the registry TLS certificate: %w", err)
+	}
+	if generated {
+		fmt.Fprintln(os.Stderr, "The certificate was issued by a new CA whose key is discarded. Pass --tls-cert, --tls-key and --tls-ca to use a CA you keep.")
+	}
+	if opts.TLS && caOut != "" && len(opts.TLSCertificate.CA) > 0 {
+		if err := writeCABundle(opts.TLSCertificate.CA, caOut); err != nil {
+			return err
+		}
+	}
+
+	objects, err := registry.Objects(opts)
+	if err != nil {
+		return err
+	}
+	manifest, err := kube.MarshalYAML(objects...)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(manifest)
+	return err
+}
+
+// registryOptionsFromFlags reads the options of the registry command
+func registryOptionsFromFlags(cmd *cobra.Command) (registry.RegistryOptions, error) {
+	flags := cmd.Flags()
+	opts := registry.DefaultRegistryOptions()
+
+	opts.Namespace, _ = flags.GetString("namespace")
+	if image, _ := flags.GetString("image"); image != "" {
+		opts.RegistryImage = image
+	}
+	if chartImage, _ := flags.GetString("chartmuseum-image"); chartImage != "" {
+		opts.ChartMuseumImage = chartImage
+	}
+	opts.PersistentPV, _ = flags.GetBool("persistent")
+	opts.KubeconfigPath, _ = flags.GetString("kubeconfig")
+	opts.StorageClass, _ = flags.GetString("storage-class")
+	opts.StorageSize, _ = flags.GetString("storage-size")
+	opts.Replicas, _ = flags.GetInt32("replicas")
+	opts.NodeSelector, _ = flags.GetStringToString("node-selector")
+	opts.Labels, _ = flags.GetStringToString("labels")
+
+	requests, _ := flags.GetStringToString("requests")
+	limits, _ := flags.GetStringToString("limits")
+	resources, err := registry.ParseResources(requests, limits)
+	if err != nil {
+		return opts, err
+	}
+	opts.Resources = resources
+
+	tolerations, _ := flags.GetStringArray("toleration")
+	for _, spec := range tolerations {
+		toleration, err := registry.ParseToleration(spec)
+		if err != nil {
+			return opts, err
+		}
+		opts.Tolerations = append(opts.Tolerations, toleration)
+	}
+
+	// The pod security context is only set when asked for, so images keep
+	// the user they were built with
+	if flags.Changed("run-as-user") || flags.Changed("run-as-group") || flags.Changed("fs-group") {
+		opts.SecurityContext = &corev1.PodSecurityContext{}
+		if flags.Changed("run-as-user") {
+			user, _ := flags.GetInt64("run-as-user")
+			opts.SecurityContext.RunAsUser = &user
+		}
+		if flags.Changed("run-as-group") {
+			group, _ := flags.GetInt64("run-as-group")
+			opts.SecurityContext.RunAsGroup = &group
+		}
+		if flags.Changed("fs-group") {
+			fsGroup, _ := flags.GetInt64("fs-group")
+			opts.SecurityContext.FSGroup = &fsGroup
+		}
+	}
+
+	// A user-provided certificate enables TLS; otherwise --tls has one
+	// generated
+	opts.TLS, _ = flags.GetBool("tls")
+	opts.TLSHosts, _ = flags.GetStringArray("tls-san")
+	certFile, _ := flags.GetString("tls-cert")
+	keyFile, _ := flags.GetString("tls-key")
+	caFile, _ := flags.GetString("tls-ca")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return opts, fmt.Errorf("--tls-cert and --tls-key must be used together")
+		}
+		certificate, err := registry.LoadTLSCertificate(certFile, keyFile, caFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.TLS = true
+		opts.TLSCertificate = certificate
+	} else if caFile != "" {
+		return opts, fmt.Errorf("--tls-ca can only be used with --tls-cert and --tls-key")
+	}
+
+	return opts, nil
+}
+
 // detectAirGapped attempts to determine if we're in an air-gapped environment
 func detectAirGapped() bool {
 	// Try to access a well-known internet endpoint
@@ -124,21 +285,15 @@ func loadImageToCluster(imageTarPath string, kubeconfigPath string) error {
 	}
 
 	// Get nodes in the cluster
-	var kubectlArgs []string
-	kubectlArgs = append(kubectlArgs, "get", "nodes", "-o", "jsonpath='{.items[*].metadata.name}'")
-	if kubeconfigPath != "" {
-		kubectlArgs = append(kubectlArgs, "--kubeconfig", kubeconfigPath)
+	client, err := kube.NewClient(kubeconfigPath)
+	if err != nil {
+		return err
 	}
-
-	cmd := exec.Command("kubectl", kubectlArgs...)
-	nodesOutput, err := cmd.Output()
+	nodeNames, err := client.NodeNames(context.Background())
 	if err != nil {
 		return fmt.Errorf("failed to get cluster nodes: %w", err)
 	}
 
-	// Parse node names (simple space-separated string)
-	nodeNames := strings.Split(strings.Trim(string(nodesOutput), "'"), " ")
-
 	// For real clusters we would distribute the image to each node
 	// In a single-node or minikube cluster, the local docker load is sufficient
 	fmt.Printf("Found %d nodes in cluster\n", len(nodeNames))
@@ -155,8 +310,10 @@ func loadImageToCluster(imageTarPath string, kubeconfigPath string) error {
 }
 
 // runPush handles the push command
-func runPush(image, bundlePath, namespace, kubeconfigPath string, externalRegistry, username, password string) error {
+func runPush(image, bundlePath, namespace, kubeconfigPath string, externalRegistry, username, password, publicKeyPath, chartRepository, caFile string, skipTLSVerify bool) error {
 	var registryURL string
+	var kubeClient *kube.Client
+	var clusterCA []byte // CA bundle of the in-cluster registry, if it serves TLS
 
 	if externalRegistry != "" {
 		// Use the external registry URL
@@ -172,58 +329,73 @@ func runPush(image, bundlePath, namespace, kubeconfigPath string, externalRegist
 		}
 	} else {
 		// Get registry URL from the Kubernetes service
-		var kubectlArgs []string
-		kubectlArgs = append(kubectlArgs, "get", "service", "-n", namespace, "registry", "-o", "jsonpath='{.spec.clusterIP}'")
-		if kubeconfigPath != "" {
-			kubectlArgs = append(kubectlArgs, "--kubeconfig", kubeconfigPath)
+		var err error
+		kubeClient, err = kube.NewClient(kubeconfigPath)
+		if err != nil {
+			return err
 		}
 
 		fmt.Println("Finding registry service...")
-		cmd := exec.Command("kubectl", kubectlArgs...)
-		registryIPOutput, err := cmd.Output()
+		registryIP, err := kubeClient.ServiceClusterIP(context.Background(), namespace, "registry")
 		if err != nil {
 			return fmt.Errorf("failed to get registry service: %w", err)
 		}
 
-		registryIP := strings.Trim(string(registryIPOutput), "'")
-		if registryIP == "" {
-			return fmt.Errorf("registry service not found in namespace %s", namespace)
-		}
-
 		registryURL = fmt.Sprintf("%s:5000", registryIP)
 		fmt.Printf("Found registry at %s\n", registryURL)
 
+		tlsData, found, err := kubeClient.Secret(context.Background(), namespace, registry.TLSSecretName)
+		if err != nil {
+			return fmt.Errorf("failed to get registry TLS secret: %w", err)
+		}
+		if found && len(tlsData[registry.CABundleKey]) > 0 {
+			fmt.Printf("Trusting the registry CA bundle from secret %s\n", registry.TLSSecretName)
+			clusterCA = tlsData[registry.CABundleKey]
+		}
+
 		// Set up port-forwarding to the registry to make it accessible from the CLI
 		// This is necessary since we're pushing directly instead of using an in-cluster tool
 		fmt.Printf("Setting up port-forwarding to registry in namespace %s...\n", namespace)
-		forwardProc, err := startPortForward(namespace, "registry", 5000, kubeconfigPath)
+		forward, err := startPortForward(kubeClient, namespace, "registry", 5000)
 		if err != nil {
 			fmt.Printf("Warning: Failed to set up port forwarding: %v\n", err)
 			fmt.Println("Will attempt to push directly to the registry ClusterIP (may fail if not reachable)")
 		} else {
-			defer stopPortForward(forwardProc)
-			// Use localhost URL since we've set up port forwarding
-			registryURL = "localhost:5000"
+			defer stopPortForward(forward)
+			// Use the forwarded local port
+			registryURL = forward.Address()
 			fmt.Printf("Port forwarding established, using registry at %s\n", registryURL)
 		}
 	}
 
+	tlsConfig, err := pushTLSConfig(caFile, clusterCA, skipTLSVerify)
+	if err != nil {
+		return err
+	}
+
 	// Handle different push modes
 	if bundlePath != "" {
+		// Unpack the bundle once for both images and charts
+		bundleDir, cleanup, err := openBundle(bundlePath, publicKeyPath)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
 		// Push all artifacts from a bundle
-		if err := pushImagesFromBundle(bundlePath, registryURL, namespace, kubeconfigPath); err != nil {
+		if err := pushImagesFromBundle(bundleDir, registryURL, tlsConfig); err != nil {
 			return fmt.Errorf("failed to push images: %w", err)
 		}
 
-		// Push charts if they exist and we're not using an external registry
-		// (since chart publishing requires ChartMuseum)
+		// Publish charts to ChartMuseum, or as OCI artifacts to an external registry
 		if externalRegistry == "" {
-			if err := publishChartsFromBundle(bundlePath, namespace, kubeconfigPath); err != nil {
+			if err := publishChartsFromBundle(bundleDir, namespace, kubeClient); err != nil {
 				return fmt.Errorf("failed to publish charts: %w", err)
 			}
 		} else {
-			fmt.Println("Skipping chart publishing for external registry.")
-			fmt.Println("Charts can only be published to the built-in ChartMuseum repository.")
+			if err := pushChartsToOCIRegistry(bundleDir, externalRegistry, chartRepository, username, password, tlsConfig); err != nil {
+				return fmt.Errorf("failed to push charts: %w", err)
+			}
 		}
 
 		return nil
@@ -235,6 +407,74 @@ func runPush(image, bundlePath, namespace, kubeconfigPath string, externalRegist
 	return fmt.Errorf("either --image or --bundle must be specified")
 }
 
+// pushTLSConfig returns the TLS configuration for pushing to a registry,
+// trusting the CA bundles from caFile and of the in-cluster registry
+func pushTLSConfig(caFile string, clusterCA []byte, insecure bool) (*tls.Config, error) {
+	var caBundle []byte
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		caBundle = append(data, '\n')
+	}
+	caBundle = append(caBundle, clusterCA...)
+	return image.TLSConfig(caBundle, insecure)
+}
+
+// openBundle returns a directory containing the bundle contents. Archives are
+// extracted to a temporary directory that is removed by the returned cleanup function.
+// Bundles that fail verification, or lack a valid signature when a public key is
+// given, are refused.
+func openBundle(bundlePath, publicKeyPath string) (string, func(), error) {
+	noop := func() {}
+
+	if !utils.BundleExists(bundlePath) {
+		return "", noop, fmt.Errorf("bundle file not found: %s", bundlePath)
+	}
+
+	// Assume a directory is an already unpacked bundle
+	if info, err := os.Stat(bundlePath); err == nil && info.IsDir() {
+		if utils.HasBundleIndex(bundlePath) || publicKeyPath != "" {
+			fmt.Println("Verifying bundle checksums...")
+			result, err := utils.VerifyBundle(bundlePath, utils.VerifyOptions{PublicKeyPath: publicKeyPath})
+			if err != nil && (publicKeyPath != "" || !errors.Is(err, utils.ErrBundleNotVerifiable)) {
+				return "", noop, err
+			}
+			if err == nil && !result.OK() {
+				result.Print(os.Stdout)
+				return "", noop, result.Err()
+			}
+		}
+		return bundlePath, noop, nil
+	}
+
+	// Create a temporary directory for unpacking
+	tempDir, err := os.MkdirTemp("", "capsailer-bundle-")
+	if err != nil {
+		return "", noop, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing temp directory: %v\n", err)
+		}
+	}
+
+	fmt.Printf("Extracting bundle to %s...\n", tempDir)
+	unpacker := utils.NewUnpacker(utils.UnpackOptions{
+		BundlePath:    bundlePath,
+		OutputDir:     tempDir,
+		Verify:        true,
+		PublicKeyPath: publicKeyPath,
+	})
+	if err := unpacker.Unpack(); err != nil {
+		cleanup()
+		return "", noop, fmt.Errorf("failed to extract bundle: %w", err)
+	}
+
+	return tempDir, cleanup, nil
+}
+
 // loginToRegistry attempts to authenticate with an external registry
 func loginToRegistry(registry, username, password string) error {
 	// Try to authenticate using Docker CLI if available
@@ -259,29 +499,28 @@ func loginToRegistry(registry, username, password string) error {
 }
 
 // pushSingleImage pushes a single image to the registry
-func pushSingleImage(image, registryURL string) error {
-	fmt.Printf("Pushing single image %s to registry\n", image)
+func pushSingleImage(imageRef, registryURL string) error {
+	fmt.Printf("Pushing single image %s to registry\n", imageRef)
 
 	// Check if image exists locally
-	fmt.Printf("Checking if image %s exists locally...\n", image)
-	inspectCmd := exec.Command("docker", "image", "inspect", image)
+	fmt.Printf("Checking if image %s exists locally...\n", imageRef)
+	inspectCmd := exec.Command("docker", "image", "inspect", imageRef)
 	if err := inspectCmd.Run(); err != nil {
-		return fmt.Errorf("image %s not found locally: %w", image, err)
+		return fmt.Errorf("image %s not found locally: %w", imageRef, err)
 	}
 
 	// Create a tagged version for the registry
-	parts := strings.Split(image, "/")
-	var imageName string
-	if len(parts) > 1 {
-		imageName = parts[len(parts)-1]
-	} else {
-		imageName = image
+	rewriter, err := image.NewRewriter(registryURL, nil)
+	if err != nil {
+		return err
+	}
+	targetImage, err := rewriter.Reference(imageRef)
+	if err != nil {
+		return err
 	}
-
-	targetImage := fmt.Sprintf("%s/%s", registryURL, imageName)
 	fmt.Printf("Tagging image as %s\n", targetImage)
 
-	tagCmd := exec.Command("docker", "tag", image, targetImage)
+	tagCmd := exec.Command("docker", "tag", imageRef, targetImage)
 	tagCmd.Stdout = os.Stdout
 	tagCmd.Stderr = os.Stderr
 	if err := tagCmd.Run(); err != nil {
@@ -297,80 +536,131 @@ func pushSingleImage(image, registryURL string) error {
 		return fmt.Errorf("failed to push image: %w", err)
 	}
 
-	fmt.Printf("Successfully pushed %s to registry\n", image)
+	fmt.Printf("Successfully pushed %s to registry\n", imageRef)
 	fmt.Printf("Image is now available as: %s\n", targetImage)
 
 	return nil
 }
 
-// pushImagesFromBundle pushes all images from a bundle to a registry
-func pushImagesFromBundle(bundlePath, registryURL, namespace, kubeconfigPath string) error {
-	fmt.Printf("Pushing all images from bundle %s to registry\n", bundlePath)
+// bundleImage is an image in a bundle together with its original reference
+type bundleImage struct {
+	Reference string
+	File      string // OCI layout directory, or docker tarball for older bundles
+	Digest    string // Manifest digest of the image within the layout
+	InLayout  bool
+	Delta     bool // Layers may be left out because a base bundle provides them
+}
+
+// pushImagesFromBundle pushes all images from an unpacked bundle to a registry
+func pushImagesFromBundle(bundleDir, registryURL string, tlsConfig *tls.Config) error {
+	fmt.Printf("Pushing all images from bundle %s to registry\n", bundleDir)
 
-	// First, check if the bundle exists
-	if _, err := os.Stat(bundlePath); os.IsNotExist(err) {
-		return fmt.Errorf("bundle file not found: %s", bundlePath)
+	images, err := listBundleImages(bundleDir)
+	if err != nil {
+		return err
 	}
 
-	// Create a temporary directory for unpacking
-	tempDir, err := os.MkdirTemp("", "capsailer-bundle-")
+	// Store images where the bundle's charts expect them
+	rewrite, err := utils.LoadBundleImageRewrite(bundleDir)
 	if err != nil {
-		return fmt.Errorf("failed to create temp directory: %w", err)
+		return err
+	}
+	rewriter, err := image.NewRewriter(registryURL, rewrite)
+	if err != nil {
+		return err
 	}
-	defer func() {
-		if err := os.RemoveAll(tempDir); err != nil {
-			fmt.Fprintf(os.Stderr, "Error removing temp directory: %v\n", err)
-		}
-	}()
 
-	// Determine the images directory path
-	var imagesDir string
-	if filepath.Ext(bundlePath) == ".tar" || filepath.Ext(bundlePath) == ".gz" {
-		fmt.Printf("Extracting bundle to %s...\n", tempDir)
-
-		// Extract the bundle
-		extractCmd := exec.Command("tar", "-xf", bundlePath, "-C", tempDir)
-		extractCmd.Stdout = os.Stdout
-		extractCmd.Stderr = os.Stderr
-		if err := extractCmd.Run(); err != nil {
-			return fmt.Errorf("failed to extract bundle: %w", err)
+	fmt.Printf("Found %d images to push\n", len(images))
+	if len(images) > 0 && images[0].Delta {
+		fmt.Println("This is a delta bundle: layers from its base bundle must already be in the registry.")
+	}
+
+	// Process each image
+	var failed []string
+	for _, img := range images {
+		fmt.Printf("Processing image %s\n", img.Reference)
+
+		// Target reference for the image in the registry
+		targetRef, err := rewriter.Reference(img.Reference)
+		if err != nil {
+			return err
 		}
+		fmt.Printf("Pushing image to %s\n", targetRef)
 
-		imagesDir = filepath.Join(tempDir, "images")
-	} else {
-		// Assume bundlePath is a directory that might contain an images directory
-		potentialImagesDir := filepath.Join(bundlePath, "images")
-		if _, err := os.Stat(potentialImagesDir); !os.IsNotExist(err) {
-			imagesDir = potentialImagesDir
+		// Load the image from the bundle
+		fmt.Printf("Loading image from %s...\n", img.File)
+
+		// Direct implementation using go-containerregistry
+		if err := pushImageToRegistry(img, targetRef, tlsConfig); err != nil {
+			fmt.Printf("Warning: Failed to push image: %v\n", err)
+			if img.Delta {
+				// Docker cannot help when layers are missing from the bundle itself
+				fmt.Println("The image may reference layers that are only in the base bundle. Push the base bundle to this registry first, then push this delta again.")
+				failed = append(failed, img.Reference)
+				continue
+			}
+			if !pushImageFallback(img, targetRef) {
+				failed = append(failed, img.Reference)
+			}
 		} else {
-			// If no images subdirectory, assume the specified path is the images directory
-			imagesDir = bundlePath
+			fmt.Printf("Successfully pushed image: %s\n", targetRef)
 		}
 	}
 
-	// Check if images directory exists
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to push %d of %d images: %s", len(failed), len(images), strings.Join(failed, ", "))
+	}
+
+	fmt.Printf("All images from bundle have been processed.\n")
+	return nil
+}
+
+// listBundleImages returns the images stored in an unpacked bundle. The bundle
+// index is authoritative; bundles without one fall back to parsing tar filenames.
+func listBundleImages(bundleDir string) ([]bundleImage, error) {
+	if utils.HasBundleIndex(bundleDir) {
+		index, err := utils.LoadBundleIndex(bundleDir)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(index.Images) == 0 {
+			return nil, fmt.Errorf("no images found in bundle index")
+		}
+
+		var images []bundleImage
+		for _, entry := range index.Images {
+			images = append(images, bundleImage{
+				Reference: entry.Reference,
+				File:      filepath.Join(bundleDir, entry.File),
+				Digest:    entry.Digest,
+				InLayout:  index.UsesImageLayout(),
+				Delta:     index.IsDelta(),
+			})
+		}
+		return images, nil
+	}
+
+	// Determine the images directory path
+	imagesDir := filepath.Join(bundleDir, "images")
 	if _, err := os.Stat(imagesDir); os.IsNotExist(err) {
-		return fmt.Errorf("images directory not found in bundle: %s", imagesDir)
+		// If no images subdirectory, assume the specified path is the images directory
+		imagesDir = bundleDir
 	}
 
 	// Get list of image tars in the images directory
 	imageTars, err := filepath.Glob(filepath.Join(imagesDir, "*.tar"))
 	if err != nil {
-		return fmt.Errorf("failed to list images: %w", err)
+		return nil, fmt.Errorf("failed to list images: %w", err)
 	}
 
 	if len(imageTars) == 0 {
-		return fmt.Errorf("no image tars found in %s", imagesDir)
+		return nil, fmt.Errorf("no image tars found in %s", imagesDir)
 	}
 
-	fmt.Printf("Found %d image tars to push\n", len(imageTars))
-
-	// Process each image tar
+	var images []bundleImage
 	for _, imageTar := range imageTars {
-		imageName := filepath.Base(imageTar)
-		imageName = strings.TrimSuffix(imageName, ".tar")
-
-		fmt.Printf("Processing image %s\n", imageName)
+		imageName := strings.TrimSuffix(filepath.Base(imageTar), ".tar")
 
 		// Extract original image name from tarball name
 		// Convert underscores back to slashes and colons
@@ -383,42 +673,127 @@ func pushImagesFromBundle(bundlePath, registryURL, namespace, kubeconfigPath str
 			}
 		}
 
-		// Target reference for the image in the registry
-		targetRef := fmt.Sprintf("%s/%s", registryURL, repoPath)
-		fmt.Printf("Pushing image to %s\n", targetRef)
+		images = append(images, bundleImage{Reference: repoPath, File: imageTar})
+	}
 
-		// Load the image from tar file
-		fmt.Printf("Loading image from %s...\n", imageTar)
+	return images, nil
+}
 
-		// Direct implementation using go-containerregistry
-		if err := pushImageToRegistry(imageTar, targetRef); err != nil {
-			fmt.Printf("Warning: Failed to push image: %v\n", err)
+// findBundleImage looks up an image by its original reference in an unpacked bundle
+func findBundleImage(bundleDir, reference string) (bundleImage, bool) {
+	images, err := listBundleImages(bundleDir)
+	if err != nil {
+		return bundleImage{}, false
+	}
+
+	for _, img := range images {
+		if img.Reference == reference {
+			return img, true
+		}
+	}
+	return bundleImage{}, false
+}
+
+// loadBundleImage reads an image from its OCI layout or docker tarball.
+// Multi-architecture images are returned as an index and a nil image.
+func loadBundleImage(img bundleImage) (v1.Image, v1.ImageIndex, error) {
+	if !img.InLayout {
+		loaded, err := tarball.ImageFromPath(img.File, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load image from tar: %w", err)
+		}
+		return loaded, nil, nil
+	}
+
+	imageLayout, err := image.OpenLayout(img.File)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	isIndex, err := imageLayout.IsIndex(img.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isIndex {
+		ii, err := imageLayout.Index(img.Digest)
+		return nil, ii, err
+	}
+
+	loaded, err := imageLayout.Image(img.Digest)
+	return loaded, nil, err
+}
+
+// dockerArchive returns a docker tarball of an image for tools that cannot
+// read OCI layouts. Images in a layout are exported to a temporary file,
+// which the caller removes when temporary is true.
+func dockerArchive(img bundleImage) (path string, temporary bool, err error) {
+	if !img.InLayout {
+		return img.File, false, nil
+	}
 
-			// Try using Docker if available
-			if checkCommandAvailable("docker") {
-				fmt.Println("Attempting to push with Docker as fallback...")
-				if err := pushWithDocker(imageTar, targetRef); err != nil {
-					fmt.Printf("Warning: Docker fallback also failed: %v\n", err)
-					fmt.Printf("Manual steps to push this image:\n")
-					fmt.Printf("  1. Load the image: docker load -i %s\n", imageTar)
-					fmt.Printf("  2. Tag the image: docker tag %s %s\n", repoPath, targetRef)
-					fmt.Printf("  3. Push the image: docker push %s\n", targetRef)
-				} else {
-					fmt.Printf("Successfully pushed image using Docker: %s\n", targetRef)
+	// Docker loads a single platform, so pick the one matching this machine
+	imageLayout, err := image.OpenLayout(img.File)
+	if err != nil {
+		return "", false, err
+	}
+	loaded, err := imageLayout.PlatformImage(img.Digest, image.HostPlatform())
+	if err != nil {
+		return "", false, err
+	}
+
+	ref, err := name.ParseReference(img.Reference)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid image reference: %w", err)
+	}
+
+	archive, err := os.CreateTemp("", "capsailer-image-*.tar")
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create temporary image archive: %w", err)
+	}
+	if err := archive.Close(); err != nil {
+		return "", false, fmt.Errorf("failed to close temporary image archive: %w", err)
+	}
+
+	if err := tarball.WriteToFile(archive.Name(), ref, loaded); err != nil {
+		if removeErr := os.Remove(archive.Name()); removeErr != nil {
+			fmt.Fprintf(os.Stderr, "Error removing temporary image archive: %v\n", removeErr)
+		}
+		return "", false, fmt.Errorf("failed to export image archive: %w", err)
+	}
+
+	return archive.Name(), true, nil
+}
+
+// pushImageFallback tries Docker after a failed push and otherwise prints manual steps.
+// An exported archive is kept when the manual steps refer to it. It reports whether
+// Docker pushed the image.
+func pushImageFallback(img bundleImage, targetRef string) bool {
+	archive, temporary, err := dockerArchive(img)
+	if err != nil {
+		fmt.Printf("Warning: Failed to prepare image for Docker: %v\n", err)
+		return false
+	}
+
+	if checkCommandAvailable("docker") {
+		fmt.Println("Attempting to push with Docker as fallback...")
+		err := pushWithDocker(archive, targetRef)
+		if err == nil {
+			fmt.Printf("Successfully pushed image using Docker: %s\n", targetRef)
+			if temporary {
+				if err := os.Remove(archive); err != nil {
+					fmt.Fprintf(os.Stderr, "Error removing temporary image archive: %v\n", err)
 				}
-			} else {
-				fmt.Printf("Manual steps to push this image:\n")
-				fmt.Printf("  1. Load the image: docker load -i %s\n", imageTar)
-				fmt.Printf("  2. Tag the image: docker tag %s %s\n", repoPath, targetRef)
-				fmt.Printf("  3. Push the image: docker push %s\n", targetRef)
 			}
-		} else {
-			fmt.Printf("Successfully pushed image: %s\n", targetRef)
+			return true
 		}
+		fmt.Printf("Warning: Docker fallback also failed: %v\n", err)
 	}
 
-	fmt.Printf("All images from bundle have been processed.\n")
-	return nil
+	fmt.Printf("Manual steps to push this image:\n")
+	fmt.Printf("  1. Load the image: docker load -i %s\n", archive)
+	fmt.Printf("  2. Tag the image: docker tag %s %s\n", img.Reference, targetRef)
+	fmt.Printf("  3. Push the image: docker push %s\n", targetRef)
+	return false
 }
 
 // checkCommandAvailable checks if a command is available in the PATH
@@ -477,33 +852,33 @@ func parseDockerLoadOutput(output, defaultName string) string {
 	return defaultName
 }
 
-// pushImageToRegistry pushes an image from a tar file to a registry using go-containerregistry
+// pushImageToRegistry pushes an image from a bundle to a registry using go-containerregistry
 // This eliminates the dependency on Docker or skopeo
-func pushImageToRegistry(imageTarPath, targetRef string) error {
+func pushImageToRegistry(bundled bundleImage, targetRef string, tlsConfig *tls.Config) error {
 	// Import the image from the tar file
-	tag, err := name.NewTag(targetRef)
+	ref, err := name.ParseReference(targetRef)
 	if err != nil {
 		return fmt.Errorf("invalid target reference: %w", err)
 	}
 
-	// Load the image from the tar file
-	img, err := tarball.ImageFromPath(imageTarPath, nil)
+	// Load the image from the bundle
+	img, ii, err := loadBundleImage(bundled)
 	if err != nil {
-		return fmt.Errorf("failed to load image from tar: %w", err)
+		return err
 	}
 
 	// Push the image to the registry
-	// Set up options to allow insecure registries (commonly used in air-gapped environments)
-	insecureTransport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
+	// Verify the registry's certificate with its CA bundle, unless
+	// --skip-tls-verify was given
+	transport := remote.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
 
 	// Check if we need to use authentication
 	// If the registry is not localhost, try to get credentials from Docker config
 	var auth authn.Authenticator = authn.Anonymous
 	if !strings.HasPrefix(targetRef, "localhost:") {
 		// Try to get credentials from Docker config
-		auth, err = authn.DefaultKeychain.Resolve(tag.Registry)
+		auth, err = authn.DefaultKeychain.Resolve(ref.Context().Registry)
 		if err != nil {
 			fmt.Printf("Warning: Failed to get credentials from Docker config: %v\n", err)
 			fmt.Println("Continuing with anonymous authentication")
@@ -511,8 +886,18 @@ func pushImageToRegistry(imageTarPath, targetRef string) error {
 		}
 	}
 
-	if err := remote.Write(tag, img,
-		remote.WithTransport(insecureTransport),
+	// Multi-architecture images are pushed as a whole index
+	if ii != nil {
+		if err := remote.WriteIndex(ref, ii,
+			remote.WithTransport(transport),
+			remote.WithAuth(auth)); err != nil {
+			return fmt.Errorf("failed to push image index: %w", err)
+		}
+		return nil
+	}
+
+	if err := remote.Write(ref, img,
+		remote.WithTransport(transport),
 		remote.WithAuth(auth)); err != nil {
 		return fmt.Errorf("failed to push image: %w", err)
 	}
@@ -520,57 +905,13 @@ func pushImageToRegistry(imageTarPath, targetRef string) error {
 	return nil
 }
 
-// publishChartsFromBundle publishes Helm charts from a bundle to a chart repository
-func publishChartsFromBundle(bundlePath, namespace, kubeconfigPath string) error {
+// publishChartsFromBundle publishes Helm charts from an unpacked bundle to a chart repository
+func publishChartsFromBundle(bundleDir, namespace string, client *kube.Client) error {
 	fmt.Println("Looking for Helm charts in bundle...")
 
-	// Create a temporary directory for unpacking
-	tempDir, err := os.MkdirTemp("", "capsailer-bundle-")
-	if err != nil {
-		return fmt.Errorf("failed to create temp directory: %w", err)
-	}
-	defer func() {
-		if err := os.RemoveAll(tempDir); err != nil {
-			fmt.Fprintf(os.Stderr, "Error removing temp directory: %v\n", err)
-		}
-	}()
-
-	// Determine the charts directory path
-	var chartsDir string
-	if filepath.Ext(bundlePath) == ".tar" || filepath.Ext(bundlePath) == ".gz" {
-		// Bundle is already extracted in pushImagesFromBundle, reuse that temp dir if possible
-		// But handle the case if this function is called independently
-
-		// Extract the bundle
-		extractCmd := exec.Command("tar", "-xf", bundlePath, "-C", tempDir)
-		extractCmd.Stdout = os.Stdout
-		extractCmd.Stderr = os.Stderr
-		if err := extractCmd.Run(); err != nil {
-			return fmt.Errorf("failed to extract bundle: %w", err)
-		}
-
-		chartsDir = filepath.Join(tempDir, "charts")
-	} else {
-		// Assume bundlePath is a directory that might contain a charts directory
-		potentialChartsDir := filepath.Join(bundlePath, "charts")
-		if _, err := os.Stat(potentialChartsDir); !os.IsNotExist(err) {
-			chartsDir = potentialChartsDir
-		} else {
-			// If no charts subdirectory, assume the specified path is the charts directory
-			chartsDir = bundlePath
-		}
-	}
-
-	// Check if charts directory exists
-	if _, err := os.Stat(chartsDir); os.IsNotExist(err) {
-		fmt.Println("No charts directory found in bundle, skipping chart publishing")
-		return nil
-	}
-
-	// Get list of chart tgz files in the charts directory
-	chartTgzs, err := filepath.Glob(filepath.Join(chartsDir, "*.tgz"))
+	chartTgzs, err := listBundleCharts(bundleDir)
 	if err != nil {
-		return fmt.Errorf("failed to list charts: %w", err)
+		return err
 	}
 
 	if len(chartTgzs) == 0 {
@@ -581,26 +922,26 @@ func publishChartsFromBundle(bundlePath, namespace, kubeconfigPath string) error
 	fmt.Printf("Found %d charts to publish\n", len(chartTgzs))
 
 	// Set up a Helm chart server in Kubernetes if one doesn't already exist
-	if err := setupChartRepository(namespace, kubeconfigPath); err != nil {
+	if err := setupChartRepository(client, namespace); err != nil {
 		return fmt.Errorf("failed to setup chart repository: %w", err)
 	}
 
 	// Get the chart repository URL
-	repoURL, err := getChartRepoURL(namespace, kubeconfigPath)
+	repoURL, err := getChartRepoURL(client, namespace)
 	if err != nil {
 		return fmt.Errorf("failed to get chart repository URL: %w", err)
 	}
 
 	// Port-forward the chartmuseum service to make it accessible to the CLI
 	// This is needed since we're publishing directly from the CLI, not from inside the cluster
-	forwardPort, err := startPortForward(namespace, "chartmuseum", 8080, kubeconfigPath)
+	forward, err := startPortForward(client, namespace, "chartmuseum", 8080)
 	if err != nil {
 		fmt.Printf("Warning: Could not set up port forwarding to chartmuseum: %v\n", err)
 		fmt.Println("Will attempt to publish directly to cluster IP...")
 	} else {
-		defer stopPortForward(forwardPort)
-		// Use localhost for publishing since we have port forwarding
-		repoURL = "http://localhost:8080"
+		defer stopPortForward(forward)
+		// Use the forwarded local port for publishing
+		repoURL = "http://" + forward.Address()
 	}
 
 	// Publish each chart
@@ -619,179 +960,141 @@ func publishChartsFromBundle(bundlePath, namespace, kubeconfigPath string) error
 	return nil
 }
 
-// startPortForward starts port forwarding to a Kubernetes service
-func startPortForward(namespace, serviceName string, port int, kubeconfigPath string) (*os.Process, error) {
-	fmt.Printf("Setting up port forwarding to %s in namespace %s...\n", serviceName, namespace)
+// pushChartsToOCIRegistry pushes the charts of an unpacked bundle to an OCI
+// registry, like `helm push <chart> oci://<registry>/<chartRepository>`
+func pushChartsToOCIRegistry(bundleDir, registryURL, chartRepository, username, password string, tlsConfig *tls.Config) error {
+	chartTgzs, err := listBundleCharts(bundleDir)
+	if err != nil {
+		return err
+	}
 
-	var kubectlArgs []string
-	kubectlArgs = append(kubectlArgs, "port-forward", "-n", namespace, fmt.Sprintf("svc/%s", serviceName), fmt.Sprintf("%d:%d", port, port))
-	if kubeconfigPath != "" {
-		kubectlArgs = append(kubectlArgs, "--kubeconfig", kubeconfigPath)
+	if len(chartTgzs) == 0 {
+		fmt.Println("No chart packages found in bundle, skipping chart publishing")
+		return nil
 	}
 
-	cmd := exec.Command("kubectl", kubectlArgs...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	repoURL := "oci://" + strings.TrimSuffix(registryURL, "/")
+	if chartRepository = strings.Trim(chartRepository, "/"); chartRepository != "" {
+		repoURL += "/" + chartRepository
+	}
+	fmt.Printf("Pushing %d charts to %s\n", len(chartTgzs), repoURL)
 
-	// Start the command without waiting for it to complete
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start port-forward: %w", err)
+	for _, chartTgz := range chartTgzs {
+		ref, err := helm.PushOCIChart(chartTgz, repoURL, username, password, tlsConfig)
+		if err != nil {
+			return fmt.Errorf("failed to push chart %s: %w", filepath.Base(chartTgz), err)
+		}
+		fmt.Printf("Successfully pushed chart: %s\n", ref)
 	}
 
-	// Give it a moment to establish the connection
-	time.Sleep(2 * time.Second)
+	fmt.Printf("All charts have been pushed to %s\n", repoURL)
+	return nil
+}
 
-	return cmd.Process, nil
+// listBundleCharts returns the chart packages stored in an unpacked bundle
+func listBundleCharts(bundleDir string) ([]string, error) {
+	if utils.HasBundleIndex(bundleDir) {
+		index, err := utils.LoadBundleIndex(bundleDir)
+		if err != nil {
+			return nil, err
+		}
+
+		var chartTgzs []string
+		for _, entry := range index.Charts {
+			if entry.InBase {
+				fmt.Printf("Skipping chart %s-%s: unchanged from the base bundle, which must be pushed first\n", entry.Name, entry.Version)
+				continue
+			}
+			chartTgzs = append(chartTgzs, filepath.Join(bundleDir, entry.File))
+		}
+		return chartTgzs, nil
+	}
+
+	// Determine the charts directory path
+	chartsDir := filepath.Join(bundleDir, "charts")
+	if _, err := os.Stat(chartsDir); os.IsNotExist(err) {
+		// If no charts subdirectory, assume the specified path is the charts directory
+		chartsDir = bundleDir
+	}
+
+	// Get list of chart tgz files in the charts directory
+	chartTgzs, err := filepath.Glob(filepath.Join(chartsDir, "*.tgz"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list charts: %w", err)
+	}
+
+	return chartTgzs, nil
 }
 
-// stopPortForward stops a port forwarding process
-func stopPortForward(process *os.Process) {
-	if process != nil {
+// startPortForward forwards a free local port to a port of a Kubernetes
+// service, and waits until the tunnel is ready
+func startPortForward(client *kube.Client, namespace, serviceName string, port int) (*kube.PortForward, error) {
+	fmt.Printf("Setting up port forwarding to %s in namespace %s...\n", serviceName, namespace)
+
+	forward, err := client.PortForwardService(context.Background(), namespace, serviceName, port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start port-forward: %w", err)
+	}
+
+	fmt.Printf("Forwarding %s to %s:%d\n", forward.Address(), serviceName, port)
+	return forward, nil
+}
+
+// stopPortForward stops port forwarding
+func stopPortForward(forward *kube.PortForward) {
+	if forward != nil {
 		fmt.Println("Stopping port forwarding...")
-		if err := process.Kill(); err != nil {
+		if err := forward.Close(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error stopping port forwarding: %v\n", err)
 		}
 	}
 }
 
 // setupChartRepository ensures a Helm chart repository is running
-func setupChartRepository(namespace, kubeconfigPath string) error {
+func setupChartRepository(client *kube.Client, namespace string) error {
 	fmt.Println("Setting up Helm chart repository...")
+	ctx := context.Background()
 
 	// See if chartmuseum is already running
-	var kubectlArgs []string
-	kubectlArgs = append(kubectlArgs, "get", "deployment", "-n", namespace, "chartmuseum", "--ignore-not-found")
-	if kubeconfigPath != "" {
-		kubectlArgs = append(kubectlArgs, "--kubeconfig", kubeconfigPath)
+	exists, err := client.DeploymentExists(ctx, namespace, "chartmuseum")
+	if err != nil {
+		return err
 	}
-
-	cmd := exec.Command("kubectl", kubectlArgs...)
-	output, err := cmd.CombinedOutput()
-	if err == nil && len(output) > 0 && !strings.Contains(string(output), "No resources found") {
+	if exists {
 		fmt.Println("Chart repository is already running")
 		return nil
 	}
 
 	// Create chartmuseum deployment
-	chartMuseumManifest, err := createChartMuseumManifest(namespace)
+	opts := registry.DefaultRegistryOptions()
+	opts.Namespace = namespace
+	opts.PersistentPV = false
+	objects, err := registry.ChartMuseumObjects(opts)
 	if err != nil {
 		return err
 	}
 
-	// Apply the manifest
-	applyArgs := []string{"apply", "-f", chartMuseumManifest}
-	if kubeconfigPath != "" {
-		applyArgs = append(applyArgs, "--kubeconfig", kubeconfigPath)
-	}
-
 	fmt.Println("Creating chart repository...")
-	applyCmd := exec.Command("kubectl", applyArgs...)
-	applyCmd.Stdout = os.Stdout
-	applyCmd.Stderr = os.Stderr
-	if err := applyCmd.Run(); err != nil {
+	if err := client.Apply(ctx, objects...); err != nil {
 		return fmt.Errorf("failed to create chart repository: %w", err)
 	}
 
 	// Wait for deployment to be ready
-	waitArgs := []string{"rollout", "status", "deployment/chartmuseum", "-n", namespace}
-	if kubeconfigPath != "" {
-		waitArgs = append(waitArgs, "--kubeconfig", kubeconfigPath)
-	}
-
 	fmt.Println("Waiting for chart repository to be ready...")
-	waitCmd := exec.Command("kubectl", waitArgs...)
-	waitCmd.Stdout = os.Stdout
-	waitCmd.Stderr = os.Stderr
-	if err := waitCmd.Run(); err != nil {
+	if err := client.WaitForRollout(ctx, namespace, "chartmuseum"); err != nil {
 		return fmt.Errorf("failed waiting for chart repository: %w", err)
 	}
 
 	return nil
 }
 
-// createChartMuseumManifest creates a YAML manifest for chartmuseum
-func createChartMuseumManifest(namespace string) (string, error) {
-	manifest := fmt.Sprintf(`apiVersion: apps/v1
-kind: Deployment
-metadata:
-  name: chartmuseum
-  namespace: %s
-spec:
-  selector:
-    matchLabels:
-      app: chartmuseum
-  replicas: 1
-  template:
-    metadata:
-      labels:
-        app: chartmuseum
-    spec:
-      containers:
-        - name: chartmuseum
-          image: chartmuseum/chartmuseum:latest
-          ports:
-            - containerPort: 8080
-          env:
-            - name: PORT
-              value: "8080"
-            - name: DEBUG
-              value: "true"
-            - name: STORAGE
-              value: "local"
-            - name: STORAGE_LOCAL_ROOTDIR
-              value: "/charts"
-            - name: ALLOW_OVERWRITE
-              value: "true"
-          volumeMounts:
-            - name: charts-data
-              mountPath: /charts
-      volumes:
-        - name: charts-data
-          emptyDir: {}
----
-apiVersion: v1
-kind: Service
-metadata:
-  name: chartmuseum
-  namespace: %s
-spec:
-  selector:
-    app: chartmuseum
-  ports:
-    - port: 8080
-      targetPort: 8080
-  type: ClusterIP
-`, namespace, namespace)
-
-	// Create a temporary file for the manifest
-	manifestPath := filepath.Join(os.TempDir(), "capsailer-chartmuseum.yaml")
-	if err := os.WriteFile(manifestPath, []byte(manifest), 0644); err != nil {
-		return "", fmt.Errorf("failed to write chartmuseum manifest: %w", err)
-	}
-
-	fmt.Printf("Created chartmuseum manifest at %s\n", manifestPath)
-	return manifestPath, nil
-}
-
 // getChartRepoURL gets the URL for the chart repository
-func getChartRepoURL(namespace, kubeconfigPath string) (string, error) {
-	var kubectlArgs []string
-	kubectlArgs = append(kubectlArgs, "get", "service", "-n", namespace, "chartmuseum", "-o", "jsonpath='{.spec.clusterIP}'")
-	if kubeconfigPath != "" {
-		kubectlArgs = append(kubectlArgs, "--kubeconfig", kubeconfigPath)
-	}
-
-	cmd := exec.Command("kubectl", kubectlArgs...)
-	output, err := cmd.Output()
+func getChartRepoURL(client *kube.Client, namespace string) (string, error) {
+	serviceIP, err := client.ServiceClusterIP(context.Background(), namespace, "chartmuseum")
 	if err != nil {
 		return "", fmt.Errorf("failed to get chartmuseum service: %w", err)
 	}
 
-	serviceIP := strings.Trim(string(output), "'")
-	if serviceIP == "" {
-		return "", fmt.Errorf("chartmuseum service not found in namespace %s", namespace)
-	}
-
 	return fmt.Sprintf("http://%s:8080", serviceIP), nil
 }
 
@@ -937,12 +1240,14 @@ func init() {
 		Long: `Deploy a standalone Docker registry and ChartMuseum in your Kubernetes cluster.
 This registry can be used for air-gapped deployments.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			namespace, _ := cmd.Flags().GetString("namespace")
-			image, _ := cmd.Flags().GetString("image")
-			chartImage, _ := cmd.Flags().GetString("chartmuseum-image")
-			persistent, _ := cmd.Flags().GetBool("persistent")
-			kubeconfigPath, _ := cmd.Flags().GetString("kubeconfig")
-			return runRegistry(namespace, image, chartImage, persistent, kubeconfigPath)
+			opts, err := registryOptionsFromFlags(cmd)
+			if err != nil {
+				return err
+			}
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			output, _ := cmd.Flags().GetString("output")
+			caOut, _ := cmd.Flags().GetString("tls-ca-out")
+			return runRegistry(opts, dryRun, output, caOut)
 		},
 	}
 
@@ -951,6 +1256,25 @@ This registry can be used for air-gapped deployments.`,
 	registryCmd.Flags().String("chartmuseum-image", "", "Container image for ChartMuseum (default: ghcr.io/helm/chartmuseum:v0.15.0)")
 	registryCmd.Flags().Bool("persistent", true, "Use persistent storage for the registry")
 	registryCmd.Flags().String("kubeconfig", "", "Path to kubeconfig file")
+	registryCmd.Flags().String("storage-class", "", "Storage class of the persistent volumes (default: the cluster's default)")
+	registryCmd.Flags().String("storage-size", "10Gi", "Size of each persistent volume")
+	registryCmd.Flags().Int32("replicas", 1, "Replicas of the registry deployment; more than one needs a storage class that supports ReadWriteMany")
+	registryCmd.Flags().StringToString("requests", nil, "Resource requests of the containers (e.g., cpu=100m,memory=128Mi)")
+	registryCmd.Flags().StringToString("limits", nil, "Resource limits of the containers (e.g., cpu=1,memory=512Mi)")
+	registryCmd.Flags().StringToString("node-selector", nil, "Node labels the pods must run on (e.g., disktype=ssd)")
+	registryCmd.Flags().StringArray("toleration", nil, "Taint the pods tolerate, as key[=value][:effect] (can be repeated)")
+	registryCmd.Flags().Int64("run-as-user", 0, "User ID the containers run as")
+	registryCmd.Flags().Int64("run-as-group", 0, "Group ID the containers run as")
+	registryCmd.Flags().Int64("fs-group", 0, "Group ID that owns the mounted volumes")
+	registryCmd.Flags().StringToString("labels", nil, "Labels added to every object (e.g., team=platform)")
+	registryCmd.Flags().Bool("dry-run", false, "Print the Kubernetes objects instead of applying them")
+	registryCmd.Flags().StringP("output", "o", "", "Output format of --dry-run (yaml)")
+	registryCmd.Flags().Bool("tls", false, "Serve the registry over TLS with a certificate from a generated CA")
+	registryCmd.Flags().String("tls-cert", "", "PEM serving certificate for the registry, instead of a generated one")
+	registryCmd.Flags().String("tls-key", "", "PEM private key of --tls-cert")
+	registryCmd.Flags().String("tls-ca", "", "PEM CA bundle that signed --tls-cert")
+	registryCmd.Flags().StringArray("tls-san", nil, "Extra host name or IP address of the generated certificate (can be repeated)")
+	registryCmd.Flags().String("tls-ca-out", "", "File to write the registry's CA bundle to")
 
 	// Initialize push command
 	pushCmd := &cobra.Command{
@@ -968,12 +1292,16 @@ You can push a single image or all images from a bundle.`,
 			externalRegistry, _ := cmd.Flags().GetString("external-registry")
 			username, _ := cmd.Flags().GetString("username")
 			password, _ := cmd.Flags().GetString("password")
+			publicKeyPath, _ := cmd.Flags().GetString("public-key")
+			chartRepository, _ := cmd.Flags().GetString("chart-repository")
+			caFile, _ := cmd.Flags().GetString("ca-file")
+			skipTLSVerify, _ := cmd.Flags().GetBool("skip-tls-verify")
 
 			if image == "" && bundlePath == "" && externalRegistry == "" {
 				return fmt.Errorf("either --image, --bundle, or --external-registry must be specified")
 			}
 
-			return runPush(image, bundlePath, namespace, kubeconfigPath, externalRegistry, username, password)
+			return runPush(image, bundlePath, namespace, kubeconfigPath, externalRegistry, username, password, publicKeyPath, chartRepository, caFile, skipTLSVerify)
 		},
 	}
 
@@ -985,6 +1313,10 @@ You can push a single image or all images from a bundle.`,
 	pushCmd.Flags().String("external-registry", "", "External registry to push images to (e.g., artifactory.example.com)")
 	pushCmd.Flags().String("username", "", "Username for authentication with external registry")
 	pushCmd.Flags().String("password", "", "Password for authentication with external registry")
+	pushCmd.Flags().String("public-key", "", "Trusted public key; refuse bundles without a valid signature")
+	pushCmd.Flags().String("ca-file", "", "PEM CA bundle to verify the registry's TLS certificate with")
+	pushCmd.Flags().Bool("skip-tls-verify", false, "Skip TLS verification when pushing to the registry")
+	pushCmd.Flags().String("chart-repository", "charts", "Repository path under the external registry that charts are pushed to as OCI artifacts")
 	// Either image or bundle must be specified, but not marking either as required individually
 
 	// Add commands to root
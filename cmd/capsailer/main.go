@@ -3,9 +3,12 @@ package main
 import (
 	"fmt"
 	"os"
-	"strings"
+	"path/filepath"
 
 	"github.com/capsailer/capsailer-cli/pkg/build"
+	"github.com/capsailer/capsailer-cli/pkg/cache"
+	"github.com/capsailer/capsailer-cli/pkg/deploy"
+	"github.com/capsailer/capsailer-cli/pkg/signing"
 	"github.com/capsailer/capsailer-cli/pkg/utils"
 	"github.com/spf13/cobra"
 )
@@ -36,7 +39,10 @@ var buildCmd = &cobra.Command{
 	Use:   "build",
 	Short: "Build a deployable bundle from a manifest",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return runBuild(manifestFile, outputFile, rewriteImageRefs, registryURL)
+		if noCache {
+			cacheDir = ""
+		}
+		return runBuild(manifestFile, outputFile, rewriteImageRefs, registryURL, signingKey, lockedBuild, baseBundle, splitSize, cacheDir, authFile, configFile, autoImages)
 	},
 }
 
@@ -44,18 +50,75 @@ var unpackCmd = &cobra.Command{
 	Use:   "unpack",
 	Short: "Unpack a bundle in an air-gapped environment",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return runUnpack(bundleFile)
+		return runUnpack(bundleFile, unpackDir, publicKey)
+	},
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify the integrity of a bundle",
+	Long: `Verify a bundle archive or unpacked bundle directory offline.
+Every file is checked against the SHA-256 checksums recorded in the bundle index,
+and the archive itself is checked against its .sha256 file when one is present.
+Missing, extra and corrupted files are reported.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runVerify(bundleFile, publicKey)
+	},
+}
+
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate a key pair for signing bundles",
+	Long: `Generate a key pair for signing bundles offline.
+Keep the private key on the build side and ship the public key to the
+air-gapped side separately from the bundles it is used to verify.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runKeygen(keyAlgorithm, privateKeyPath, publicKeyPath)
+	},
+}
+
+var deployCmd = &cobra.Command{
+	Use:   "deploy",
+	Short: "Deploy charts from an unpacked bundle",
+	Long: `Deploy Helm charts from an unpacked bundle into the cluster.
+With --chart a single chart is installed; otherwise every chart listed in the
+bundle's manifest.yaml is installed with its bundled values file.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runDeploy(bundleDir, chartName, valuesFile, deployNamespace, releaseName, registryURL, registryNamespace, kubeconfigPath)
 	},
 }
 
+// defaultBundleDir is where unpack extracts bundles, and where the commands
+// that use an unpacked bundle look for it
+const defaultBundleDir = "unpacked-bundle"
+
 // Global flags
 var manifestFile string
 var outputFile string
 var bundleFile string
+var unpackDir string
 var kubeconfigPath string
 var registryNamespace string
 var rewriteImageRefs bool
 var registryURL string
+var bundleDir string
+var chartName string
+var valuesFile string
+var deployNamespace string
+var releaseName string
+var signingKey string
+var publicKey string
+var publicKeyPath string
+var privateKeyPath string
+var keyAlgorithm string
+var lockedBuild bool
+var baseBundle string
+var splitSize string
+var cacheDir string
+var noCache bool
+var authFile string
+var configFile string
+var autoImages bool
 
 func init() {
 	// init command flags
@@ -66,17 +129,53 @@ func init() {
 	buildCmd.Flags().StringVar(&outputFile, "output", "capsailer-bundle.tar.gz", "Output file path")
 	buildCmd.Flags().BoolVar(&rewriteImageRefs, "rewrite-image-references", false, "Rewrite image references in Helm charts to use a private registry")
 	buildCmd.Flags().StringVar(&registryURL, "registry-url", "", "URL of the private registry to use when rewriting image references")
+	buildCmd.Flags().StringVar(&signingKey, "signing-key", "", "Path to a PEM private key (ed25519 or ECDSA) used to sign the bundle; cosign encrypted keys read their password from $COSIGN_PASSWORD")
+	buildCmd.Flags().BoolVar(&lockedBuild, "locked", false, "Build exactly the digests in the manifest lockfile and fail if a registry serves something different")
+	buildCmd.Flags().StringVar(&baseBundle, "base", "", "Previous bundle to build a delta against; only images, layers and charts it lacks are included")
+	buildCmd.Flags().StringVar(&splitSize, "split-size", "", "Split the bundle into numbered volumes of at most this size (e.g. 4G, 700M)")
+	buildCmd.Flags().StringVar(&cacheDir, "cache-dir", cache.DefaultDir(), "Directory for the download cache shared between builds (env "+cache.EnvCacheDir+")")
+	buildCmd.Flags().BoolVar(&noCache, "no-cache", false, "Download everything again without using the download cache")
+	buildCmd.Flags().StringVar(&authFile, "auth-file", "", "Registry credentials file in Docker config.json format, used before docker login credentials")
+	buildCmd.Flags().StringVar(&configFile, "config", "", "Path to the capsailer config file (default $"+utils.EnvConfigFile+" or capsailer/config.yaml in the user config directory)")
+	buildCmd.Flags().BoolVar(&autoImages, "auto-images", false, "Analyze the charts and add the images they use that the manifest does not list")
 
 	// unpack command flags
 	unpackCmd.Flags().StringVar(&bundleFile, "file", "", "Path to the bundle file")
 	if err := unpackCmd.MarkFlagRequired("file"); err != nil {
 		fmt.Printf("Error marking flag as required: %v\n", err)
 	}
+	unpackCmd.Flags().StringVar(&unpackDir, "output", defaultBundleDir, "Directory to extract the bundle to")
+	unpackCmd.Flags().StringVar(&publicKey, "public-key", "", "Trusted public key; refuse bundles without a valid signature")
+
+	// verify command flags
+	verifyCmd.Flags().StringVar(&bundleFile, "bundle", "", "Path to the bundle file or unpacked bundle directory")
+	if err := verifyCmd.MarkFlagRequired("bundle"); err != nil {
+		fmt.Printf("Error marking flag as required: %v\n", err)
+	}
+	verifyCmd.Flags().StringVar(&publicKey, "public-key", "", "Trusted public key; require a valid bundle signature")
+
+	// keygen command flags
+	keygenCmd.Flags().StringVar(&privateKeyPath, "private-key", "capsailer.key", "Path to write the private key")
+	keygenCmd.Flags().StringVar(&publicKeyPath, "public-key", "capsailer.pub", "Path to write the public key")
+	keygenCmd.Flags().StringVar(&keyAlgorithm, "algorithm", signing.AlgorithmEd25519, "Key algorithm: ed25519 or ecdsa-p256")
+
+	// deploy command flags
+	deployCmd.Flags().StringVar(&bundleDir, "bundle-dir", defaultBundleDir, "Directory containing the unpacked bundle")
+	deployCmd.Flags().StringVar(&chartName, "chart", "", "Name of a single chart to deploy (default: all charts in the bundle manifest)")
+	deployCmd.Flags().StringVar(&valuesFile, "values", "", "Values file to use for the chart (requires --chart)")
+	deployCmd.Flags().StringVar(&deployNamespace, "namespace", "default", "Kubernetes namespace to deploy into")
+	deployCmd.Flags().StringVar(&releaseName, "release-name", "", "Helm release name (default: chart name, requires --chart)")
+	deployCmd.Flags().StringVar(&registryURL, "registry", "", "Registry that image references are rewritten to (default: registry.<registry-namespace>.svc.cluster.local:5000)")
+	deployCmd.Flags().StringVar(&registryNamespace, "registry-namespace", "capsailer-registry", "Kubernetes namespace where the registry and ChartMuseum are deployed")
+	deployCmd.Flags().StringVar(&kubeconfigPath, "kubeconfig", "", "Path to kubeconfig file")
 
 	// Add commands to root
 	rootCmd.AddCommand(initCmd)
 	rootCmd.AddCommand(buildCmd)
 	rootCmd.AddCommand(unpackCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rootCmd.AddCommand(keygenCmd)
+	rootCmd.AddCommand(deployCmd)
 	// registry and push commands added in commands.go
 }
 
@@ -108,56 +207,55 @@ func runInit(manifestPath string) error {
 		fmt.Println("Example:")
 		fmt.Println("  capsailer build --manifest manifest.yaml --output bundle.tar.gz \\")
 		fmt.Println("    --rewrite-image-references --registry-url registry.local:5000")
-		
-		// Check if there are potential image references in chart names
-		var potentialImageRefs []string
-		for _, chart := range manifest.Charts {
-			// Common chart names that likely use images with the same name
-			if chart.Name == "nginx" || chart.Name == "redis" || chart.Name == "postgresql" || 
-			   chart.Name == "mysql" || chart.Name == "mongodb" || chart.Name == "elasticsearch" ||
-			   chart.Name == "prometheus" || chart.Name == "grafana" {
-				
-				// Check if an image with this name is in the manifest
-				found := false
-				for _, img := range manifest.Images {
-					if strings.Contains(img, chart.Name) {
-						found = true
-						break
-					}
-				}
-				
-				if !found {
-					potentialImageRefs = append(potentialImageRefs, chart.Name)
-				}
-			}
-		}
-		
-		// Warn about potential missing images
-		if len(potentialImageRefs) > 0 {
-			fmt.Println("\nPotential missing images:")
-			fmt.Println("------------------------")
-			fmt.Println("The following charts may require images that are not in your manifest:")
-			for _, name := range potentialImageRefs {
-				fmt.Printf("  - Chart '%s' may need image '%s' or 'bitnami/%s'\n", name, name, name)
-			}
-			fmt.Println("\nConsider adding these images to your manifest to ensure they're included in the bundle.")
-		}
+		fmt.Println("")
+		fmt.Println("Images used by the charts but missing from the manifest can be found")
+		fmt.Println("and added to the bundle with:")
+		fmt.Println("  capsailer build --manifest manifest.yaml --auto-images")
 	}
 
 	return nil
 }
 
 // runBuild handles the build command
-func runBuild(manifestPath, outputPath string, rewriteImageRefs bool, registryURL string) error {
+func runBuild(manifestPath, outputPath string, rewriteImageRefs bool, registryURL, signingKey string, locked bool, basePath, splitSize, cacheDir, authFile, configPath string, autoImages bool) error {
 	fmt.Printf("Building bundle from manifest %s\n", manifestPath)
 
+	// Registry credentials and mirrors can come from the config file
+	cfg, err := utils.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if authFile == "" {
+		authFile = cfg.AuthFile
+	}
+
+	var volumeSize int64
+	if splitSize != "" {
+		size, err := utils.ParseSize(splitSize)
+		if err != nil {
+			return err
+		}
+		if size <= utils.VolumeHeaderSize {
+			return fmt.Errorf("split size must be larger than the %d byte volume header", utils.VolumeHeaderSize)
+		}
+		volumeSize = size
+	}
+
 	// Create builder with options
 	builder := build.NewBuilder(build.BuildOptions{
-		ManifestPath:          manifestPath,
-		OutputPath:            outputPath,
-		Parallel:              4,
+		ManifestPath:           manifestPath,
+		OutputPath:             outputPath,
+		Parallel:               4,
 		RewriteImageReferences: rewriteImageRefs,
-		RegistryURL:           registryURL,
+		RegistryURL:            registryURL,
+		SigningKey:             signingKey,
+		Locked:                 locked,
+		BasePath:               basePath,
+		SplitSize:              volumeSize,
+		CacheDir:               cacheDir,
+		AuthFile:               authFile,
+		Registries:             cfg.Registries,
+		AutoImages:             autoImages,
 	})
 
 	// Run the build
@@ -169,13 +267,15 @@ func runBuild(manifestPath, outputPath string, rewriteImageRefs bool, registryUR
 }
 
 // runUnpack handles the unpack command
-func runUnpack(bundlePath string) error {
+func runUnpack(bundlePath, outputDir, publicKeyPath string) error {
 	fmt.Printf("Unpacking bundle from %s\n", bundlePath)
 
 	// Create unpacker with options
 	unpacker := utils.NewUnpacker(utils.UnpackOptions{
-		BundlePath: bundlePath,
-		OutputDir:  ".",
+		BundlePath:    bundlePath,
+		OutputDir:     outputDir,
+		Verify:        true,
+		PublicKeyPath: publicKeyPath,
 	})
 
 	// Extract the bundle
@@ -183,10 +283,168 @@ func runUnpack(bundlePath string) error {
 		return fmt.Errorf("unpacking failed: %w", err)
 	}
 
+	// Summarize the contents recorded in the bundle index
+	if utils.HasBundleIndex(unpacker.Options.OutputDir) {
+		index, err := utils.LoadBundleIndex(unpacker.Options.OutputDir)
+		if err != nil {
+			return err
+		}
+
+		if index.IsDelta() {
+			fmt.Printf("This is a delta bundle against base %s (%d layers left out).\n", index.Delta.BaseDigest, len(index.Delta.OmittedBlobs))
+		}
+		fmt.Printf("Bundle contains %d images and %d charts:\n", len(index.Images), len(index.Charts))
+		for _, img := range index.Images {
+			fmt.Printf("  image  %s (%s, %d bytes) -> %s\n", img.Reference, img.Digest, img.Size, img.File)
+		}
+		for _, chart := range index.Charts {
+			version := chart.Version
+			if chart.Constraint != "" {
+				version = fmt.Sprintf("%s (%s)", chart.Version, chart.Constraint)
+			}
+			if chart.InBase {
+				fmt.Printf("  chart  %s %s from %s -> in base bundle\n", chart.Name, version, chart.Repo)
+				continue
+			}
+			fmt.Printf("  chart  %s %s from %s (%d bytes) -> %s\n", chart.Name, version, chart.Repo, chart.Size, chart.File)
+		}
+	}
+
 	fmt.Println("Bundle unpacked successfully.")
 	return nil
 }
 
+// runVerify handles the verify command
+func runVerify(bundlePath, publicKeyPath string) error {
+	fmt.Printf("Verifying bundle %s\n", bundlePath)
+
+	result, err := utils.VerifyBundle(bundlePath, utils.VerifyOptions{PublicKeyPath: publicKeyPath})
+	if err != nil {
+		return err
+	}
+
+	result.Print(os.Stdout)
+	if err := result.Err(); err != nil {
+		return err
+	}
+
+	fmt.Println("Bundle verified successfully.")
+	return nil
+}
+
+// runKeygen handles the keygen command
+func runKeygen(algorithm, privateKeyPath, publicKeyPath string) error {
+	for _, path := range []string{privateKeyPath, publicKeyPath} {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("refusing to overwrite existing key file %s", path)
+		}
+	}
+
+	if err := signing.GenerateKeyPair(algorithm, privateKeyPath, publicKeyPath); err != nil {
+		return err
+	}
+
+	fmt.Printf("Private key written to %s (keep this secret)\n", privateKeyPath)
+	fmt.Printf("Public key written to %s\n", publicKeyPath)
+	return nil
+}
+
+// runDeploy handles the deploy command
+func runDeploy(bundleDir, chartName, valuesFile, namespace, releaseName, registryURL, registryNamespace, kubeconfigPath string) error {
+	if registryURL == "" {
+		registryURL = fmt.Sprintf("registry.%s.svc.cluster.local:5000", registryNamespace)
+	}
+
+	// Deploy a single chart when one was requested
+	if chartName != "" {
+		deployer := deploy.NewDeployer(deploy.DeployOptions{
+			ChartName:         chartName,
+			ValuesFile:        valuesFile,
+			Namespace:         namespace,
+			ReleaseName:       releaseName,
+			Registry:          registryURL,
+			KubeconfigPath:    kubeconfigPath,
+			RegistryNamespace: registryNamespace,
+			BundleDir:         bundleDir,
+		})
+		return deployer.Deploy()
+	}
+
+	if valuesFile != "" || releaseName != "" {
+		return fmt.Errorf("--values and --release-name can only be used together with --chart")
+	}
+
+	// Otherwise deploy every chart in the bundle
+	charts, err := listDeployableCharts(bundleDir)
+	if err != nil {
+		return err
+	}
+
+	if len(charts) == 0 {
+		fmt.Println("Bundle contains no charts to deploy.")
+		return nil
+	}
+
+	fmt.Printf("Deploying %d charts from bundle in %s\n", len(charts), bundleDir)
+	for _, chart := range charts {
+		deployer := deploy.NewDeployer(deploy.DeployOptions{
+			ChartName:         chart.Name,
+			ChartVersion:      chart.Version,
+			ValuesFile:        chart.ValuesFile,
+			Namespace:         namespace,
+			Registry:          registryURL,
+			KubeconfigPath:    kubeconfigPath,
+			RegistryNamespace: registryNamespace,
+			BundleDir:         bundleDir,
+		})
+		if err := deployer.Deploy(); err != nil {
+			return fmt.Errorf("failed to deploy chart %s: %w", chart.Name, err)
+		}
+	}
+
+	fmt.Println("All charts from bundle have been deployed.")
+	return nil
+}
+
+// listDeployableCharts returns the charts in an unpacked bundle with their values
+// files resolved. The bundle index is used when present, otherwise the manifest.
+// Charts that a delta bundle left out because its base has them are skipped.
+func listDeployableCharts(bundleDir string) ([]utils.Chart, error) {
+	if !utils.HasBundleIndex(bundleDir) {
+		manifest, err := utils.LoadBundleManifest(bundleDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load bundle manifest: %w", err)
+		}
+		return manifest.Charts, nil
+	}
+
+	index, err := utils.LoadBundleIndex(bundleDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var charts []utils.Chart
+	for _, entry := range index.Charts {
+		// A delta leaves out charts that are unchanged since its base, which
+		// deployed them already
+		if entry.InBase {
+			fmt.Printf("Chart %s-%s is unchanged from the base bundle, skipping it\n", entry.Name, entry.Version)
+			continue
+		}
+		chart := utils.Chart{
+			Name:    entry.Name,
+			Repo:    entry.Repo,
+			Version: entry.Version,
+		}
+		if entry.ValuesFile != "" {
+			chart.ValuesFile = filepath.Join(bundleDir, entry.ValuesFile)
+		}
+		charts = append(charts, chart)
+	}
+
+	return charts, nil
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
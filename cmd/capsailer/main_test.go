@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/capsailer/capsailer-cli/pkg/utils"
+)
+
+func TestListDeployableCharts(t *testing.T) {
+	// A delta bundle lists the charts it left out for its base
+	bundleDir := t.TempDir()
+	index := utils.NewBundleIndex()
+	index.Delta = &utils.DeltaInfo{BaseDigest: "sha256:0123"}
+	index.Charts = []utils.ChartEntry{
+		{Name: "app", Version: "1.1.0", Repo: "https://charts.example.com", File: "charts/app-1.1.0.tgz", ValuesFile: "values/app-values.yaml"},
+		{Name: "db", Version: "16.2.0", Repo: "https://charts.example.com", InBase: true},
+	}
+	if err := utils.SaveBundleIndex(index, bundleDir); err != nil {
+		t.Fatalf("Failed to save bundle index: %v", err)
+	}
+
+	charts, err := listDeployableCharts(bundleDir)
+	if err != nil {
+		t.Fatalf("Failed to list charts: %v", err)
+	}
+	want := []utils.Chart{{
+		Name:       "app",
+		Repo:       "https://charts.example.com",
+		Version:    "1.1.0",
+		ValuesFile: filepath.Join(bundleDir, "values/app-values.yaml"),
+	}}
+	if !reflect.DeepEqual(charts, want) {
+		t.Errorf("Expected %+v, got %+v", want, charts)
+	}
+}
+
+func TestListDeployableChartsFromManifest(t *testing.T) {
+	// Bundles built before the index was added only carry their manifest
+	bundleDir := t.TempDir()
+	manifest := `apiVersion: capsailer.io/v1
+kind: Manifest
+images:
+  - name: nginx:1.25
+charts:
+  - name: app
+    repo: https://charts.example.com
+    version: 1.0.0
+    valuesFile: ./values/app-values.yaml
+`
+	if err := os.WriteFile(filepath.Join(bundleDir, "manifest.yaml"), []byte(manifest), 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	// The build copies values files next to the charts
+	if err := os.MkdirAll(filepath.Join(bundleDir, "charts"), 0755); err != nil {
+		t.Fatalf("Failed to create charts directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(bundleDir, "charts", "app-values.yaml"), []byte("replicas: 2\n"), 0644); err != nil {
+		t.Fatalf("Failed to write values file: %v", err)
+	}
+
+	charts, err := listDeployableCharts(bundleDir)
+	if err != nil {
+		t.Fatalf("Failed to list charts: %v", err)
+	}
+	want := []utils.Chart{{
+		Name:       "app",
+		Repo:       "https://charts.example.com",
+		Version:    "1.0.0",
+		ValuesFile: filepath.Join(bundleDir, "charts", "app-values.yaml"),
+	}}
+	if !reflect.DeepEqual(charts, want) {
+		t.Errorf("Expected %+v, got %+v", want, charts)
+	}
+}
+
+func TestRunDeployRequiresChartForChartOptions(t *testing.T) {
+	tests := map[string]struct {
+		valuesFile  string
+		releaseName string
+	}{
+		"values":       {valuesFile: "values.yaml"},
+		"release name": {releaseName: "app"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := runDeploy(t.TempDir(), "", tt.valuesFile, "default", tt.releaseName, "", "capsailer-registry", "")
+			if err == nil || !strings.Contains(err.Error(), "only be used together with --chart") {
+				t.Errorf("Expected the option to be refused without --chart, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestListBundleImagesKeepsReferences(t *testing.T) {
+	// Tar filenames lose the registry port, the index keeps the reference as is
+	bundleDir := t.TempDir()
+	index := utils.NewBundleIndex()
+	index.Images = []utils.ImageEntry{
+		{Reference: "localhost:5000/org/image:tag", Digest: "sha256:0123", File: "images"},
+	}
+	if err := utils.SaveBundleIndex(index, bundleDir); err != nil {
+		t.Fatalf("Failed to save bundle index: %v", err)
+	}
+
+	images, err := listBundleImages(bundleDir)
+	if err != nil {
+		t.Fatalf("Failed to list images: %v", err)
+	}
+	want := []bundleImage{{
+		Reference: "localhost:5000/org/image:tag",
+		File:      filepath.Join(bundleDir, "images"),
+		Digest:    "sha256:0123",
+		InLayout:  true,
+	}}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("Expected %+v, got %+v", want, images)
+	}
+
+	if img, ok := findBundleImage(bundleDir, "localhost:5000/org/image:tag"); !ok || img.Digest != "sha256:0123" {
+		t.Errorf("Expected to find the image by its reference, got %+v, %v", img, ok)
+	}
+}
@@ -5,16 +5,19 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/capsailer/capsailer-cli/pkg/cache"
 	"github.com/capsailer/capsailer-cli/pkg/helm"
+	"github.com/capsailer/capsailer-cli/pkg/image"
+	"github.com/capsailer/capsailer-cli/pkg/signing"
 	"github.com/capsailer/capsailer-cli/pkg/utils"
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
-	"github.com/google/go-containerregistry/pkg/v1/tarball"
-	"helm.sh/helm/v3/pkg/getter"
 	"helm.sh/helm/v3/pkg/repo"
 )
 
@@ -25,12 +28,27 @@ type BuildOptions struct {
 	Parallel               int
 	RewriteImageReferences bool
 	RegistryURL            string
+	SigningKey             string                 // Private key used to sign the bundle index
+	Locked                 bool                   // Build exactly the digests pinned in the manifest lockfile
+	BasePath               string                 // Previous bundle to build a delta against
+	SplitSize              int64                  // Split the bundle into volumes of at most this many bytes, 0 to keep one file
+	CacheDir               string                 // Persistent download cache shared between builds, empty to disable
+	AuthFile               string                 // Registry credentials file in Docker config.json format
+	Registries             []utils.RegistryConfig // Mirror and rewrite rules from the config file
+	AutoImages             bool                   // Add the images that charts use but the manifest does not list
 }
 
 // Builder handles the build process
 type Builder struct {
-	options BuildOptions
-	tracker *utils.ProgressTracker
+	options  BuildOptions
+	tracker  *utils.ProgressTracker
+	index    *utils.BundleIndex
+	lock     *utils.Lockfile   // Lockfile being written, or the one being enforced in locked mode
+	base     *utils.BaseBundle // Base bundle when building a delta
+	cache    *cache.Cache      // Download cache, nil when disabled
+	keychain authn.Keychain    // Registry credentials for image pulls
+	mirrors  *image.Mirrors    // Where images are pulled from
+	mu       sync.Mutex        // guards index and lock during parallel downloads
 }
 
 // NewBuilder creates a new Builder with the given options
@@ -38,6 +56,8 @@ func NewBuilder(options BuildOptions) *Builder {
 	return &Builder{
 		options: options,
 		tracker: utils.NewProgressTracker(),
+		index:   utils.NewBundleIndex(),
+		lock:    utils.NewLockfile(),
 	}
 }
 
@@ -60,6 +80,58 @@ func (b *Builder) Build() error {
 		return fmt.Errorf("failed to load manifest: %w", err)
 	}
 
+	// In locked mode, enforce the digests from the lockfile
+	lockPath := utils.LockfilePath(b.options.ManifestPath)
+	if b.options.Locked {
+		lock, err := utils.LoadLockfile(lockPath)
+		if err != nil {
+			return fmt.Errorf("locked build requires a lockfile, run a build without --locked first: %w", err)
+		}
+		if err := lock.CheckManifest(manifest); err != nil {
+			return err
+		}
+		b.lock = lock
+		// Use the lock time so that rebuilds produce identical bundles
+		b.index.CreatedAt = lock.GeneratedAt
+		fmt.Printf("Building locked digests from %s\n", lockPath)
+	}
+
+	// Read what the base bundle already provides
+	if b.options.BasePath != "" {
+		fmt.Printf("Reading base bundle %s...\n", b.options.BasePath)
+		base, err := utils.LoadBaseBundle(b.options.BasePath)
+		if err != nil {
+			return err
+		}
+		b.base = base
+		b.index.Delta = &utils.DeltaInfo{
+			BaseDigest:    base.Digest,
+			BaseCreatedAt: base.Index.CreatedAt,
+			OmittedBlobs:  []string{},
+		}
+		fmt.Printf("Building a delta bundle against base %s\n", base.Digest)
+	}
+
+	// Set up registry credentials and mirrors; manifest rules take precedence
+	// over those from the config file
+	if b.keychain, err = image.Keychain(b.options.AuthFile); err != nil {
+		return err
+	}
+	registries := append(append([]utils.RegistryConfig{}, manifest.Registries...), b.options.Registries...)
+	if b.mirrors, err = image.NewMirrors(registries); err != nil {
+		return err
+	}
+
+	// Reuse blobs and charts from earlier or interrupted builds
+	if b.options.CacheDir != "" {
+		c, err := cache.Open(b.options.CacheDir)
+		if err != nil {
+			return err
+		}
+		b.cache = c
+		fmt.Printf("Using download cache %s\n", c.Dir())
+	}
+
 	// Create directory structure
 	imagesDir := filepath.Join(tempDir, "images")
 	chartsDir := filepath.Join(tempDir, "charts")
@@ -72,16 +144,31 @@ func (b *Builder) Build() error {
 		return fmt.Errorf("failed to create charts directory: %w", err)
 	}
 
+	// Download charts first, so that the images they use can be discovered
+	fmt.Println("Downloading charts...")
+	if err := b.downloadCharts(manifest.Charts, chartsDir); err != nil {
+		return fmt.Errorf("failed to download charts: %w", err)
+	}
+
+	if b.options.AutoImages {
+		fmt.Println("Discovering images in charts...")
+		if err := b.discoverImages(manifest, chartsDir); err != nil {
+			return fmt.Errorf("failed to discover chart images: %w", err)
+		}
+	}
+
 	// Download images
 	fmt.Println("Downloading images...")
-	if err := b.downloadImages(manifest.Images, imagesDir); err != nil {
+	if err := b.downloadImages(manifest, imagesDir); err != nil {
 		return fmt.Errorf("failed to download images: %w", err)
 	}
 
-	// Download charts
-	fmt.Println("Downloading charts...")
-	if err := b.downloadCharts(manifest.Charts, chartsDir); err != nil {
-		return fmt.Errorf("failed to download charts: %w", err)
+	// Record the resolved digests in the bundle
+	sort.Slice(b.lock.Images, func(i, j int) bool {
+		return b.lock.Images[i].Reference < b.lock.Images[j].Reference
+	})
+	if err := utils.SaveLockfile(b.lock, filepath.Join(tempDir, filepath.Base(lockPath))); err != nil {
+		return err
 	}
 
 	// Rewrite image references in charts if requested
@@ -91,7 +178,11 @@ func (b *Builder) Build() error {
 		}
 
 		fmt.Println("Rewriting image references in Helm charts...")
-		if err := b.rewriteImageReferencesInCharts(manifest.Charts, chartsDir); err != nil {
+		rewriter, err := image.NewRewriter(b.options.RegistryURL, manifest.ImageRewrite)
+		if err != nil {
+			return err
+		}
+		if err := b.rewriteImageReferencesInCharts(manifest.Charts, chartsDir, rewriter); err != nil {
 			return fmt.Errorf("failed to rewrite image references: %w", err)
 		}
 	}
@@ -111,34 +202,147 @@ func (b *Builder) Build() error {
 		return fmt.Errorf("failed to write manifest to temp directory: %w", err)
 	}
 
+	// Write the bundle index
+	if err := b.writeIndex(tempDir); err != nil {
+		return fmt.Errorf("failed to write bundle index: %w", err)
+	}
+
+	// Sign the index, which covers every file through its checksums
+	if b.options.SigningKey != "" {
+		fmt.Println("Signing bundle index...")
+		indexPath := filepath.Join(tempDir, utils.BundleIndexFile)
+		if err := signing.SignFile(b.options.SigningKey, indexPath, filepath.Join(tempDir, utils.BundleSignatureFile)); err != nil {
+			return fmt.Errorf("failed to sign bundle: %w", err)
+		}
+	}
+
 	// Create bundle
 	fmt.Println("Creating bundle...")
-	if err := utils.CreateTarGz(tempDir, b.options.OutputPath, b.tracker); err != nil {
+	if err := utils.CreateTarGz(tempDir, b.options.OutputPath, b.index.CreatedAt, b.tracker); err != nil {
 		return fmt.Errorf("failed to create bundle: %w", err)
 	}
 
-	fmt.Printf("Bundle created successfully: %s\n", b.options.OutputPath)
+	// Record the checksum of the whole archive next to it
+	archiveDigest, err := utils.WriteArchiveChecksum(b.options.OutputPath)
+	if err != nil {
+		return fmt.Errorf("failed to write bundle checksum: %w", err)
+	}
+
+	// Write the lockfile next to the manifest once the build has succeeded
+	if !b.options.Locked {
+		if err := utils.SaveLockfile(b.lock, lockPath); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote lockfile: %s\n", lockPath)
+	}
+
+	// Split the archive for removable media; the checksum still covers the whole archive
+	if b.options.SplitSize > 0 {
+		volumes, err := utils.SplitFile(b.options.OutputPath, b.options.SplitSize)
+		if err != nil {
+			return fmt.Errorf("failed to split bundle: %w", err)
+		}
+		fmt.Printf("Bundle created successfully in %d volumes:\n", len(volumes))
+		for _, volume := range volumes {
+			fmt.Printf("  %s\n", volume)
+		}
+	} else {
+		fmt.Printf("Bundle created successfully: %s\n", b.options.OutputPath)
+	}
+	fmt.Printf("Bundle checksum (sha256): %s, written to %s%s\n", archiveDigest, b.options.OutputPath, utils.ChecksumSuffix)
 	return nil
 }
 
-// downloadImages downloads container images in parallel
-func (b *Builder) downloadImages(images []string, outputDir string) error {
+// discoverImages analyzes the downloaded charts and adds the images they use
+// that the manifest does not list, printing what each chart contributed
+func (b *Builder) discoverImages(manifest *utils.Manifest, chartsDir string) error {
+	chartImages, err := helm.AnalyzeChartsInManifest(manifest, chartsDir)
+	if err != nil {
+		return err
+	}
+
+	manifestImages := make([]string, 0, len(manifest.Images))
+	for _, img := range manifest.Images {
+		manifestImages = append(manifestImages, img.Name)
+	}
+	missing := make(map[string]bool)
+	for _, img := range helm.FindImagesNotInManifest(chartImages, manifestImages) {
+		missing[img] = true
+	}
+
+	added := 0
+	for _, chart := range manifest.Charts {
+		fmt.Printf("Chart %s-%s:\n", chart.Name, chart.Version)
+		seen := make(map[string]bool)
+		for _, ref := range chartImages[chart.Name] {
+			img := ref.Image()
+			if seen[img] {
+				continue
+			}
+			seen[img] = true
+
+			var notes []string
+			if ref.Chart != chart.Name {
+				notes = append(notes, "subchart "+ref.Chart)
+			}
+			marker := " "
+			if missing[img] {
+				marker = "+"
+				notes = append(notes, "added")
+				manifest.Images = append(manifest.Images, utils.Image{Name: img})
+				delete(missing, img)
+				added++
+			} else if _, err := name.ParseReference(img); err != nil {
+				notes = append(notes, "ignored, not a valid image reference")
+			}
+
+			line := fmt.Sprintf("  %s %s", marker, img)
+			if len(notes) > 0 {
+				line += " (" + strings.Join(notes, ", ") + ")"
+			}
+			fmt.Println(line)
+		}
+		if len(seen) == 0 {
+			fmt.Println("    no images found")
+		}
+	}
+	fmt.Printf("Added %d images found in charts\n", added)
+
+	return nil
+}
+
+// downloadImages downloads container images in parallel into a single OCI
+// image layout, so layers shared between images are stored only once
+func (b *Builder) downloadImages(manifest *utils.Manifest, outputDir string) error {
+	imageLayout, err := image.CreateLayout(outputDir)
+	if err != nil {
+		return err
+	}
+	if b.base != nil {
+		if err := imageLayout.ExcludeLayers(b.base.Layers); err != nil {
+			return err
+		}
+	}
+	if b.cache != nil {
+		imageLayout.UseCache(b.cache)
+	}
+
 	var wg sync.WaitGroup
 	semaphore := make(chan struct{}, b.options.Parallel)
-	errChan := make(chan error, len(images))
+	errChan := make(chan error, len(manifest.Images))
 
-	for _, image := range images {
+	for _, img := range manifest.Images {
 		wg.Add(1)
 		semaphore <- struct{}{}
 
-		go func(img string) {
+		go func(imageRef string, platforms []string) {
 			defer wg.Done()
 			defer func() { <-semaphore }()
 
-			if err := b.downloadImage(img, outputDir); err != nil {
-				errChan <- fmt.Errorf("failed to download image %s: %w", img, err)
+			if err := b.downloadImage(imageRef, platforms, imageLayout, outputDir); err != nil {
+				errChan <- fmt.Errorf("failed to download image %s: %w", imageRef, err)
 			}
-		}(image)
+		}(img.Name, manifest.ImagePlatforms(img))
 	}
 
 	// Wait for all downloads to complete
@@ -154,172 +358,519 @@ func (b *Builder) downloadImages(images []string, outputDir string) error {
 	// Add a small delay to ensure all progress bars are properly rendered
 	time.Sleep(100 * time.Millisecond)
 
-	return nil
+	if b.cache != nil {
+		fmt.Printf("Reused %d layers from the download cache\n", imageLayout.CachedLayers())
+	}
+
+	if b.base != nil {
+		b.index.Delta.OmittedBlobs = imageLayout.OmittedLayers()
+		fmt.Printf("Left out %d layers that the base bundle already has\n", len(b.index.Delta.OmittedBlobs))
+	}
+
+	// Keep the layout independent of download order
+	return imageLayout.SortIndex()
 }
 
-// downloadImage downloads a single container image using go-containerregistry
-func (b *Builder) downloadImage(image, outputDir string) error {
+// downloadImage downloads a single container image into the OCI layout.
+// Without platforms only the registry default platform is kept; otherwise the
+// image index is kept whole ("all") or filtered to the requested platforms.
+func (b *Builder) downloadImage(imageRef string, platforms []string, imageLayout *image.Layout, outputDir string) error {
 	// Parse the image reference
-	ref, err := name.ParseReference(image)
+	ref, err := name.ParseReference(imageRef)
 	if err != nil {
 		return fmt.Errorf("failed to parse image reference: %w", err)
 	}
 
-	// Pull the image
-	img, err := remote.Image(ref, remote.WithContext(context.Background()))
+	wanted, all, err := image.ParsePlatforms(platforms)
 	if err != nil {
-		return fmt.Errorf("failed to pull image: %w", err)
+		return err
 	}
 
-	// Get image size
-	size, err := img.Size()
+	// Fetch the manifest or image index
+	desc, err := b.fetchImage(ref, imageRef)
 	if err != nil {
-		return fmt.Errorf("failed to get image size: %w", err)
+		return err
 	}
 
-	// Create a filename-safe version of the image name
-	safeImageName := strings.ReplaceAll(image, "/", "_")
-	safeImageName = strings.ReplaceAll(safeImageName, ":", "_")
-	outputPath := filepath.Join(outputDir, safeImageName+".tar")
+	entry := utils.ImageEntry{
+		Reference: imageRef,
+		File:      filepath.Base(outputDir),
+	}
 
-	// Add progress bar
-	b.tracker.AddProgressBar(image, size)
+	if desc.MediaType.IsIndex() && (all || len(wanted) > 0) {
+		ii, err := desc.ImageIndex()
+		if err != nil {
+			return fmt.Errorf("failed to pull image index: %w", err)
+		}
+		if !all {
+			if ii, err = image.FilterIndex(ii, wanted); err != nil {
+				return err
+			}
+		}
 
-	// Create output file
-	outputFile, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
-	}
-	defer outputFile.Close()
+		if entry.Platforms, err = image.IndexPlatforms(ii); err != nil {
+			return err
+		}
+		if entry.Size, err = image.StoredIndexSize(ii); err != nil {
+			return fmt.Errorf("failed to get image size: %w", err)
+		}
 
-	// Save the image as a tarball
-	if err := tarball.WriteToFile(outputPath, ref, img); err != nil {
-		b.tracker.Finish(image) // Ensure we clean up the progress bar on error
-		return fmt.Errorf("failed to save image: %w", err)
+		b.tracker.AddProgressBar(imageRef, entry.Size)
+		stored, err := imageLayout.AppendIndex(ii, imageRef)
+		if err != nil {
+			b.tracker.Finish(imageRef) // Ensure we clean up the progress bar on error
+			return fmt.Errorf("failed to save image: %w", err)
+		}
+		entry.Digest = stored.Digest.String()
+	} else {
+		if !desc.MediaType.IsIndex() && (all || len(wanted) > 0) {
+			fmt.Printf("Note: %s is a single-platform image, storing it as is\n", imageRef)
+		}
+
+		img, err := desc.Image()
+		if err != nil {
+			return fmt.Errorf("failed to pull image: %w", err)
+		}
+
+		// Get the size of everything the image stores in the layout
+		if entry.Size, err = image.StoredSize(img); err != nil {
+			return fmt.Errorf("failed to get image size: %w", err)
+		}
+
+		// Write the image blobs, skipping layers that are already in the layout
+		b.tracker.AddProgressBar(imageRef, entry.Size)
+		stored, err := imageLayout.AppendImage(img, imageRef)
+		if err != nil {
+			b.tracker.Finish(imageRef) // Ensure we clean up the progress bar on error
+			return fmt.Errorf("failed to save image: %w", err)
+		}
+		entry.Digest = stored.Digest.String()
 	}
 
 	// Update progress to 100%
-	b.tracker.Increment(image, size)
+	b.tracker.Increment(imageRef, entry.Size)
 
 	// Mark progress as complete
-	b.tracker.Finish(image)
+	b.tracker.Finish(imageRef)
+
+	// Record the image in the bundle index
+	b.mu.Lock()
+	b.index.Images = append(b.index.Images, entry)
+	b.mu.Unlock()
 
 	return nil
 }
 
-// downloadCharts downloads Helm charts
-func (b *Builder) downloadCharts(charts []utils.Chart, outputDir string) error {
-	for _, chart := range charts {
-		// Create a chart repository
-		repoURL := chart.Repo
-		repoName := fmt.Sprintf("capsailer-%s", chart.Name)
-
-		// Create temp directory for repo cache
-		cacheDir, err := os.MkdirTemp("", "capsailer-helm-cache")
+// fetchImage fetches the manifest or image index for an image and records its
+// digest. In locked mode it checks that the registry still serves the locked
+// digest and pulls by that digest.
+func (b *Builder) fetchImage(ref name.Reference, imageRef string) (*remote.Descriptor, error) {
+	if !b.options.Locked {
+		desc, err := b.pullFromSources(ref, func(source name.Reference) (*remote.Descriptor, error) {
+			return remote.Get(source, b.remoteOptions()...)
+		})
 		if err != nil {
-			return fmt.Errorf("failed to create temp directory for helm cache: %w", err)
+			return nil, fmt.Errorf("failed to pull image: %w", err)
 		}
-		defer func() {
-			if err := os.RemoveAll(cacheDir); err != nil {
-				fmt.Fprintf(os.Stderr, "Error removing cache directory: %v\n", err)
-			}
-		}()
 
-		// Initialize the chart repository and download the index file
-		if err := initChartRepo(repoName, repoURL, cacheDir); err != nil {
-			return fmt.Errorf("failed to initialize chart repository: %w", err)
-		}
+		b.mu.Lock()
+		b.lock.Images = append(b.lock.Images, utils.LockedImage{Reference: imageRef, Digest: desc.Digest.String()})
+		b.mu.Unlock()
+		return desc, nil
+	}
+
+	locked, ok := b.lock.FindImage(imageRef)
+	if !ok {
+		return nil, fmt.Errorf("image is not in the lockfile")
+	}
 
-		// Find the chart version in the index
-		indexPath := filepath.Join(cacheDir, fmt.Sprintf("%s-index.yaml", repoName))
-		indexFile, err := repo.LoadIndexFile(indexPath)
+	return b.pullFromSources(ref, func(source name.Reference) (*remote.Descriptor, error) {
+		current, err := remote.Head(source, b.remoteOptions()...)
 		if err != nil {
-			return fmt.Errorf("failed to load repository index: %w", err)
+			return nil, fmt.Errorf("failed to resolve image digest: %w", err)
+		}
+		if current.Digest.String() != locked.Digest {
+			return nil, fmt.Errorf("registry now serves %s, but the lockfile pins %s", current.Digest, locked.Digest)
 		}
 
-		chartVersions, ok := indexFile.Entries[chart.Name]
-		if !ok {
-			return fmt.Errorf("chart %s not found in repository", chart.Name)
+		desc, err := remote.Get(source.Context().Digest(locked.Digest), b.remoteOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pull image by digest: %w", err)
 		}
+		return desc, nil
+	})
+}
 
-		// Find the requested version
-		var chartURL string
-		for _, ver := range chartVersions {
-			if ver.Version == chart.Version {
-				if len(ver.URLs) == 0 {
-					return fmt.Errorf("no download URL found for chart %s version %s", chart.Name, chart.Version)
-				}
-				chartURL = ver.URLs[0]
-				break
+// pullFromSources runs pull against each location an image can be pulled
+// from, configured mirrors first, and returns the first success
+func (b *Builder) pullFromSources(ref name.Reference, pull func(name.Reference) (*remote.Descriptor, error)) (*remote.Descriptor, error) {
+	sources, err := b.mirrors.Sources(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	for _, source := range sources {
+		desc, err := pull(source)
+		if err != nil {
+			if len(sources) > 1 {
+				errs = append(errs, fmt.Sprintf("%s: %v", source, err))
+			} else {
+				return nil, err
 			}
+			continue
 		}
 
-		if chartURL == "" {
-			return fmt.Errorf("chart version %s not found for %s", chart.Version, chart.Name)
+		if source.String() != ref.String() {
+			fmt.Printf("Pulling %s from %s\n", ref, source)
 		}
-
-		// If URL is relative, prepend the repo URL
-		if !strings.HasPrefix(chartURL, "http://") && !strings.HasPrefix(chartURL, "https://") {
-			chartURL = strings.TrimSuffix(repoURL, "/") + "/" + strings.TrimPrefix(chartURL, "/")
+		if len(errs) > 0 {
+			fmt.Printf("Warning: skipped unavailable sources for %s: %s\n", ref, strings.Join(errs, "; "))
 		}
+		return desc, nil
+	}
 
-		// Add progress bar
-		chartName := fmt.Sprintf("%s-%s", chart.Name, chart.Version)
-		b.tracker.AddProgressBar(chartName, 100) // We'll update this in chunks
+	return nil, fmt.Errorf("no source could provide the image: %s", strings.Join(errs, "; "))
+}
+
+// remoteOptions returns the options for registry requests
+func (b *Builder) remoteOptions() []remote.Option {
+	return []remote.Option{
+		remote.WithContext(context.Background()),
+		remote.WithAuthFromKeychain(b.keychain),
+	}
+}
+
+// downloadCharts downloads Helm charts, taking them from the download cache
+// when possible. Version constraints are resolved, and each chart's version
+// is set to the version that was downloaded.
+func (b *Builder) downloadCharts(charts []utils.Chart, outputDir string) error {
+	for i := range charts {
+		chart := charts[i]
+		constraint := chart.Version
+		progressName := fmt.Sprintf("%s-%s", chart.Name, constraint)
 
-		// Set up HTTP getter
-		getters := getter.Providers{
-			getter.Provider{
-				Schemes: []string{"http", "https"},
-				New:     getter.NewHTTPGetter,
-			},
+		// Add progress bar
+		b.tracker.AddProgressBar(progressName, 100) // We'll update this in chunks
+
+		// A locked chart is known by digest, so the repository is not needed
+		cached := false
+		var locked *utils.LockedChart
+		if b.options.Locked {
+			var ok bool
+			if locked, ok = b.lock.FindChart(chart.Name, constraint, chart.Repo); !ok {
+				b.tracker.Finish(progressName)
+				return fmt.Errorf("chart %s-%s is not in the lockfile", chart.Name, constraint)
+			}
+			chart.Version = locked.Version
+			if b.cache != nil {
+				var err error
+				if cached, err = b.cache.CopyTo(locked.Digest, filepath.Join(outputDir, chartFile(chart))); err != nil {
+					return err
+				}
+			}
 		}
 
-		// Get an HTTP client
-		httpGetter, err := getters.ByScheme("https")
-		if err != nil {
-			return fmt.Errorf("failed to get HTTP getter: %w", err)
+		if !cached {
+			var err error
+			if chart.Version, cached, err = b.downloadChart(chart, outputDir); err != nil {
+				b.tracker.Finish(progressName)
+				return err
+			}
 		}
+		charts[i].Version = chart.Version
 
-		// Download the chart
-		chartFileName := fmt.Sprintf("%s-%s.tgz", chart.Name, chart.Version)
+		chartName := fmt.Sprintf("%s-%s", chart.Name, chart.Version)
+		chartFileName := chartFile(chart)
 		outputPath := filepath.Join(outputDir, chartFileName)
 
-		// Download the chart data
-		data, err := httpGetter.Get(chartURL)
+		// Pin the chart package, or check it against the lockfile
+		digest, err := utils.FileDigest(outputPath)
 		if err != nil {
-			return fmt.Errorf("failed to download chart: %w", err)
+			return err
+		}
+		if b.options.Locked {
+			if locked.Digest != digest {
+				return fmt.Errorf("repository now serves %s for chart %s-%s, but the lockfile pins %s", digest, chart.Name, chart.Version, locked.Digest)
+			}
+		} else {
+			b.lock.Charts = append(b.lock.Charts, utils.LockedChart{
+				Name:       chart.Name,
+				Version:    chart.Version,
+				Constraint: chartConstraint(chart, constraint),
+				Repo:       chart.Repo,
+				Digest:     digest,
+			})
 		}
 
-		// Write chart data to file
-		if err := os.WriteFile(outputPath, data.Bytes(), 0644); err != nil {
-			return fmt.Errorf("failed to write chart file: %w", err)
+		if b.cache != nil && !cached {
+			if err := b.cacheFile(digest, outputPath); err != nil {
+				return err
+			}
+		}
+
+		// Add the subcharts the package declares but does not contain
+		if err := b.vendorDependencies(chart, outputPath); err != nil {
+			b.tracker.Finish(progressName)
+			return err
 		}
 
 		// Update progress to 100%
-		b.tracker.Increment(chartName, 100)
+		b.tracker.Increment(progressName, 100)
 
 		// Mark progress as complete
-		b.tracker.Finish(chartName)
+		b.tracker.Finish(progressName)
+
+		if chart.Version != constraint {
+			fmt.Printf("Resolved chart %s %s to version %s\n", chart.Name, constraint, chart.Version)
+		}
+		if cached {
+			fmt.Printf("Using cached chart %s\n", chartName)
+		}
+
+		// Record the chart in the bundle index
+		b.index.Charts = append(b.index.Charts, utils.ChartEntry{
+			Name:       chart.Name,
+			Version:    chart.Version,
+			Constraint: chartConstraint(chart, constraint),
+			Repo:       chart.Repo,
+			File:       filepath.Join(filepath.Base(outputDir), chartFileName),
+		})
 	}
 
 	return nil
 }
 
-// Helper function to initialize a chart repository
-func initChartRepo(name, url, cacheDir string) error {
-	// Create repo entry
-	entry := &repo.Entry{
-		Name: name,
-		URL:  url,
+// chartFile returns the file name of a chart package
+func chartFile(chart utils.Chart) string {
+	return fmt.Sprintf("%s-%s.tgz", chart.Name, chart.Version)
+}
+
+// chartConstraint returns the manifest version of a chart if it was a
+// constraint rather than the exact version
+func chartConstraint(chart utils.Chart, constraint string) string {
+	if constraint == chart.Version {
+		return ""
+	}
+	return constraint
+}
+
+// vendorDependencies downloads the dependencies a chart package lacks into
+// the package and records them in the lockfile, or in locked mode pins them
+// to the lockfile versions and checks their digests
+func (b *Builder) vendorDependencies(chart utils.Chart, chartPath string) error {
+	repoOpts, err := chartRepoOptions(chart)
+	if err != nil {
+		return fmt.Errorf("chart %s: %w", chart.Name, err)
+	}
+
+	locked, ok := b.lock.FindChart(chart.Name, chart.Version, chart.Repo)
+	if !ok {
+		return fmt.Errorf("chart %s-%s is not in the lockfile", chart.Name, chart.Version)
+	}
+	var pinned map[string]string
+	if b.options.Locked {
+		pinned = make(map[string]string)
+		for _, dep := range locked.Dependencies {
+			pinned[dep.Name] = dep.Version
+		}
+	}
+
+	vendored, err := helm.VendorDependencies(chartPath, chart.Repo, repoOpts, pinned)
+	if err != nil {
+		return fmt.Errorf("chart %s-%s: %w", chart.Name, chart.Version, err)
+	}
+
+	for _, dep := range vendored {
+		if b.options.Locked {
+			var lockedDigest string
+			for _, lockedDep := range locked.Dependencies {
+				if lockedDep.Name == dep.Name && lockedDep.Version == dep.Version {
+					lockedDigest = lockedDep.Digest
+				}
+			}
+			if lockedDigest == "" {
+				return fmt.Errorf("lockfile is out of date, no entry for dependency %s-%s of chart %s-%s", dep.Name, dep.Version, chart.Name, chart.Version)
+			}
+			if lockedDigest != dep.Digest {
+				return fmt.Errorf("repository now serves %s for dependency %s-%s of chart %s-%s, but the lockfile pins %s", dep.Digest, dep.Name, dep.Version, chart.Name, chart.Version, lockedDigest)
+			}
+		} else {
+			locked.Dependencies = append(locked.Dependencies, utils.LockedChart{
+				Name:    dep.Name,
+				Version: dep.Version,
+				Repo:    dep.Repository,
+				Digest:  dep.Digest,
+			})
+		}
+		fmt.Printf("Vendored dependency %s-%s into chart %s-%s\n", dep.Name, dep.Version, chart.Name, chart.Version)
+	}
+
+	return nil
+}
+
+// downloadChart resolves a chart version or constraint in its repository to
+// the highest matching version, writes the package to outputDir and returns
+// the version. When the repository index lists a digest that is already in
+// the download cache, the cached package is used instead.
+func (b *Builder) downloadChart(chart utils.Chart, outputDir string) (string, bool, error) {
+	repoOpts, err := chartRepoOptions(chart)
+	if err != nil {
+		return "", false, fmt.Errorf("chart %s: %w", chart.Name, err)
 	}
 
+	if helm.IsOCIRepo(chart.Repo) {
+		if chart.Version, err = helm.ResolveOCIChartVersion(chart.Repo, chart.Name, chart.Version, repoOpts); err != nil {
+			return "", false, err
+		}
+		return chart.Version, false, downloadOCIChart(chart, repoOpts, filepath.Join(outputDir, chartFile(chart)))
+	}
+
+	// Create a chart repository
+	repoURL := chart.Repo
+	repoName := fmt.Sprintf("capsailer-%s", chart.Name)
+
+	// Create temp directory for repo cache
+	cacheDir, err := os.MkdirTemp("", "capsailer-helm-cache")
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create temp directory for helm cache: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(cacheDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing cache directory: %v\n", err)
+		}
+	}()
+
+	// Initialize the chart repository and download the index file
+	if err := initChartRepo(repoName, repoURL, cacheDir, repoOpts); err != nil {
+		return "", false, fmt.Errorf("failed to initialize chart repository: %w", err)
+	}
+
+	// Find the chart version in the index
+	indexPath := filepath.Join(cacheDir, fmt.Sprintf("%s-index.yaml", repoName))
+	indexFile, err := repo.LoadIndexFile(indexPath)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to load repository index: %w", err)
+	}
+
+	if _, ok := indexFile.Entries[chart.Name]; !ok {
+		return "", false, fmt.Errorf("chart %s not found in repository", chart.Name)
+	}
+
+	// Find the highest version matching the requested one
+	chartVersion, err := indexFile.Get(chart.Name, chart.Version)
+	if err != nil {
+		return "", false, fmt.Errorf("no version of chart %s matches %s", chart.Name, chart.Version)
+	}
+	if len(chartVersion.URLs) == 0 {
+		return "", false, fmt.Errorf("no download URL found for chart %s version %s", chart.Name, chartVersion.Version)
+	}
+	chart.Version = chartVersion.Version
+	chartURL, indexDigest := chartVersion.URLs[0], chartVersion.Digest
+	outputPath := filepath.Join(outputDir, chartFile(chart))
+
+	// Skip the download if the package the index describes is cached
+	if b.cache != nil && indexDigest != "" {
+		cached, err := b.cache.CopyTo("sha256:"+strings.TrimPrefix(indexDigest, "sha256:"), outputPath)
+		if err != nil || cached {
+			return chart.Version, cached, err
+		}
+	}
+
+	// If URL is relative, prepend the repo URL
+	if !strings.HasPrefix(chartURL, "http://") && !strings.HasPrefix(chartURL, "https://") {
+		chartURL = strings.TrimSuffix(repoURL, "/") + "/" + strings.TrimPrefix(chartURL, "/")
+	}
+
+	// Set up HTTP getter
+	getters, err := repoOpts.Getters(repoURL)
+	if err != nil {
+		return "", false, err
+	}
+
+	// Get an HTTP client
+	httpGetter, err := getters.ByScheme("https")
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get HTTP getter: %w", err)
+	}
+
+	// Download the chart data, with the repository's credentials
+	data, err := httpGetter.Get(chartURL, repoOpts.GetterOptions(repoURL)...)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to download chart: %w", err)
+	}
+
+	// Write chart data to file
+	if err := os.WriteFile(outputPath, data.Bytes(), 0644); err != nil {
+		return "", false, fmt.Errorf("failed to write chart file: %w", err)
+	}
+
+	return chart.Version, false, nil
+}
+
+// downloadOCIChart pulls a chart package from an OCI registry
+func downloadOCIChart(chart utils.Chart, repoOpts helm.RepoOptions, outputPath string) error {
+	data, _, err := helm.PullOCIChart(chart.Repo, chart.Name, chart.Version, repoOpts)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(outputPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write chart file: %w", err)
+	}
+
+	return nil
+}
+
+// chartRepoOptions resolves the credentials and TLS settings of a chart
+func chartRepoOptions(chart utils.Chart) (helm.RepoOptions, error) {
+	opts := helm.RepoOptions{
+		CAFile:                chart.CAFile,
+		CertFile:              chart.CertFile,
+		KeyFile:               chart.KeyFile,
+		InsecureSkipTLSVerify: chart.InsecureSkipTLSVerify,
+	}
+
+	if chart.Auth != nil {
+		creds, err := chart.Auth.Credentials()
+		if err != nil {
+			return helm.RepoOptions{}, err
+		}
+		opts.Username = creds.Username
+		opts.Password = creds.Password
+		opts.Token = creds.Token
+	}
+
+	return opts, nil
+}
+
+// cacheFile stores a downloaded file in the download cache
+func (b *Builder) cacheFile(digest, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing file: %v\n", err)
+		}
+	}()
+
+	if err := b.cache.Put(digest, file); err != nil {
+		return fmt.Errorf("failed to cache %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// Helper function to initialize a chart repository
+func initChartRepo(name, url, cacheDir string, repoOpts helm.RepoOptions) error {
+	// Create repo entry with the repository's credentials and TLS settings
+	entry := repoOpts.Entry(name, url)
+
 	// Create providers
-	providers := getter.Providers{
-		getter.Provider{
-			Schemes: []string{"http", "https"},
-			New:     getter.NewHTTPGetter,
-		},
+	providers, err := repoOpts.Getters(url)
+	if err != nil {
+		return err
 	}
 
 	// Create chart repository
@@ -362,15 +913,61 @@ func (b *Builder) copyValuesFiles(charts []utils.Chart, outputDir string) error
 		}
 
 		fmt.Printf("Copied values file: %s\n", outputPath)
+
+		if entry, ok := b.index.FindChart(chart.Name, chart.Version); ok {
+			entry.ValuesFile = filepath.Join(filepath.Base(outputDir), filepath.Base(chart.ValuesFile))
+		}
 	}
 
 	return nil
 }
 
-// rewriteImageReferencesInCharts rewrites image references in all charts
-func (b *Builder) rewriteImageReferencesInCharts(charts []utils.Chart, chartsDir string) error {
+// writeIndex fills in chart sizes and digests, then writes the bundle index.
+// It runs after all files are final, since rewriting changes chart packages.
+func (b *Builder) writeIndex(bundleDir string) error {
+	for i := range b.index.Charts {
+		entry := &b.index.Charts[i]
+		chartPath := filepath.Join(bundleDir, entry.File)
+		info, err := os.Stat(chartPath)
+		if err != nil {
+			return fmt.Errorf("failed to stat chart file for %s: %w", entry.Name, err)
+		}
+		entry.Size = info.Size()
+
+		digest, err := utils.FileDigest(chartPath)
+		if err != nil {
+			return err
+		}
+		entry.Digest = digest
+
+		// A delta leaves out chart packages that are identical in the base
+		if b.base != nil && b.base.HasChart(entry.Name, entry.Version, entry.Digest) {
+			fmt.Printf("Chart %s-%s is unchanged from the base bundle, leaving it out\n", entry.Name, entry.Version)
+			if err := os.Remove(chartPath); err != nil {
+				return fmt.Errorf("failed to remove chart file: %w", err)
+			}
+			entry.InBase = true
+		}
+	}
+
+	// Keep the index stable regardless of download order
+	sort.Slice(b.index.Images, func(i, j int) bool {
+		return b.index.Images[i].Reference < b.index.Images[j].Reference
+	})
+
+	// Record a checksum for every file so the bundle can be verified offline
+	if err := b.index.RecordFiles(bundleDir); err != nil {
+		return err
+	}
+
+	return utils.SaveBundleIndex(b.index, bundleDir)
+}
+
+// rewriteImageReferencesInCharts rewrites image references in all charts to
+// the references push stores the images under
+func (b *Builder) rewriteImageReferencesInCharts(charts []utils.Chart, chartsDir string, rewriter *image.Rewriter) error {
 	for _, chart := range charts {
-		fmt.Printf("Rewriting image references in chart: %s\n", chart.Name)
+		fmt.Printf("Rewriting image references in chart: %s-%s\n", chart.Name, chart.Version)
 
 		// Find the chart file
 		chartPath := filepath.Join(chartsDir, fmt.Sprintf("%s-%s.tgz", chart.Name, chart.Version))
@@ -384,10 +981,16 @@ func (b *Builder) rewriteImageReferencesInCharts(charts []utils.Chart, chartsDir
 			chartPath = matches[0]
 		}
 
-		// Rewrite image references
-		if err := helm.RewriteImageReferences(chartPath, b.options.RegistryURL); err != nil {
+		// Rewrite image references, showing the change for review
+		diff, err := helm.RewriteImageReferences(chartPath, rewriter)
+		if err != nil {
 			return fmt.Errorf("failed to rewrite image references in chart %s: %w", chart.Name, err)
 		}
+		if diff == "" {
+			fmt.Printf("No image references to rewrite in chart: %s-%s\n", chart.Name, chart.Version)
+		} else {
+			fmt.Print(diff)
+		}
 	}
 
 	return nil
@@ -0,0 +1,342 @@
+package build
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/capsailer/capsailer-cli/pkg/helm"
+	"github.com/capsailer/capsailer-cli/pkg/image"
+	"github.com/capsailer/capsailer-cli/pkg/utils"
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+func TestLockedBuild(t *testing.T) {
+	// Keep the registry clients away from the user's credentials
+	t.Setenv("HELM_REGISTRY_CONFIG", filepath.Join(t.TempDir(), "config.json"))
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	server := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	// Registries on localhost are reached over plain HTTP
+	host := strings.Replace(strings.TrimPrefix(server.URL, "http://"), "127.0.0.1", "localhost", 1)
+
+	pushImage(t, host+"/app:1.0")
+	pushChart(t, host, "demo app")
+
+	dir := t.TempDir()
+	manifestPath := filepath.Join(dir, "manifest.yaml")
+	manifest := "images:\n  - " + host + "/app:1.0\ncharts:\n  - name: demo\n    repo: oci://" + host + "/charts\n    version: 1.0.0\n"
+	if err := os.WriteFile(manifestPath, []byte(manifest), 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	build := func(locked bool) error {
+		return NewBuilder(BuildOptions{
+			ManifestPath: manifestPath,
+			OutputPath:   filepath.Join(dir, "bundle.tar.gz"),
+			Parallel:     2,
+			Locked:       locked,
+		}).Build()
+	}
+
+	// A locked build needs the lockfile that a first build writes
+	if err := build(true); err == nil || !strings.Contains(err.Error(), "requires a lockfile") {
+		t.Fatalf("Expected a locked build without lockfile to fail, got: %v", err)
+	}
+	if err := build(false); err != nil {
+		t.Fatalf("Failed to build: %v", err)
+	}
+	if err := build(true); err != nil {
+		t.Fatalf("Failed to build the locked digests: %v", err)
+	}
+
+	// An image tag moved to another image is refused
+	pushImage(t, host+"/app:1.0")
+	if err := build(true); err == nil || !strings.Contains(err.Error(), "registry now serves") {
+		t.Fatalf("Expected an image digest mismatch, got: %v", err)
+	}
+
+	// So is a chart republished under the same version
+	pushChart(t, host, "demo app, changed")
+	if err := build(true); err == nil || !strings.Contains(err.Error(), "repository now serves") {
+		t.Fatalf("Expected a chart digest mismatch, got: %v", err)
+	}
+}
+
+func TestDeltaBuild(t *testing.T) {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	source := newTestRegistry(t, false)
+	shared := randomLayer(t)
+	baseOnly := randomLayer(t)
+	writeImage(t, source+"/base:1.0", shared, baseOnly)
+
+	dir := t.TempDir()
+	build := func(bundle, basePath string, images ...string) {
+		t.Helper()
+		manifestPath := filepath.Join(dir, bundle+".yaml")
+		manifest := "images:\n  - " + strings.Join(images, "\n  - ") + "\n"
+		if err := os.WriteFile(manifestPath, []byte(manifest), 0644); err != nil {
+			t.Fatalf("Failed to write manifest: %v", err)
+		}
+		if err := NewBuilder(BuildOptions{
+			ManifestPath: manifestPath,
+			OutputPath:   filepath.Join(dir, bundle+".tar.gz"),
+			Parallel:     2,
+			BasePath:     basePath,
+		}).Build(); err != nil {
+			t.Fatalf("Failed to build %s: %v", bundle, err)
+		}
+	}
+	build("base", "", source+"/base:1.0")
+
+	// A new repository shares a layer with the base, which only the base
+	// repository has in the registry
+	writeImage(t, source+"/app:1.0", shared, randomLayer(t))
+	writeImage(t, source+"/base:1.1", shared, randomLayer(t))
+	build("delta", filepath.Join(dir, "base.tar.gz"), source+"/base:1.0", source+"/base:1.1", source+"/app:1.0")
+
+	delta, err := utils.LoadBaseBundle(filepath.Join(dir, "delta.tar.gz"))
+	if err != nil {
+		t.Fatalf("Failed to read delta bundle: %v", err)
+	}
+	digest, err := baseOnly.Digest()
+	if err != nil {
+		t.Fatalf("Failed to get layer digest: %v", err)
+	}
+	if want := []string{digest.String()}; !reflect.DeepEqual(delta.Index.Delta.OmittedBlobs, want) {
+		t.Errorf("Expected omitted layers %v, got %v", want, delta.Index.Delta.OmittedBlobs)
+	}
+
+	// The delta pushes after its base, but not on its own
+	target := newTestRegistry(t, true)
+	if err := pushBundle(t, filepath.Join(dir, "delta.tar.gz"), target); err == nil {
+		t.Error("Expected pushing the delta without its base to fail")
+	}
+	target = newTestRegistry(t, true)
+	if err := pushBundle(t, filepath.Join(dir, "base.tar.gz"), target); err != nil {
+		t.Fatalf("Failed to push base bundle: %v", err)
+	}
+	if err := pushBundle(t, filepath.Join(dir, "delta.tar.gz"), target); err != nil {
+		t.Fatalf("Failed to push delta bundle: %v", err)
+	}
+}
+
+func TestDownloadChartResolvesConstraint(t *testing.T) {
+	// Serve a chart repository with several versions of each chart
+	repoDir := t.TempDir()
+	versions := map[string][]string{
+		"db":  {"15.0.0", "15.1.0", "15.1.3", "15.1.4-rc.1", "15.2.0"},
+		"app": {"1.1.0", "1.2.0", "1.9.5", "1.10.0-rc.1", "2.0.0"},
+	}
+	for name, chartVersions := range versions {
+		for _, version := range chartVersions {
+			if _, err := chartutil.Save(&chart.Chart{
+				Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: name, Version: version},
+			}, repoDir); err != nil {
+				t.Fatalf("Failed to package chart: %v", err)
+			}
+		}
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(repoDir)))
+	defer server.Close()
+	index, err := repo.IndexDirectory(repoDir, server.URL)
+	if err != nil {
+		t.Fatalf("Failed to index charts: %v", err)
+	}
+	if err := index.WriteFile(filepath.Join(repoDir, "index.yaml"), 0644); err != nil {
+		t.Fatalf("Failed to write index: %v", err)
+	}
+
+	tests := []struct {
+		name, constraint, want string
+	}{
+		{name: "db", constraint: "~15.1", want: "15.1.3"},
+		{name: "app", constraint: ">=1.2 <2", want: "1.9.5"},
+		{name: "app", constraint: "1.2.0", want: "1.2.0"},
+	}
+
+	builder := NewBuilder(BuildOptions{})
+	for _, tt := range tests {
+		t.Run(tt.name+" "+tt.constraint, func(t *testing.T) {
+			outputDir := t.TempDir()
+			version, _, err := builder.downloadChart(utils.Chart{Name: tt.name, Repo: server.URL, Version: tt.constraint}, outputDir)
+			if err != nil {
+				t.Fatalf("Failed to download chart: %v", err)
+			}
+			if version != tt.want {
+				t.Errorf("Expected %s to resolve to %s, got %s", tt.constraint, tt.want, version)
+			}
+			if _, err := os.Stat(filepath.Join(outputDir, tt.name+"-"+tt.want+".tgz")); err != nil {
+				t.Errorf("Expected the resolved package to be downloaded: %v", err)
+			}
+		})
+	}
+
+	if _, _, err := builder.downloadChart(utils.Chart{Name: "db", Repo: server.URL, Version: "~16"}, t.TempDir()); err == nil {
+		t.Error("Expected error for a constraint no version matches, but got nil")
+	}
+}
+
+// newTestRegistry starts an in-memory registry and returns its host. A scoped
+// registry only serves blobs that were uploaded to the same repository, as
+// real registries do.
+func newTestRegistry(t *testing.T, scoped bool) string {
+	t.Helper()
+
+	handler := ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+	if scoped {
+		handler = &scopedBlobs{handler: handler, blobs: make(map[string]bool)}
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	// Registries on localhost are reached over plain HTTP
+	return strings.Replace(strings.TrimPrefix(server.URL, "http://"), "127.0.0.1", "localhost", 1)
+}
+
+// scopedBlobs hides blobs from repositories they were not uploaded to
+type scopedBlobs struct {
+	handler http.Handler
+
+	mu    sync.Mutex
+	blobs map[string]bool // "<repository>@<digest>"
+}
+
+func (s *scopedBlobs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	repo, target, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/blobs/")
+	if ok {
+		s.mu.Lock()
+		if strings.HasPrefix(target, "uploads") {
+			if digest := r.URL.Query().Get("digest"); digest != "" {
+				s.blobs[repo+"@"+digest] = true
+			}
+		} else if !s.blobs[repo+"@"+target] {
+			s.mu.Unlock()
+			http.Error(w, `{"errors":[{"code":"BLOB_UNKNOWN"}]}`, http.StatusNotFound)
+			return
+		}
+		s.mu.Unlock()
+	}
+	s.handler.ServeHTTP(w, r)
+}
+
+// pushBundle pushes the images of a bundle to a registry like capsailer push
+func pushBundle(t *testing.T, bundlePath, registry string) error {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := utils.NewUnpacker(utils.UnpackOptions{BundlePath: bundlePath, OutputDir: dir}).Unpack(); err != nil {
+		t.Fatalf("Failed to unpack bundle: %v", err)
+	}
+	index, err := utils.LoadBundleIndex(dir)
+	if err != nil {
+		t.Fatalf("Failed to load bundle index: %v", err)
+	}
+	rewriter, err := image.NewRewriter(registry, nil)
+	if err != nil {
+		t.Fatalf("Failed to create rewriter: %v", err)
+	}
+
+	for _, entry := range index.Images {
+		imageLayout, err := image.OpenLayout(filepath.Join(dir, entry.File))
+		if err != nil {
+			t.Fatalf("Failed to open layout: %v", err)
+		}
+		img, err := imageLayout.Image(entry.Digest)
+		if err != nil {
+			t.Fatalf("Failed to read image: %v", err)
+		}
+		target, err := rewriter.Reference(entry.Reference)
+		if err != nil {
+			t.Fatalf("Failed to rewrite reference: %v", err)
+		}
+		ref, err := name.ParseReference(target)
+		if err != nil {
+			t.Fatalf("Failed to parse reference: %v", err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// randomLayer returns a random layer
+func randomLayer(t *testing.T) v1.Layer {
+	t.Helper()
+
+	layer, err := random.Layer(256, types.DockerLayer)
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	return layer
+}
+
+// writeImage pushes an image made of the layers to a registry
+func writeImage(t *testing.T, reference string, layers ...v1.Layer) {
+	t.Helper()
+
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, err := name.ParseReference(reference)
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+}
+
+// pushImage pushes a random image to a registry
+func pushImage(t *testing.T, reference string) {
+	t.Helper()
+
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, err := name.ParseReference(reference)
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+}
+
+// pushChart pushes version 1.0.0 of the demo chart, with a description, to
+// the charts repository of a registry
+func pushChart(t *testing.T, host, description string) {
+	t.Helper()
+
+	packaged, err := chartutil.Save(&chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "demo", Version: "1.0.0", Description: description},
+	}, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to package chart: %v", err)
+	}
+	if _, err := helm.PushOCIChart(packaged, "oci://"+host+"/charts", "", "", nil); err != nil {
+		t.Fatalf("Failed to push chart: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EnvCacheDir is the environment variable that sets the cache directory
+const EnvCacheDir = "CAPSAILER_CACHE_DIR"
+
+// Cache is a persistent, content-addressed store for image blobs and chart
+// packages that is shared between builds. Blobs are stored by their SHA-256
+// digest and only appear once they are complete, so a build that is
+// interrupted leaves behind every blob it finished and nothing else.
+type Cache struct {
+	dir string
+}
+
+// DefaultDir returns the cache directory from CAPSAILER_CACHE_DIR, or a
+// capsailer directory in the user's cache directory
+func DefaultDir() string {
+	if dir := os.Getenv(EnvCacheDir); dir != "" {
+		return dir
+	}
+
+	userCache, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(userCache, "capsailer")
+}
+
+// Open opens the cache in dir, creating it if needed
+func Open(dir string) (*Cache, error) {
+	for _, sub := range []string{filepath.Join("blobs", "sha256"), "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+	}
+
+	return &Cache{dir: dir}, nil
+}
+
+// Dir returns the cache directory
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Has reports whether a blob ("sha256:<hex>") is in the cache
+func (c *Cache) Has(digest string) bool {
+	path, err := c.path(digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// Put stores a blob read from r. The data is written to a temporary file and
+// only moved into place once it matches the digest.
+func (c *Cache) Put(digest string, r io.Reader) error {
+	path, err := c.path(digest)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(c.dir, "tmp"), filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer func() {
+		// Only left behind if the blob was not moved into place
+		if err := os.Remove(tmp.Name()); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Error removing cache file: %v\n", err)
+		}
+	}()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), r); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close cache file: %w", err)
+	}
+
+	if actual := "sha256:" + hex.EncodeToString(hasher.Sum(nil)); actual != digest {
+		return fmt.Errorf("downloaded data has digest %s, expected %s", actual, digest)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store cache file: %w", err)
+	}
+
+	return nil
+}
+
+// CopyTo copies a cached blob to dest, checking its digest on the way. A
+// damaged blob is removed from the cache and reported as missing.
+func (c *Cache) CopyTo(digest, dest string) (bool, error) {
+	path, err := c.path(digest)
+	if err != nil {
+		return false, err
+	}
+
+	in, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to open cache file: %w", err)
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing cache file: %v\n", err)
+		}
+	}()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return false, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hasher), in); err != nil {
+		_ = out.Close()
+		return false, fmt.Errorf("failed to copy cache file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return false, fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if actual := "sha256:" + hex.EncodeToString(hasher.Sum(nil)); actual != digest {
+		fmt.Fprintf(os.Stderr, "Warning: removing damaged cache file %s\n", path)
+		if err := os.Remove(path); err != nil {
+			return false, fmt.Errorf("failed to remove damaged cache file: %w", err)
+		}
+		if err := os.Remove(dest); err != nil {
+			return false, fmt.Errorf("failed to remove file: %w", err)
+		}
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Fetch copies a blob to dest, downloading it into the cache with open first
+// if it is not cached yet. It reports whether the blob came from the cache.
+func (c *Cache) Fetch(digest, dest string, open func() (io.ReadCloser, error)) (bool, error) {
+	if ok, err := c.CopyTo(digest, dest); err != nil || ok {
+		return ok, err
+	}
+
+	rc, err := open()
+	if err != nil {
+		return false, err
+	}
+	err = c.Put(digest, rc)
+	if closeErr := rc.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close download: %w", closeErr)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := c.CopyTo(digest, dest)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, fmt.Errorf("blob %s disappeared from the cache", digest)
+	}
+	return false, nil
+}
+
+// path returns the file of a blob, rejecting digests that are not SHA-256
+func (c *Cache) path(digest string) (string, error) {
+	hexDigest, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hexDigest) != sha256.Size*2 {
+		return "", fmt.Errorf("unsupported digest '%s'", digest)
+	}
+	if _, err := hex.DecodeString(hexDigest); err != nil {
+		return "", fmt.Errorf("unsupported digest '%s'", digest)
+	}
+
+	return filepath.Join(c.dir, "blobs", "sha256", hexDigest), nil
+}
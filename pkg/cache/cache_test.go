@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	c, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open cache: %v", err)
+	}
+
+	data := "chart package"
+	sum := sha256.Sum256([]byte(data))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	// Data that does not match its digest is not stored
+	if err := c.Put(digest, strings.NewReader("something else")); err == nil {
+		t.Error("Expected error for mismatched digest, but got nil")
+	}
+	if c.Has(digest) {
+		t.Error("Expected mismatched data to be left out of the cache")
+	}
+
+	// A miss downloads into the cache, a second fetch is a hit
+	dest := filepath.Join(t.TempDir(), "blob")
+	downloads := 0
+	open := func() (io.ReadCloser, error) {
+		downloads++
+		return io.NopCloser(strings.NewReader(data)), nil
+	}
+	for _, expectHit := range []bool{false, true} {
+		hit, err := c.Fetch(digest, dest, open)
+		if err != nil {
+			t.Fatalf("Failed to fetch blob: %v", err)
+		}
+		if hit != expectHit {
+			t.Errorf("Expected cache hit %v, got %v", expectHit, hit)
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("Expected 1 download, got %d", downloads)
+	}
+
+	content, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("Failed to read blob: %v", err)
+	}
+	if string(content) != data {
+		t.Errorf("Expected blob content %q, got %q", data, content)
+	}
+
+	// A damaged blob is dropped and reported as missing
+	path, err := c.path(digest)
+	if err != nil {
+		t.Fatalf("Failed to get blob path: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("damaged"), 0644); err != nil {
+		t.Fatalf("Failed to damage blob: %v", err)
+	}
+	if hit, err := c.CopyTo(digest, dest); err != nil || hit {
+		t.Errorf("Expected a miss for a damaged blob, got hit %v, error %v", hit, err)
+	}
+	if c.Has(digest) {
+		t.Error("Expected damaged blob to be removed")
+	}
+}
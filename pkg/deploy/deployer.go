@@ -1,32 +1,36 @@
 package deploy
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
-	"time"
 
 	"github.com/capsailer/capsailer-cli/pkg/helm"
+	"github.com/capsailer/capsailer-cli/pkg/image"
+	"github.com/capsailer/capsailer-cli/pkg/kube"
+	"github.com/capsailer/capsailer-cli/pkg/utils"
 	yaml "gopkg.in/yaml.v3"
 )
 
 // DeployOptions defines options for deployment
 type DeployOptions struct {
 	ChartName         string
+	ChartVersion      string
 	ValuesFile        string
 	Namespace         string
 	ReleaseName       string
 	Registry          string
 	KubeconfigPath    string
 	RegistryNamespace string // Namespace where registry and chartmuseum are deployed
+	BundleDir         string // Directory containing an unpacked bundle
 }
 
 // Deployer handles deploying Helm charts
 type Deployer struct {
 	Options DeployOptions
+	kube    *kube.Client
 }
 
 // NewDeployer creates a new Deployer instance
@@ -48,6 +52,10 @@ func NewDeployer(options DeployOptions) *Deployer {
 		options.RegistryNamespace = "capsailer-registry"
 	}
 
+	if options.BundleDir == "" {
+		options.BundleDir = "."
+	}
+
 	return &Deployer{
 		Options: options,
 	}
@@ -68,31 +76,15 @@ func (d *Deployer) Deploy() error {
 		fmt.Printf("Chart '%s' found in ChartMuseum, downloading...\n", d.Options.ChartName)
 
 		// Set up port forwarding to ChartMuseum
-		forwardCmd := exec.Command("kubectl", "port-forward", "-n", d.Options.RegistryNamespace, "svc/chartmuseum", "8080:8080")
-		if d.Options.KubeconfigPath != "" {
-			forwardCmd.Args = append(forwardCmd.Args, "--kubeconfig", d.Options.KubeconfigPath)
-		}
-
-		// Start port-forwarding in background
-		if err := forwardCmd.Start(); err != nil {
-			return fmt.Errorf("failed to start port-forward to ChartMuseum: %w", err)
-		}
-
-		// Ensure we stop the port-forwarding when done
-		defer func() {
-			if forwardCmd.Process != nil {
-				if err := forwardCmd.Process.Kill(); err != nil {
-					fmt.Fprintf(os.Stderr, "Error stopping port forwarding: %v\n", err)
-				}
-			}
-		}()
-
-		// Give port-forwarding time to establish
 		fmt.Println("Setting up port-forwarding to ChartMuseum for download...")
-		time.Sleep(2 * time.Second)
+		forward, err := d.forwardChartMuseum()
+		if err != nil {
+			return err
+		}
+		defer closePortForward(forward)
 
-		// Use localhost URL for chart download
-		repoURL := "http://localhost:8080"
+		// Use the forwarded local port for chart download
+		repoURL := "http://" + forward.Address()
 
 		// Download the chart to a temporary directory
 		tempDir, err := os.MkdirTemp("", "capsailer-chart-")
@@ -119,22 +111,27 @@ func (d *Deployer) Deploy() error {
 		}
 	}
 
-	// Load values file
-	values, err := loadValues(d.Options.ValuesFile)
+	// Load values file, with image references rewritten to where push
+	// stored the images. The rendered workloads are rewritten the same way
+	// while installing.
+	rewrite, err := utils.LoadBundleImageRewrite(d.Options.BundleDir)
 	if err != nil {
-		return fmt.Errorf("failed to load values: %w", err)
+		return err
 	}
-
-	// Rewrite image references in values to use the local registry
-	if err := rewriteImageReferences(values, d.Options.Registry); err != nil {
-		return fmt.Errorf("failed to rewrite image references: %w", err)
+	rewriter, err := image.NewRewriter(d.Options.Registry, rewrite)
+	if err != nil {
+		return err
+	}
+	values, err := loadValues(d.Options.ValuesFile, rewriter)
+	if err != nil {
+		return fmt.Errorf("failed to load values: %w", err)
 	}
 
 	// Install the chart
 	fmt.Printf("Installing chart %s as release %s in namespace %s\n",
 		d.Options.ChartName, d.Options.ReleaseName, d.Options.Namespace)
 
-	if err := helm.InstallChart(chartPath, d.Options.ReleaseName, d.Options.Namespace, values); err != nil {
+	if err := helm.InstallChart(chartPath, d.Options.ReleaseName, d.Options.Namespace, d.Options.KubeconfigPath, values, rewriter); err != nil {
 		return fmt.Errorf("failed to install chart: %w", err)
 	}
 
@@ -144,20 +141,44 @@ func (d *Deployer) Deploy() error {
 
 // findChart looks for a chart in the local charts directory or in ChartMuseum
 func (d *Deployer) findChart(name string) (string, bool, error) {
+	// Use the location recorded in the bundle index when there is one
+	if utils.HasBundleIndex(d.Options.BundleDir) {
+		index, err := utils.LoadBundleIndex(d.Options.BundleDir)
+		if err != nil {
+			return "", false, err
+		}
+		if entry, ok := index.FindChart(name, d.Options.ChartVersion); ok {
+			if entry.InBase {
+				return "", false, fmt.Errorf("chart %s-%s is not in this delta bundle, deploy it from the base bundle", entry.Name, entry.Version)
+			}
+			return filepath.Join(d.Options.BundleDir, entry.File), true, nil
+		}
+	}
+
+	chartsDir := filepath.Join(d.Options.BundleDir, "charts")
+
+	// Prefer the exact version recorded in the bundle manifest
+	if d.Options.ChartVersion != "" {
+		chartPath := filepath.Join(chartsDir, fmt.Sprintf("%s-%s.tgz", name, d.Options.ChartVersion))
+		if _, err := os.Stat(chartPath); err == nil {
+			return chartPath, true, nil
+		}
+	}
+
 	// First, check if chart exists in local charts directory
-	chartPath := filepath.Join("charts", name)
+	chartPath := filepath.Join(chartsDir, name)
 	if _, err := os.Stat(chartPath); err == nil {
 		return chartPath, true, nil
 	}
 
 	// Try with .tgz extension
-	chartPath = filepath.Join("charts", name+".tgz")
+	chartPath = filepath.Join(chartsDir, name+".tgz")
 	if _, err := os.Stat(chartPath); err == nil {
 		return chartPath, true, nil
 	}
 
 	// Try finding by pattern
-	matches, err := filepath.Glob(filepath.Join("charts", name+"-*.tgz"))
+	matches, err := filepath.Glob(filepath.Join(chartsDir, name+"-*.tgz"))
 	if err == nil && len(matches) > 0 {
 		// Use the first match
 		return matches[0], true, nil
@@ -189,34 +210,16 @@ func (d *Deployer) chartExistsInChartMuseum(chartName string) (bool, error) {
 	// We'll use port-forwarding to access it, so we don't need this URL directly
 	_ = fmt.Sprintf("%s/api/charts/%s", repoURL, chartName)
 
-	// Use kubectl port-forward to access ChartMuseum
-	forwardCmd := exec.Command("kubectl", "port-forward", "-n", d.Options.RegistryNamespace, "svc/chartmuseum", "8080:8080")
-	if d.Options.KubeconfigPath != "" {
-		forwardCmd.Args = append(forwardCmd.Args, "--kubeconfig", d.Options.KubeconfigPath)
-	}
-
-	// Start port-forwarding in background
-	if err := forwardCmd.Start(); err != nil {
-		return false, fmt.Errorf("failed to start port-forward to ChartMuseum: %w", err)
-	}
-
-	// Ensure we stop the port-forwarding when done
-	defer func() {
-		if forwardCmd.Process != nil {
-			if err := forwardCmd.Process.Kill(); err != nil {
-				fmt.Fprintf(os.Stderr, "Error stopping port forwarding: %v\n", err)
-			}
-		}
-	}()
-
-	// Give port-forwarding time to establish
+	// Use port-forwarding to access ChartMuseum
 	fmt.Println("Setting up port-forwarding to ChartMuseum...")
+	forward, err := d.forwardChartMuseum()
+	if err != nil {
+		return false, err
+	}
+	defer closePortForward(forward)
 
 	// Use the local port-forwarded URL
-	localURL := "http://localhost:8080/api/charts/" + chartName
-
-	// Wait a moment for port-forwarding to establish
-	time.Sleep(2 * time.Second)
+	localURL := "http://" + forward.Address() + "/api/charts/" + chartName
 
 	// Check if chart exists
 	resp, err := http.Get(localURL)
@@ -235,28 +238,56 @@ func (d *Deployer) chartExistsInChartMuseum(chartName string) (bool, error) {
 
 // getChartMuseumURL gets the URL for ChartMuseum
 func (d *Deployer) getChartMuseumURL() (string, error) {
-	// Get ChartMuseum service IP
-	kubectlArgs := []string{"get", "service", "-n", d.Options.RegistryNamespace, "chartmuseum", "-o", "jsonpath={.spec.clusterIP}"}
-	if d.Options.KubeconfigPath != "" {
-		kubectlArgs = append(kubectlArgs, "--kubeconfig", d.Options.KubeconfigPath)
+	client, err := d.kubeClient()
+	if err != nil {
+		return "", err
 	}
 
-	cmd := exec.Command("kubectl", kubectlArgs...)
-	output, err := cmd.CombinedOutput()
+	// Get ChartMuseum service IP
+	serviceIP, err := client.ServiceClusterIP(context.Background(), d.Options.RegistryNamespace, "chartmuseum")
 	if err != nil {
 		return "", fmt.Errorf("failed to get ChartMuseum service: %w", err)
 	}
 
-	serviceIP := strings.TrimSpace(string(output))
-	if serviceIP == "" {
-		return "", fmt.Errorf("ChartMuseum service not found in namespace %s", d.Options.RegistryNamespace)
+	return fmt.Sprintf("http://%s:8080", serviceIP), nil
+}
+
+// forwardChartMuseum forwards a free local port to the ChartMuseum service
+func (d *Deployer) forwardChartMuseum() (*kube.PortForward, error) {
+	client, err := d.kubeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	forward, err := client.PortForwardService(context.Background(), d.Options.RegistryNamespace, "chartmuseum", 8080)
+	if err != nil {
+		return nil, fmt.Errorf("failed to port-forward to ChartMuseum: %w", err)
 	}
+	return forward, nil
+}
 
-	return fmt.Sprintf("http://%s:8080", serviceIP), nil
+// closePortForward stops a port-forward, reporting how it ended
+func closePortForward(forward *kube.PortForward) {
+	if err := forward.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error stopping port forwarding: %v\n", err)
+	}
+}
+
+// kubeClient returns the client for the cluster, creating it on first use
+func (d *Deployer) kubeClient() (*kube.Client, error) {
+	if d.kube == nil {
+		client, err := kube.NewClient(d.Options.KubeconfigPath)
+		if err != nil {
+			return nil, err
+		}
+		d.kube = client
+	}
+	return d.kube, nil
 }
 
-// loadValues loads values from a YAML file
-func loadValues(filename string) (map[string]interface{}, error) {
+// loadValues loads values from a YAML file, rewriting the image references
+// in it
+func loadValues(filename string, rewriter *image.Rewriter) (map[string]interface{}, error) {
 	if filename == "" {
 		return map[string]interface{}{}, nil
 	}
@@ -266,6 +297,11 @@ func loadValues(filename string) (map[string]interface{}, error) {
 		return nil, fmt.Errorf("failed to read values file: %w", err)
 	}
 
+	data, err = helm.RewriteValues(data, rewriter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rewrite image references: %w", err)
+	}
+
 	var values map[string]interface{}
 	if err := yaml.Unmarshal(data, &values); err != nil {
 		return nil, fmt.Errorf("failed to parse values YAML: %w", err)
@@ -273,30 +309,3 @@ func loadValues(filename string) (map[string]interface{}, error) {
 
 	return values, nil
 }
-
-// rewriteImageReferences updates image references in values to use the local registry
-func rewriteImageReferences(values map[string]interface{}, registry string) error {
-	// This is a simplified version - a real implementation would need to be more sophisticated
-	// to handle various chart structures
-
-	// Look for common patterns of image references
-	if image, ok := values["image"]; ok {
-		if imageMap, ok := image.(map[string]interface{}); ok {
-			if repository, ok := imageMap["repository"].(string); ok {
-				// Rewrite the repository
-				imageMap["repository"] = fmt.Sprintf("%s/%s", registry, filepath.Base(repository))
-			}
-		}
-	}
-
-	// Handle more complex structures recursively
-	for _, value := range values {
-		if subMap, ok := value.(map[string]interface{}); ok {
-			if err := rewriteImageReferences(subMap, registry); err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
-}
@@ -0,0 +1,120 @@
+package helm
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+const deploymentTemplate = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ .Chart.Name }}
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: "{{ .Values.image.repository }}:{{ .Values.image.tag | default .Chart.AppVersion }}"
+`
+
+const cronJobTemplate = `apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: backup
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          initContainers:
+            - name: wait
+              image: busybox:1.36
+          containers:
+            - name: backup
+              image: {{ .Values.backup.image }}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: notes
+data:
+  example: "image: not/an-image:1"
+`
+
+// newTestChart returns a chart with the given values.yaml and templates
+func newTestChart(name, appVersion, values string, templates map[string]string) *chart.Chart {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: name, Version: "0.1.0", AppVersion: appVersion},
+		Raw:      []*chart.File{{Name: chartutil.ValuesfileName, Data: []byte(values)}},
+	}
+	for templateName, data := range templates {
+		c.Templates = append(c.Templates, &chart.File{Name: "templates/" + templateName, Data: []byte(data)})
+	}
+	return c
+}
+
+func TestAnalyzeChartForImages(t *testing.T) {
+	parent := newTestChart("app", "1.0", "image:\n  repository: quay.io/acme/app\n  tag: \"\"\nbackup:\n  image: acme/backup@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef\n",
+		map[string]string{"deployment.yaml": deploymentTemplate, "cronjob.yaml": cronJobTemplate})
+	parent.Metadata.Dependencies = []*chart.Dependency{
+		{Name: "db", Version: "0.1.0"},
+		{Name: "cache", Version: "0.1.0", Condition: "cache.enabled"},
+	}
+	parent.SetDependencies(
+		newTestChart("db", "16.2", "image:\n  repository: postgres\n", map[string]string{"deployment.yaml": deploymentTemplate}),
+		newTestChart("cache", "7.0", "image:\n  repository: redis\n", map[string]string{"deployment.yaml": deploymentTemplate}),
+	)
+
+	dir := t.TempDir()
+	chartPath, err := chartutil.Save(parent, dir)
+	if err != nil {
+		t.Fatalf("Failed to save chart: %v", err)
+	}
+
+	// User values override the parent image tag and disable a subchart
+	valuesFile := filepath.Join(dir, "values.yaml")
+	values := "image:\n  tag: \"2.0\"\ncache:\n  enabled: false\n"
+	if err := os.WriteFile(valuesFile, []byte(values), 0644); err != nil {
+		t.Fatalf("Failed to write values file: %v", err)
+	}
+
+	refs, err := AnalyzeChartForImages(chartPath, valuesFile)
+	if err != nil {
+		t.Fatalf("Failed to analyze chart: %v", err)
+	}
+
+	var got []string
+	for _, ref := range refs {
+		got = append(got, ref.Chart+" "+ref.Image()+" "+ref.FullPath)
+	}
+	want := []string{
+		"db postgres:16.2 Deployment/db containers[app]",
+		"app acme/backup@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef CronJob/backup containers[backup]",
+		"app busybox:1.36 CronJob/backup initContainers[wait]",
+		"app quay.io/acme/app:2.0 Deployment/app containers[app]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	chartImages := map[string][]ImageReference{"app": refs}
+	manifestImages := []string{
+		"docker.io/library/postgres:16.2",
+		"busybox:1.35",
+		"acme/backup:1.0@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	}
+	missing := FindImagesNotInManifest(chartImages, manifestImages)
+	// Another tag of a listed repository is still missing
+	wantMissing := []string{
+		"busybox:1.36",
+		"quay.io/acme/app:2.0",
+	}
+	if !reflect.DeepEqual(missing, wantMissing) {
+		t.Errorf("Expected missing images %v, got %v", wantMissing, missing)
+	}
+}
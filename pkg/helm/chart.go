@@ -1,11 +1,13 @@
 package helm
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/capsailer/capsailer-cli/pkg/image"
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
@@ -13,6 +15,7 @@ import (
 	"helm.sh/helm/v3/pkg/downloader"
 	"helm.sh/helm/v3/pkg/getter"
 	"helm.sh/helm/v3/pkg/repo"
+	"helm.sh/helm/v3/pkg/storage/driver"
 )
 
 // ChartInfo stores information about a Helm chart
@@ -96,8 +99,10 @@ func LoadChart(chartPath string) (*chart.Chart, error) {
 	return loader.Load(chartPath)
 }
 
-// InstallChart installs a Helm chart in Kubernetes
-func InstallChart(chartPath, releaseName, namespace string, values map[string]interface{}) error {
+// InstallChart installs a Helm chart in Kubernetes, or upgrades the release
+// when it is already installed. With a rewriter, the images of the rendered
+// workloads are rewritten to the private registry.
+func InstallChart(chartPath, releaseName, namespace, kubeconfigPath string, values map[string]interface{}, rewriter *image.Rewriter) error {
 	// Load the chart
 	chartRequested, err := loader.Load(chartPath)
 	if err != nil {
@@ -106,6 +111,10 @@ func InstallChart(chartPath, releaseName, namespace string, values map[string]in
 
 	// Get Helm settings
 	settings := cli.New()
+	settings.SetNamespace(namespace)
+	if kubeconfigPath != "" {
+		settings.KubeConfig = kubeconfigPath
+	}
 
 	// Initialize action configuration
 	actionConfig := new(action.Configuration)
@@ -115,19 +124,45 @@ func InstallChart(chartPath, releaseName, namespace string, values map[string]in
 		return fmt.Errorf("failed to initialize Helm configuration: %w", err)
 	}
 
-	// Create install action
-	installer := action.NewInstall(actionConfig)
-	installer.Namespace = namespace
-	installer.ReleaseName = releaseName
-	installer.CreateNamespace = true
-	installer.Wait = true
-	installer.Timeout = 300 * time.Second
+	return installOrUpgrade(actionConfig, chartRequested, releaseName, namespace, values, rewriter)
+}
 
-	// Run the installation
-	_, err = installer.Run(chartRequested, values)
-	if err != nil {
-		return fmt.Errorf("failed to install chart: %w", err)
+// installOrUpgrade upgrades the release if it exists and installs it
+// otherwise, like helm upgrade --install
+func installOrUpgrade(actionConfig *action.Configuration, chartRequested *chart.Chart, releaseName, namespace string, values map[string]interface{}, rewriter *image.Rewriter) error {
+	history := action.NewHistory(actionConfig)
+	history.Max = 1
+	if _, err := history.Run(releaseName); errors.Is(err, driver.ErrReleaseNotFound) {
+		// Create install action
+		installer := action.NewInstall(actionConfig)
+		installer.Namespace = namespace
+		installer.ReleaseName = releaseName
+		installer.CreateNamespace = true
+		installer.Wait = true
+		installer.Timeout = 300 * time.Second
+		if rewriter != nil {
+			installer.PostRenderer = NewImagePostRenderer(rewriter)
+		}
+
+		// Run the installation
+		if _, err := installer.Run(chartRequested, values); err != nil {
+			return fmt.Errorf("failed to install chart: %w", err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read history of release %s: %w", releaseName, err)
+	}
+
+	upgrader := action.NewUpgrade(actionConfig)
+	upgrader.Namespace = namespace
+	upgrader.Wait = true
+	upgrader.Timeout = 300 * time.Second
+	if rewriter != nil {
+		upgrader.PostRenderer = NewImagePostRenderer(rewriter)
 	}
 
+	if _, err := upgrader.Run(releaseName, chartRequested, values); err != nil {
+		return fmt.Errorf("failed to upgrade release %s: %w", releaseName, err)
+	}
 	return nil
 }
@@ -0,0 +1,42 @@
+package helm
+
+import (
+	"io"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+func TestInstallOrUpgrade(t *testing.T) {
+	actionConfig := &action.Configuration{
+		Releases:     storage.Init(driver.NewMemory()),
+		KubeClient:   &kubefake.PrintingKubeClient{Out: io.Discard},
+		Capabilities: chartutil.DefaultCapabilities,
+		Log:          func(string, ...interface{}) {},
+	}
+	chrt := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "app", Version: "1.0.0"},
+		Templates: []*chart.File{
+			{Name: "templates/configmap.yaml", Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n")},
+		},
+	}
+
+	// Deploying the same bundle twice installs, then upgrades
+	for revision := 1; revision <= 2; revision++ {
+		if err := installOrUpgrade(actionConfig, chrt, "app", "default", nil, nil); err != nil {
+			t.Fatalf("Failed to deploy revision %d: %v", revision, err)
+		}
+		rel, err := actionConfig.Releases.Last("app")
+		if err != nil {
+			t.Fatalf("Failed to get release: %v", err)
+		}
+		if rel.Version != revision {
+			t.Errorf("Expected revision %d, got %d", revision, rel.Version)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package helm
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/capsailer/capsailer-cli/pkg/utils"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/yaml"
+)
+
+// VendoredDependency is a subchart that was downloaded into a chart package
+type VendoredDependency struct {
+	Name       string
+	Version    string
+	Repository string
+	Digest     string // SHA-256 digest of the subchart package
+}
+
+// VendorDependencies downloads the dependencies that a chart package declares
+// in Chart.yaml but does not contain, and rewrites the package with them in
+// its charts/ directory, so that it installs without network access. Each
+// dependency is resolved in its own repository within its version
+// constraint, unless pinned maps its name to an exact version. The parent
+// repository's credentials are used for dependencies in the same repository.
+// Packages that already contain all their dependencies are left unchanged
+// and nil is returned.
+func VendorDependencies(chartPath, repoURL string, opts RepoOptions, pinned map[string]string) ([]VendoredDependency, error) {
+	chartObj, err := loader.Load(chartPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chart: %w", err)
+	}
+	if action.CheckDependencies(chartObj, chartObj.Metadata.Dependencies) == nil {
+		return nil, nil
+	}
+
+	modTime, err := archiveModTime(chartPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tempDir, err := os.MkdirTemp("", "capsailer-chart-deps-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing temp directory: %v\n", err)
+		}
+	}()
+
+	expandDir := filepath.Join(tempDir, "chart")
+	if err := chartutil.ExpandFile(expandDir, chartPath); err != nil {
+		return nil, fmt.Errorf("failed to expand chart: %w", err)
+	}
+	chartDir := filepath.Join(expandDir, chartObj.Name())
+
+	// Pin exact versions by declaring them in the expanded copy only
+	depsFile := dependenciesFile(chartObj)
+	original, err := os.ReadFile(filepath.Join(chartDir, depsFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", depsFile, err)
+	}
+	if len(pinned) > 0 {
+		if err := pinDependencies(chartObj, filepath.Join(chartDir, depsFile), pinned); err != nil {
+			return nil, err
+		}
+	}
+
+	manager, err := dependencyManager(chartObj, chartDir, tempDir, repoURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := manager.Update(); err != nil {
+		return nil, fmt.Errorf("failed to download dependencies: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(chartDir, depsFile), original, 0644); err != nil {
+		return nil, fmt.Errorf("failed to restore %s: %w", depsFile, err)
+	}
+
+	vendored, err := vendoredDependencies(chartDir, modTime)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeChartArchive(expandDir, chartPath, modTime); err != nil {
+		return nil, err
+	}
+
+	return vendored, nil
+}
+
+// dependenciesFile returns the file that declares a chart's dependencies:
+// Chart.yaml, or requirements.yaml for apiVersion v1 charts
+func dependenciesFile(chartObj *chart.Chart) string {
+	if chartObj.Metadata.APIVersion == chart.APIVersionV1 {
+		for _, f := range chartObj.Raw {
+			if f.Name == "requirements.yaml" {
+				return f.Name
+			}
+		}
+	}
+	return chartutil.ChartfileName
+}
+
+// pinDependencies rewrites a dependencies file with exact versions
+func pinDependencies(chartObj *chart.Chart, path string, pinned map[string]string) error {
+	deps := make([]*chart.Dependency, 0, len(chartObj.Metadata.Dependencies))
+	for _, dep := range chartObj.Metadata.Dependencies {
+		pin := *dep
+		if version, ok := pinned[dep.Name]; ok {
+			pin.Version = version
+		}
+		deps = append(deps, &pin)
+	}
+
+	var data []byte
+	var err error
+	if filepath.Base(path) == chartutil.ChartfileName {
+		metadata := *chartObj.Metadata
+		metadata.Dependencies = deps
+		data, err = yaml.Marshal(&metadata)
+	} else {
+		data, err = yaml.Marshal(map[string]interface{}{"dependencies": deps})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to pin dependency versions: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to pin dependency versions: %w", err)
+	}
+	return nil
+}
+
+// dependencyManager sets up Helm's dependency manager with a repository
+// configuration of its own, holding the repositories the dependencies use
+func dependencyManager(chartObj *chart.Chart, chartDir, tempDir, repoURL string, opts RepoOptions) (*downloader.Manager, error) {
+	repoFile := repo.NewFile()
+	var ociRepo string
+	for i, dep := range chartObj.Metadata.Dependencies {
+		switch {
+		case dep.Repository == "" || strings.HasPrefix(dep.Repository, "file://"):
+			continue
+		case IsOCIRepo(dep.Repository):
+			if ociRepo == "" {
+				ociRepo = dep.Repository
+			}
+		case strings.HasPrefix(dep.Repository, "@") || strings.HasPrefix(dep.Repository, "alias:"):
+			// Named repositories come from the user's Helm configuration
+			alias := strings.TrimPrefix(strings.TrimPrefix(dep.Repository, "@"), "alias:")
+			userRepos, err := repo.LoadFile(cli.New().RepositoryConfig)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("failed to load Helm repositories: %w", err)
+			}
+			if userRepos == nil || !userRepos.Has(alias) {
+				return nil, fmt.Errorf("dependency %s uses repository %s, which is not configured in Helm", dep.Name, dep.Repository)
+			}
+			repoFile.Update(userRepos.Get(alias))
+		case sameRepo(dep.Repository, repoURL):
+			repoFile.Update(opts.Entry(fmt.Sprintf("capsailer-dep-%d", i), dep.Repository))
+		default:
+			repoFile.Update(&repo.Entry{Name: fmt.Sprintf("capsailer-dep-%d", i), URL: dep.Repository})
+		}
+	}
+
+	repoConfig := filepath.Join(tempDir, "repositories.yaml")
+	if err := repoFile.WriteFile(repoConfig, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write repository configuration: %w", err)
+	}
+
+	getters, err := opts.Getters(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	getters = append(getters, getter.Provider{
+		Schemes: []string{registry.OCIScheme},
+		New:     getter.NewOCIGetter,
+	})
+
+	manager := &downloader.Manager{
+		Out:              io.Discard,
+		ChartPath:        chartDir,
+		Getters:          getters,
+		RepositoryConfig: repoConfig,
+		RepositoryCache:  filepath.Join(tempDir, "cache"),
+	}
+
+	// OCI dependencies in the parent's registry get its credentials
+	if ociRepo != "" {
+		var clientOpts []registry.ClientOption
+		if IsOCIRepo(repoURL) && registryHost(ociRepo) == registryHost(repoURL) && opts.Username != "" {
+			clientOpts = append(clientOpts, registry.ClientOptBasicAuth(opts.Username, opts.Password))
+		}
+		client, err := newRegistryClient(strings.TrimPrefix(ociRepo, registry.OCIScheme+"://"), clientOpts...)
+		if err != nil {
+			return nil, err
+		}
+		manager.RegistryClient = client
+	}
+
+	return manager, nil
+}
+
+// sameRepo reports whether two chart repository URLs are the same
+func sameRepo(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+// registryHost returns the host of an oci:// repository URL
+func registryHost(repoURL string) string {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// vendoredDependencies lists the subchart packages the dependency manager
+// downloaded. It rewrites the lock file the manager wrote with a fixed time,
+// and with the digest Helm computes from the declared version constraints
+// rather than from pinned versions, so that packaging the same dependencies
+// again gives the same result.
+func vendoredDependencies(chartDir string, modTime time.Time) ([]VendoredDependency, error) {
+	chartObj, err := loader.LoadDir(chartDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chart with dependencies: %w", err)
+	}
+	if chartObj.Lock == nil {
+		return nil, nil
+	}
+
+	reqData, err := json.Marshal([2][]*chart.Dependency{chartObj.Metadata.Dependencies, chartObj.Lock.Dependencies})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write dependency lock: %w", err)
+	}
+	chartObj.Lock.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(reqData))
+	chartObj.Lock.Generated = modTime
+	lockData, err := yaml.Marshal(chartObj.Lock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write dependency lock: %w", err)
+	}
+	lockFile := "Chart.lock"
+	if chartObj.Metadata.APIVersion == chart.APIVersionV1 {
+		lockFile = "requirements.lock"
+	}
+	if err := os.WriteFile(filepath.Join(chartDir, lockFile), lockData, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write dependency lock: %w", err)
+	}
+
+	var vendored []VendoredDependency
+	for _, dep := range chartObj.Lock.Dependencies {
+		if dep.Repository == "" {
+			continue
+		}
+		path := filepath.Join(chartDir, "charts", fmt.Sprintf("%s-%s.tgz", dep.Name, dep.Version))
+		digest, err := utils.FileDigest(path)
+		if err != nil {
+			return nil, fmt.Errorf("dependency %s-%s was not downloaded: %w", dep.Name, dep.Version, err)
+		}
+		vendored = append(vendored, VendoredDependency{
+			Name:       dep.Name,
+			Version:    dep.Version,
+			Repository: dep.Repository,
+			Digest:     digest,
+		})
+	}
+
+	return vendored, nil
+}
+
+// archiveModTime returns the modification time of the first file in a chart
+// package, which is when the chart was packaged
+func archiveModTime(chartPath string) (time.Time, error) {
+	file, err := os.Open(chartPath)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to open chart: %w", err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing file: %v\n", err)
+		}
+	}()
+
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read chart: %w", err)
+	}
+	header, err := tar.NewReader(gr).Next()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read chart: %w", err)
+	}
+	return header.ModTime, nil
+}
+
+// writeChartArchive packages the chart directory in sourceDir like `helm
+// package`, with every file stamped with modTime
+func writeChartArchive(sourceDir, outputPath string, modTime time.Time) error {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create chart package: %w", err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing file: %v\n", err)
+		}
+	}()
+
+	gw := gzip.NewWriter(file)
+	tw := tar.NewWriter(gw)
+
+	err = filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		relPath, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Name:    filepath.ToSlash(relPath),
+			Mode:    0644,
+			Size:    info.Size(),
+			ModTime: modTime,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to package chart: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to package chart: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("failed to package chart: %w", err)
+	}
+	return nil
+}
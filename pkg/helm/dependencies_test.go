@@ -0,0 +1,134 @@
+package helm
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+func TestVendorDependencies(t *testing.T) {
+	// A repository with two versions of the dependency
+	repoDir := t.TempDir()
+	for _, version := range []string{"1.0.0", "1.1.0"} {
+		dep := newTestChart("db", "16.2", "image:\n  repository: postgres\n", nil)
+		dep.Metadata.Version = version
+		if _, err := chartutil.Save(dep, repoDir); err != nil {
+			t.Fatalf("Failed to save dependency: %v", err)
+		}
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(repoDir)))
+	defer server.Close()
+	index, err := repo.IndexDirectory(repoDir, server.URL)
+	if err != nil {
+		t.Fatalf("Failed to index repository: %v", err)
+	}
+	if err := index.WriteFile(filepath.Join(repoDir, "index.yaml"), 0644); err != nil {
+		t.Fatalf("Failed to write index: %v", err)
+	}
+
+	tests := map[string]struct {
+		pinned  map[string]string
+		version string
+	}{
+		"constraint": {version: "1.1.0"},
+		"pinned":     {pinned: map[string]string{"db": "1.0.0"}, version: "1.0.0"},
+	}
+
+	for testName, tt := range tests {
+		parent := newTestChart("app", "1.0", "{}\n", nil)
+		parent.Metadata.Dependencies = []*chart.Dependency{{Name: "db", Version: "^1.0.0", Repository: server.URL}}
+		chartPath, err := chartutil.Save(parent, t.TempDir())
+		if err != nil {
+			t.Fatalf("%s: failed to save chart: %v", testName, err)
+		}
+
+		vendored, err := VendorDependencies(chartPath, "", RepoOptions{}, tt.pinned)
+		if err != nil {
+			t.Fatalf("%s: failed to vendor dependencies: %v", testName, err)
+		}
+		if len(vendored) != 1 || vendored[0].Version != tt.version {
+			t.Fatalf("%s: expected db %s to be vendored, got %+v", testName, tt.version, vendored)
+		}
+
+		chartObj, err := loader.Load(chartPath)
+		if err != nil {
+			t.Fatalf("%s: failed to load vendored chart: %v", testName, err)
+		}
+		deps := chartObj.Dependencies()
+		if len(deps) != 1 || deps[0].Metadata.Version != tt.version {
+			t.Errorf("%s: expected the package to contain db %s", testName, tt.version)
+		}
+		if chartObj.Metadata.Dependencies[0].Version != "^1.0.0" {
+			t.Errorf("%s: expected the version constraint to be kept, got %s", testName, chartObj.Metadata.Dependencies[0].Version)
+		}
+
+		// A complete package is left alone
+		before, err := os.ReadFile(chartPath)
+		if err != nil {
+			t.Fatalf("%s: failed to read chart: %v", testName, err)
+		}
+		vendored, err = VendorDependencies(chartPath, "", RepoOptions{}, nil)
+		if err != nil || vendored != nil {
+			t.Errorf("%s: expected nothing to vendor, got %+v, %v", testName, vendored, err)
+		}
+		after, err := os.ReadFile(chartPath)
+		if err != nil {
+			t.Fatalf("%s: failed to read chart: %v", testName, err)
+		}
+		if string(before) != string(after) {
+			t.Errorf("%s: expected a complete package to be unchanged", testName)
+		}
+	}
+	// A dependency repository other than the parent's is fetched with its own
+	// TLS settings, not with the parent's token and CA
+	tlsRepoDir := t.TempDir()
+	dep := newTestChart("db", "16.2", "image:\n  repository: postgres\n", nil)
+	if _, err := chartutil.Save(dep, tlsRepoDir); err != nil {
+		t.Fatalf("Failed to save dependency: %v", err)
+	}
+	// Relative chart URLs resolve against the repository URL
+	tlsIndex, err := repo.IndexDirectory(tlsRepoDir, "")
+	if err != nil {
+		t.Fatalf("Failed to index repository: %v", err)
+	}
+	if err := tlsIndex.WriteFile(filepath.Join(tlsRepoDir, "index.yaml"), 0644); err != nil {
+		t.Fatalf("Failed to write index: %v", err)
+	}
+	tlsServer := httptest.NewTLSServer(http.FileServer(http.Dir(tlsRepoDir)))
+	defer tlsServer.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	if err := os.WriteFile(caFile, caData, 0644); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+	repoConfig := filepath.Join(t.TempDir(), "repositories.yaml")
+	repoFile := repo.NewFile()
+	repoFile.Update(&repo.Entry{Name: "deps", URL: tlsServer.URL, CAFile: caFile})
+	if err := repoFile.WriteFile(repoConfig, 0644); err != nil {
+		t.Fatalf("Failed to write repository config: %v", err)
+	}
+	t.Setenv("HELM_REPOSITORY_CONFIG", repoConfig)
+
+	parent := newTestChart("app", "1.0", "{}\n", nil)
+	parent.Metadata.Dependencies = []*chart.Dependency{{Name: "db", Version: "^0.1.0", Repository: "@deps"}}
+	chartPath, err := chartutil.Save(parent, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to save chart: %v", err)
+	}
+	vendored, err := VendorDependencies(chartPath, "https://charts.example.com", RepoOptions{Token: "token"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to vendor dependencies from another repository: %v", err)
+	}
+	if len(vendored) != 1 || vendored[0].Version != dep.Metadata.Version {
+		t.Errorf("Expected db %s to be vendored, got %+v", dep.Metadata.Version, vendored)
+	}
+}
@@ -0,0 +1,172 @@
+package helm
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/google/go-containerregistry/pkg/name"
+	"helm.sh/helm/v3/pkg/registry"
+)
+
+// IsOCIRepo reports whether a chart repository is an OCI registry (oci://...)
+func IsOCIRepo(repoURL string) bool {
+	return registry.IsOCI(repoURL)
+}
+
+// OCIChartReference returns the registry reference of a chart version, for
+// example registry-1.docker.io/bitnamicharts/nginx:15.1.4
+func OCIChartReference(repoURL, chartName, version string) string {
+	repoPath := strings.TrimSuffix(strings.TrimPrefix(repoURL, registry.OCIScheme+"://"), "/")
+	return fmt.Sprintf("%s/%s:%s", repoPath, chartName, version)
+}
+
+// PullOCIChart pulls a chart package from an OCI registry with Helm's
+// registry client. Without a username in opts, credentials from `helm
+// registry login` and the Docker config are used. It returns the package and
+// its digest.
+func PullOCIChart(repoURL, chartName, version string, opts RepoOptions) ([]byte, string, error) {
+	ref := OCIChartReference(repoURL, chartName, version)
+
+	client, err := ociClient(ref, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	result, err := client.Pull(ref)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to pull chart %s: %w", ref, err)
+	}
+
+	if result.Chart.Meta != nil && result.Chart.Meta.Name != chartName {
+		return nil, "", fmt.Errorf("%s contains chart %s, expected %s", ref, result.Chart.Meta.Name, chartName)
+	}
+
+	return result.Chart.Data, result.Chart.Digest, nil
+}
+
+// ResolveOCIChartVersion returns the highest chart version in an OCI
+// registry that satisfies a version constraint. An exact version is returned
+// as is, without listing the tags of the repository.
+func ResolveOCIChartVersion(repoURL, chartName, constraint string, opts RepoOptions) (string, error) {
+	if _, err := semver.StrictNewVersion(constraint); err == nil {
+		return constraint, nil
+	}
+
+	versions, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return "", fmt.Errorf("invalid version constraint %s: %w", constraint, err)
+	}
+
+	ref := strings.TrimSuffix(OCIChartReference(repoURL, chartName, ""), ":")
+	client, err := ociClient(ref, opts)
+	if err != nil {
+		return "", err
+	}
+
+	// Tags come back as semantic versions, highest first
+	tags, err := client.Tags(ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to list versions of chart %s: %w", ref, err)
+	}
+	for _, tag := range tags {
+		if version, err := semver.NewVersion(tag); err == nil && versions.Check(version) {
+			return tag, nil
+		}
+	}
+
+	return "", fmt.Errorf("no version of chart %s matches %s", ref, constraint)
+}
+
+// ociClient creates a registry client with the credentials and TLS settings
+// of a chart repository
+func ociClient(ref string, opts RepoOptions) (*registry.Client, error) {
+	var clientOpts []registry.ClientOption
+	if opts.Username != "" {
+		clientOpts = append(clientOpts, registry.ClientOptBasicAuth(opts.Username, opts.Password))
+	}
+	if opts.CAFile != "" || opts.CertFile != "" || opts.InsecureSkipTLSVerify {
+		tlsConfig, err := opts.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		clientOpts = append(clientOpts, registry.ClientOptHTTPClient(&http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}))
+	}
+
+	return newRegistryClient(ref, clientOpts...)
+}
+
+// PushOCIChart pushes a chart package to an OCI registry like `helm push`,
+// under repoURL (oci://host/path) with the chart's name and version as tag.
+// Without a username, credentials from `helm registry login` and the Docker
+// config are used. TLS certificates are verified with tlsConfig, or the
+// system's trusted CAs when it is nil. It returns the reference the chart
+// was pushed to.
+func PushOCIChart(chartPath, repoURL, username, password string, tlsConfig *tls.Config) (string, error) {
+	chartObj, err := LoadChart(chartPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to load chart: %w", err)
+	}
+	data, err := os.ReadFile(chartPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read chart package: %w", err)
+	}
+
+	ref := OCIChartReference(repoURL, chartObj.Metadata.Name, chartObj.Metadata.Version)
+
+	var opts []registry.ClientOption
+	if tlsConfig != nil {
+		opts = append(opts, registry.ClientOptHTTPClient(&http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}))
+	}
+	if username != "" {
+		opts = append(opts, registry.ClientOptBasicAuth(username, password))
+	}
+
+	client, err := newRegistryClient(ref, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := client.Push(data, ref, registry.PushOptStrictMode(true)); err != nil {
+		return "", fmt.Errorf("failed to push chart to %s: %w", ref, err)
+	}
+
+	return ref, nil
+}
+
+// newRegistryClient creates a Helm registry client for a chart reference.
+// Like image pulls, registries on localhost are reached over plain HTTP.
+func newRegistryClient(ref string, opts ...registry.ClientOption) (*registry.Client, error) {
+	if host := strings.SplitN(ref, "/", 2)[0]; isPlainHTTPRegistry(host) {
+		opts = append(opts, registry.ClientOptPlainHTTP())
+	}
+
+	client, err := registry.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create registry client: %w", err)
+	}
+	return client, nil
+}
+
+// isPlainHTTPRegistry reports whether go-containerregistry would talk to a
+// registry host over HTTP
+func isPlainHTTPRegistry(host string) bool {
+	reg, err := name.NewRegistry(host)
+	if err != nil {
+		return false
+	}
+	return reg.Scheme() == "http"
+}
@@ -0,0 +1,110 @@
+package helm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+func TestPushAndPullOCIChart(t *testing.T) {
+	// Keep the registry client away from the user's credentials
+	t.Setenv("HELM_REGISTRY_CONFIG", filepath.Join(t.TempDir(), "config.json"))
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	server := httptest.NewServer(ggcrregistry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// Package a chart and push it to the registry
+	packaged, err := chartutil.Save(&chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "demo", Version: "1.2.3"},
+	}, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to package chart: %v", err)
+	}
+	data, err := os.ReadFile(packaged)
+	if err != nil {
+		t.Fatalf("Failed to read chart package: %v", err)
+	}
+
+	repoURL := "oci://" + host + "/charts/"
+	ref, err := PushOCIChart(packaged, repoURL, "", "", nil)
+	if err != nil {
+		t.Fatalf("Failed to push chart: %v", err)
+	}
+	if expected := host + "/charts/demo:1.2.3"; ref != expected {
+		t.Errorf("Expected chart to be pushed to %s, got %s", expected, ref)
+	}
+
+	if !IsOCIRepo(repoURL) {
+		t.Fatalf("Expected %s to be an OCI repository", repoURL)
+	}
+
+	pulled, digest, err := PullOCIChart(repoURL, "demo", "1.2.3", RepoOptions{})
+	if err != nil {
+		t.Fatalf("Failed to pull chart: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	if expected := "sha256:" + hex.EncodeToString(sum[:]); digest != expected {
+		t.Errorf("Expected digest %s, got %s", expected, digest)
+	}
+	if string(pulled) != string(data) {
+		t.Error("Pulled chart package does not match the pushed one")
+	}
+
+	if _, _, err := PullOCIChart(repoURL, "demo", "9.9.9", RepoOptions{}); err == nil {
+		t.Error("Expected error for a missing chart version, but got nil")
+	}
+}
+
+func TestResolveOCIChartVersion(t *testing.T) {
+	t.Setenv("HELM_REGISTRY_CONFIG", filepath.Join(t.TempDir(), "config.json"))
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	server := httptest.NewServer(ggcrregistry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	repoURL := "oci://" + host + "/charts"
+
+	for _, version := range []string{"1.0.0", "1.2.0", "1.2.7", "1.3.0-rc.1", "2.0.0"} {
+		packaged, err := chartutil.Save(&chart.Chart{
+			Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "demo", Version: version},
+		}, t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to package chart: %v", err)
+		}
+		if _, err := PushOCIChart(packaged, repoURL, "", "", nil); err != nil {
+			t.Fatalf("Failed to push chart: %v", err)
+		}
+	}
+
+	tests := map[string]string{
+		"~1.2":     "1.2.7",
+		">=1.0 <2": "1.2.7",
+		"^1.3.0-0": "1.3.0-rc.1",
+		"*":        "2.0.0",
+		"1.0.0":    "1.0.0",
+	}
+	for constraint, want := range tests {
+		version, err := ResolveOCIChartVersion(repoURL, "demo", constraint, RepoOptions{})
+		if err != nil {
+			t.Errorf("Failed to resolve %s: %v", constraint, err)
+			continue
+		}
+		if version != want {
+			t.Errorf("Expected %s to resolve to %s, got %s", constraint, want, version)
+		}
+	}
+
+	if _, err := ResolveOCIChartVersion(repoURL, "demo", "~3", RepoOptions{}); err == nil {
+		t.Error("Expected error for a constraint no version matches, but got nil")
+	}
+}
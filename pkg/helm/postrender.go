@@ -0,0 +1,135 @@
+package helm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/capsailer/capsailer-cli/pkg/image"
+	"gopkg.in/yaml.v3"
+)
+
+// podSpecPaths are where workloads keep their pod spec: Pods directly,
+// controllers and most custom workloads in a pod template, and CronJobs in
+// a job template
+var podSpecPaths = [][]string{
+	{"spec", "template", "spec"},
+	{"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// ImagePostRenderer is a Helm post-renderer that rewrites the image of every
+// container in the rendered manifests to where push stored it in the
+// private registry
+type ImagePostRenderer struct {
+	rewriter *image.Rewriter
+}
+
+// NewImagePostRenderer creates a post-renderer that rewrites images with the
+// given rewriter
+func NewImagePostRenderer(rewriter *image.Rewriter) *ImagePostRenderer {
+	return &ImagePostRenderer{rewriter: rewriter}
+}
+
+// Run rewrites the container images in the rendered manifests. Only the
+// image values change; every other byte of the manifests is kept.
+func (p *ImagePostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	data := renderedManifests.Bytes()
+
+	var edits []scalarEdit
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rendered manifests: %w", err)
+		}
+		if len(doc.Content) > 0 {
+			p.findContainerImages(doc.Content[0], &edits)
+		}
+	}
+
+	rewritten, err := applyScalarEdits(data, edits)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(rewritten), nil
+}
+
+// findContainerImages collects the edits for the container images of a
+// rendered object, logging each substitution
+func (p *ImagePostRenderer) findContainerImages(obj *yaml.Node, edits *[]scalarEdit) {
+	if obj.Kind != yaml.MappingNode {
+		return
+	}
+
+	kind := ""
+	if node := stringValue(obj, "kind"); node != nil {
+		kind = node.Value
+	}
+	objName := ""
+	if metadata := mappingValue(obj, "metadata"); metadata != nil {
+		if node := stringValue(metadata, "name"); node != nil {
+			objName = node.Value
+		}
+	}
+
+	var specs []*yaml.Node
+	if kind == "Pod" {
+		specs = append(specs, mappingValue(obj, "spec"))
+	}
+	for _, path := range podSpecPaths {
+		node := obj
+		for _, key := range path {
+			if node = mappingValue(node, key); node == nil {
+				break
+			}
+		}
+		specs = append(specs, node)
+	}
+
+	for _, spec := range specs {
+		if spec == nil {
+			continue
+		}
+		for _, field := range []string{"containers", "initContainers", "ephemeralContainers"} {
+			list := mappingValue(spec, field)
+			if list == nil || list.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, c := range list.Content {
+				if c.Kind != yaml.MappingNode {
+					continue
+				}
+				node := stringValue(c, "image")
+				if node == nil || node.Value == "" || strings.HasPrefix(node.Value, p.rewriter.Registry()+"/") {
+					continue
+				}
+				target, err := p.rewriter.Image(node.Value)
+				if err != nil {
+					fmt.Printf("Warning: leaving image %s of %s/%s unchanged: %v\n", node.Value, kind, objName, err)
+					continue
+				}
+				fmt.Printf("Rewriting image %s to %s in %s/%s\n", node.Value, target, kind, objName)
+				*edits = append(*edits, scalarEdit{node, target})
+			}
+		}
+	}
+}
+
+// mappingValue returns the node under a key of a mapping, or nil
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package helm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/capsailer/capsailer-cli/pkg/image"
+)
+
+func TestImagePostRenderer(t *testing.T) {
+	rendered := `---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: wait
+          image: busybox:1.36
+      containers:
+        - name: app
+          image: "quay.io/acme/app:2.0"   # from values
+        - name: local
+          image: registry.local:5000/acme/sidecar:1
+---
+# Source: app/templates/cronjob.yaml
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: backup
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: backup
+              image: acme/backup@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+---
+# Source: app/templates/pod.yaml
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test
+spec:
+  containers:
+    - {name: test, image: curlimages/curl}
+---
+# Source: app/templates/rollout.yaml
+apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: canary
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: ghcr.io/org/canary:3
+---
+# Source: app/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: notes
+data:
+  image: nginx:1.25
+`
+	want := `---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: wait
+          image: registry.local:5000/busybox:1.36
+      containers:
+        - name: app
+          image: "registry.local:5000/acme/app:2.0"   # from values
+        - name: local
+          image: registry.local:5000/acme/sidecar:1
+---
+# Source: app/templates/cronjob.yaml
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: backup
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: backup
+              image: registry.local:5000/acme/backup@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+---
+# Source: app/templates/pod.yaml
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test
+spec:
+  containers:
+    - {name: test, image: registry.local:5000/curlimages/curl}
+---
+# Source: app/templates/rollout.yaml
+apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: canary
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: registry.local:5000/org/canary:3
+---
+# Source: app/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: notes
+data:
+  image: nginx:1.25
+`
+
+	rewriter, err := image.NewRewriter("registry.local:5000", nil)
+	if err != nil {
+		t.Fatalf("Failed to create rewriter: %v", err)
+	}
+	got, err := NewImagePostRenderer(rewriter).Run(bytes.NewBufferString(rendered))
+	if err != nil {
+		t.Fatalf("Failed to post-render: %v", err)
+	}
+	if got.String() != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, got)
+	}
+}
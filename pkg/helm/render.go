@@ -0,0 +1,166 @@
+package helm
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"helm.sh/helm/v3/pkg/releaseutil"
+)
+
+// podSpec holds the containers of a pod spec; only images are read
+type podSpec struct {
+	Containers          []container `yaml:"containers"`
+	InitContainers      []container `yaml:"initContainers"`
+	EphemeralContainers []container `yaml:"ephemeralContainers"`
+}
+
+type container struct {
+	Name  string `yaml:"name"`
+	Image string `yaml:"image"`
+}
+
+type podTemplate struct {
+	Spec podSpec `yaml:"spec"`
+}
+
+// workload is a rendered Kubernetes object that runs pods
+type workload struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Spec struct {
+		podSpec     `yaml:",inline"`
+		Template    podTemplate `yaml:"template"`
+		JobTemplate struct {
+			Spec struct {
+				Template podTemplate `yaml:"template"`
+			} `yaml:"spec"`
+		} `yaml:"jobTemplate"`
+	} `yaml:"spec"`
+}
+
+// podSpec returns the pod spec of the workload, or nil for other kinds
+func (w *workload) podSpec() *podSpec {
+	switch w.Kind {
+	case "Pod":
+		return &w.Spec.podSpec
+	case "Deployment", "StatefulSet", "DaemonSet", "Job":
+		return &w.Spec.Template.Spec
+	case "CronJob":
+		return &w.Spec.JobTemplate.Spec.Template.Spec
+	}
+	return nil
+}
+
+// renderChartImages renders a chart and its subcharts offline, as
+// `helm template` does, and returns the images of the workloads in the
+// rendered manifests
+func renderChartImages(chartObj *chart.Chart, userValues map[string]interface{}) ([]ImageReference, error) {
+	options := chartutil.ReleaseOptions{
+		Name:      chartObj.Name(),
+		Namespace: "default",
+		Revision:  1,
+		IsInstall: true,
+	}
+	values, err := chartutil.ToRenderValues(chartObj, userValues, options, chartutil.DefaultCapabilities.Copy())
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare values: %w", err)
+	}
+
+	rendered, err := engine.Render(chartObj, values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render chart: %w", err)
+	}
+
+	// Visit templates in a stable order
+	templates := make([]string, 0, len(rendered))
+	for name := range rendered {
+		templates = append(templates, name)
+	}
+	sort.Strings(templates)
+
+	var references []ImageReference
+	for _, templateName := range templates {
+		ext := path.Ext(templateName)
+		if ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+
+		docs := releaseutil.SplitManifests(rendered[templateName])
+		keys := make([]string, 0, len(docs))
+		for key := range docs {
+			keys = append(keys, key)
+		}
+		sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+
+		for _, key := range keys {
+			var obj workload
+			if err := yaml.Unmarshal([]byte(docs[key]), &obj); err != nil {
+				return nil, fmt.Errorf("failed to parse rendered template %s: %w", templateName, err)
+			}
+			spec := obj.podSpec()
+			if spec == nil {
+				continue
+			}
+
+			groups := []struct {
+				field      string
+				containers []container
+			}{
+				{"containers", spec.Containers},
+				{"initContainers", spec.InitContainers},
+				{"ephemeralContainers", spec.EphemeralContainers},
+			}
+			for _, group := range groups {
+				for _, c := range group.containers {
+					if c.Image == "" {
+						continue
+					}
+					repository, tag := splitImage(c.Image)
+					references = append(references, ImageReference{
+						Chart:       templateChart(templateName),
+						Path:        templateName,
+						Repository:  repository,
+						Tag:         tag,
+						FullPath:    fmt.Sprintf("%s/%s %s[%s]", obj.Kind, obj.Metadata.Name, group.field, c.Name),
+						ValueSource: "rendered",
+					})
+				}
+			}
+		}
+	}
+
+	return references, nil
+}
+
+// templateChart returns the name of the chart or subchart a rendered
+// template belongs to, from a path like app/charts/db/templates/db.yaml
+func templateChart(templateName string) string {
+	parts := strings.Split(templateName, "/")
+	for i := len(parts) - 3; i > 0; i-- {
+		if parts[i] == "charts" && parts[i+2] == "templates" {
+			return parts[i+1]
+		}
+	}
+	return parts[0]
+}
+
+// splitImage splits an image into repository and tag. References with a
+// digest are kept whole in the repository.
+func splitImage(image string) (string, string) {
+	if strings.Contains(image, "@") {
+		return image, ""
+	}
+	lastSlash := strings.LastIndex(image, "/")
+	if i := strings.LastIndex(image, ":"); i > lastSlash {
+		return image[:i], image[i+1:]
+	}
+	return image, ""
+}
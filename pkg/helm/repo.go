@@ -0,0 +1,173 @@
+package helm
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// RepoOptions holds the credentials and TLS settings for a chart repository
+type RepoOptions struct {
+	Username              string
+	Password              string
+	Token                 string // Bearer token, used instead of a username and password
+	CAFile                string
+	CertFile              string
+	KeyFile               string
+	InsecureSkipTLSVerify bool
+}
+
+// Entry returns a Helm repository entry for the repository
+func (o RepoOptions) Entry(name, repoURL string) *repo.Entry {
+	return &repo.Entry{
+		Name:                  name,
+		URL:                   repoURL,
+		Username:              o.Username,
+		Password:              o.Password,
+		CAFile:                o.CAFile,
+		CertFile:              o.CertFile,
+		KeyFile:               o.KeyFile,
+		InsecureSkipTLSverify: o.InsecureSkipTLSVerify,
+	}
+}
+
+// GetterOptions returns the Helm getter options for downloading from the
+// repository. Basic auth is only sent to the repository's own host.
+func (o RepoOptions) GetterOptions(repoURL string) []getter.Option {
+	return []getter.Option{
+		getter.WithURL(repoURL),
+		getter.WithBasicAuth(o.Username, o.Password),
+		getter.WithTLSClientConfig(o.CertFile, o.KeyFile, o.CAFile),
+		getter.WithInsecureSkipVerifyTLS(o.InsecureSkipTLSVerify),
+	}
+}
+
+// Getters returns the getter providers for the repository. Helm's HTTP getter
+// has no bearer token support, so repositories with a token get their own,
+// which leaves other hosts to Helm's HTTP getter.
+func (o RepoOptions) Getters(repoURL string) (getter.Providers, error) {
+	if o.Token == "" {
+		return getter.Providers{
+			getter.Provider{
+				Schemes: []string{"http", "https"},
+				New:     getter.NewHTTPGetter,
+			},
+		}, nil
+	}
+
+	tlsConfig, err := o.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	bearer := bearerGetter{
+		repoURL: repoURL,
+		token:   o.Token,
+		client: &http.Client{
+			Timeout: getter.DefaultHTTPTimeout * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}
+
+	return getter.Providers{
+		getter.Provider{
+			Schemes: []string{"http", "https"},
+			New: func(options ...getter.Option) (getter.Getter, error) {
+				fallback, err := getter.NewHTTPGetter(options...)
+				if err != nil {
+					return nil, err
+				}
+				g := bearer
+				g.fallback = fallback
+				return &g, nil
+			},
+		},
+	}, nil
+}
+
+// TLSConfig builds a TLS client configuration from the CA, certificate and
+// key files
+func (o RepoOptions) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: o.InsecureSkipTLSVerify}
+
+	if o.CertFile != "" && o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if o.CAFile != "" {
+		caData, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// bearerGetter downloads from the repository's own scheme and host with a
+// bearer token and its TLS settings. Other URLs, such as dependency
+// repositories, are downloaded by fallback with the options they come with.
+type bearerGetter struct {
+	repoURL  string
+	token    string
+	client   *http.Client
+	fallback getter.Getter
+}
+
+// Get implements getter.Getter. Options are only used for other hosts, since
+// the getter is already configured for its repository.
+func (g *bearerGetter) Get(href string, options ...getter.Option) (*bytes.Buffer, error) {
+	req, err := http.NewRequest(http.MethodGet, href, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	repoURL, err := url.Parse(g.repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL: %w", err)
+	}
+	if req.URL.Scheme != repoURL.Scheme || req.URL.Host != repoURL.Host {
+		return g.fallback.Get(href, options...)
+	}
+	req.Header.Set("Authorization", "Bearer "+g.token)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing response body: %v\n", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s : %s", href, resp.Status)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if _, err := io.Copy(buf, resp.Body); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
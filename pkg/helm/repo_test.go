@@ -0,0 +1,63 @@
+package helm
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+func TestRepoOptions(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		basic := ok && user == "ci" && password == "secret"
+		if !basic && r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("apiVersion: v1\nentries: {}\n"))
+	}))
+	defer server.Close()
+
+	// Trust the test server through a CA file
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caData, 0644); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	tests := map[string]struct {
+		opts    RepoOptions
+		wantErr bool
+	}{
+		"basic auth":     {opts: RepoOptions{Username: "ci", Password: "secret", CAFile: caFile}},
+		"bearer token":   {opts: RepoOptions{Token: "token", CAFile: caFile}},
+		"wrong password": {opts: RepoOptions{Username: "ci", Password: "wrong", CAFile: caFile}, wantErr: true},
+		"untrusted":      {opts: RepoOptions{Token: "token"}, wantErr: true},
+		"insecure":       {opts: RepoOptions{Token: "token", InsecureSkipTLSVerify: true}},
+	}
+
+	for testName, tt := range tests {
+		providers, err := tt.opts.Getters(server.URL)
+		if err != nil {
+			t.Fatalf("%s: failed to create getters: %v", testName, err)
+		}
+		chartRepo, err := repo.NewChartRepository(tt.opts.Entry("test", server.URL), providers)
+		if err != nil {
+			t.Fatalf("%s: failed to create chart repository: %v", testName, err)
+		}
+		chartRepo.CachePath = t.TempDir()
+
+		_, err = chartRepo.DownloadIndexFile()
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: expected error, but got nil", testName)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: expected no error, but got: %v", testName, err)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package helm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/capsailer/capsailer-cli/pkg/image"
+	"github.com/pmezard/go-difflib/difflib"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// scalarEdit replaces the value of a scalar in a YAML document
+type scalarEdit struct {
+	node  *yaml.Node
+	value string
+}
+
+// RewriteValues rewrites the image references in a values.yaml document to
+// where the rewriter stores them. The document is edited in place: only the
+// rewritten scalars change, and comments, key order, quoting and indentation
+// are kept.
+func RewriteValues(data []byte, rewriter *image.Rewriter) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse values: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return data, nil
+	}
+
+	var edits []scalarEdit
+	findImageScalars(doc.Content[0], rewriter, &edits)
+	return applyScalarEdits(data, edits)
+}
+
+// ValuesDiff returns a unified diff of two versions of a chart's
+// values.yaml, or an empty string if they are the same
+func ValuesDiff(chartName string, before, after []byte) (string, error) {
+	if bytes.Equal(before, after) {
+		return "", nil
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(before)),
+		B:        difflib.SplitLines(string(after)),
+		FromFile: "a/" + chartName + "/values.yaml",
+		ToFile:   "b/" + chartName + "/values.yaml",
+		Context:  3,
+	})
+}
+
+// findImageScalars collects the edits that point the image references in a
+// values mapping, and the mappings nested in it, at the private registry.
+// Values that are not image references, such as templates, are left alone.
+func findImageScalars(node *yaml.Node, rewriter *image.Rewriter, edits *[]scalarEdit) {
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+
+	// An image section with registry and repository fields
+	registry := stringValue(node, "registry")
+	if repository := stringValue(node, "repository"); registry != nil && repository != nil && repository.Value != "" {
+		source := repository.Value
+		if registry.Value != "" {
+			source = strings.TrimSuffix(registry.Value, "/") + "/" + repository.Value
+		}
+		if registry.Value != rewriter.Registry() {
+			if target, err := rewriter.Image(source); err == nil {
+				host, path, _ := strings.Cut(target, "/")
+				*edits = append(*edits, scalarEdit{registry, host}, scalarEdit{repository, path})
+			}
+		}
+		return
+	}
+
+	// Standalone repository fields
+	for _, field := range []string{"repository", "image"} {
+		value := stringValue(node, field)
+		if value == nil || value.Value == "" || strings.HasPrefix(value.Value, rewriter.Registry()+"/") {
+			continue
+		}
+		if target, err := rewriter.Image(value.Value); err == nil {
+			*edits = append(*edits, scalarEdit{value, target})
+		}
+	}
+
+	// Nested mappings
+	for i := 1; i < len(node.Content); i += 2 {
+		findImageScalars(node.Content[i], rewriter, edits)
+	}
+}
+
+// stringValue returns the string scalar under a key of a mapping, or nil
+func stringValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != key {
+			continue
+		}
+		value := mapping.Content[i+1]
+		if value.Kind == yaml.ScalarNode && value.ShortTag() == "!!str" {
+			return value
+		}
+		return nil
+	}
+	return nil
+}
+
+// applyScalarEdits replaces the source text of each edited scalar, keeping
+// its quoting style, and leaves the rest of the document untouched
+func applyScalarEdits(data []byte, edits []scalarEdit) ([]byte, error) {
+	type span struct {
+		start, end int
+		text       string
+	}
+
+	// Offsets of the start of each line
+	lineStarts := []int{0}
+	for i, c := range data {
+		if c == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+
+	spans := make([]span, 0, len(edits))
+	for _, edit := range edits {
+		if edit.node.Value == edit.value {
+			continue
+		}
+		start, end, err := scalarSpan(data, lineStarts, edit.node)
+		if err != nil {
+			return nil, err
+		}
+		spans = append(spans, span{start, end, formatScalar(edit.value, edit.node.Style)})
+	}
+
+	// Replace from the end so earlier offsets stay valid
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start > spans[j].start })
+	result := append([]byte(nil), data...)
+	for i, s := range spans {
+		if i > 0 && s.end > spans[i-1].start {
+			continue // The same scalar, edited twice
+		}
+		result = append(result[:s.start], append([]byte(s.text), result[s.end:]...)...)
+	}
+
+	return result, nil
+}
+
+// scalarSpan returns the byte range of a scalar's value in the document
+func scalarSpan(data []byte, lineStarts []int, node *yaml.Node) (int, int, error) {
+	if node.Line < 1 || node.Line > len(lineStarts) {
+		return 0, 0, fmt.Errorf("invalid position of value at line %d", node.Line)
+	}
+
+	// Columns count characters, not bytes
+	start := lineStarts[node.Line-1]
+	for i := 1; i < node.Column && start < len(data); i++ {
+		_, size := utf8.DecodeRune(data[start:])
+		start += size
+	}
+
+	// The position of an anchored or tagged value is that of its properties
+	for start < len(data) && (data[start] == '&' || data[start] == '!') {
+		for start < len(data) && data[start] != ' ' && data[start] != '\t' {
+			start++
+		}
+		for start < len(data) && (data[start] == ' ' || data[start] == '\t') {
+			start++
+		}
+	}
+
+	switch {
+	case node.Style&yaml.DoubleQuotedStyle != 0:
+		for end := start + 1; end < len(data); end++ {
+			if data[end] == '\\' {
+				end++
+			} else if data[end] == '"' {
+				return start, end + 1, nil
+			}
+		}
+	case node.Style&yaml.SingleQuotedStyle != 0:
+		for end := start + 1; end < len(data); end++ {
+			if data[end] == '\'' {
+				if end+1 < len(data) && data[end+1] == '\'' {
+					end++
+					continue
+				}
+				return start, end + 1, nil
+			}
+		}
+	case node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) == 0:
+		if bytes.HasPrefix(data[start:], []byte(node.Value)) {
+			return start, start + len(node.Value), nil
+		}
+	}
+
+	return 0, 0, fmt.Errorf("cannot rewrite value %q at line %d in place", node.Value, node.Line)
+}
+
+// formatScalar writes a value in the quoting style of the scalar it replaces,
+// quoting plain values that would not read back as the same string
+func formatScalar(value string, style yaml.Style) string {
+	switch {
+	case style&yaml.DoubleQuotedStyle != 0:
+		return strconv.Quote(value)
+	case style&yaml.SingleQuotedStyle != 0:
+		return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+	}
+
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(value), &parsed); err != nil || parsed != value {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// RewriteImageReferences rewrites the image references in a chart's
+// values.yaml to where the rewriter stores them, and repackages the chart
+// with the original timestamps. It returns a unified diff of values.yaml;
+// packages without references to rewrite are left unchanged.
+func RewriteImageReferences(chartPath string, rewriter *image.Rewriter) (string, error) {
+	modTime, err := archiveModTime(chartPath)
+	if err != nil {
+		return "", err
+	}
+
+	tempDir, err := os.MkdirTemp("", "capsailer-chart-rewrite-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing temp directory: %v\n", err)
+		}
+	}()
+
+	if err := chartutil.ExpandFile(tempDir, chartPath); err != nil {
+		return "", fmt.Errorf("failed to expand chart: %w", err)
+	}
+	dirs, err := os.ReadDir(tempDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read expanded chart: %w", err)
+	}
+	if len(dirs) != 1 {
+		return "", fmt.Errorf("expected a single chart in %s", chartPath)
+	}
+	chartName := dirs[0].Name()
+
+	valuesPath := filepath.Join(tempDir, chartName, chartutil.ValuesfileName)
+	values, err := os.ReadFile(valuesPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read values.yaml: %w", err)
+	}
+
+	rewritten, err := RewriteValues(values, rewriter)
+	if err != nil {
+		return "", fmt.Errorf("failed to rewrite values.yaml: %w", err)
+	}
+	diff, err := ValuesDiff(chartName, values, rewritten)
+	if err != nil || diff == "" {
+		return "", err
+	}
+
+	if err := os.WriteFile(valuesPath, rewritten, 0644); err != nil {
+		return "", fmt.Errorf("failed to write values.yaml: %w", err)
+	}
+	if err := writeChartArchive(tempDir, chartPath, modTime); err != nil {
+		return "", err
+	}
+
+	return diff, nil
+}
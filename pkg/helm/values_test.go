@@ -0,0 +1,77 @@
+package helm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/capsailer/capsailer-cli/pkg/image"
+)
+
+func TestRewriteValues(t *testing.T) {
+	values := `# Default values for app
+image:
+  registry: docker.io   # upstream registry
+  repository: bitnami/nginx
+  tag: "1.25"
+
+sidecar:
+  image: 'quay.io/acme/agent'  # pinned by digest below
+  digest: ""
+
+# Untouched keys keep their order and formatting
+zëta: {image: "ghcr.io/org/tool", pullPolicy: Always}
+alpha:
+    repository:   registry.local:5000/already
+templated:
+  repository: "{{ .Values.global.image }}"
+`
+	want := `# Default values for app
+image:
+  registry: registry.local:5000   # upstream registry
+  repository: bitnami/nginx
+  tag: "1.25"
+
+sidecar:
+  image: 'registry.local:5000/acme/agent'  # pinned by digest below
+  digest: ""
+
+# Untouched keys keep their order and formatting
+zëta: {image: "registry.local:5000/org/tool", pullPolicy: Always}
+alpha:
+    repository:   registry.local:5000/already
+templated:
+  repository: "{{ .Values.global.image }}"
+`
+
+	rewriter, err := image.NewRewriter("registry.local:5000", nil)
+	if err != nil {
+		t.Fatalf("Failed to create rewriter: %v", err)
+	}
+	got, err := RewriteValues([]byte(values), rewriter)
+	if err != nil {
+		t.Fatalf("Failed to rewrite values: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, got)
+	}
+
+	diff, err := ValuesDiff("app", []byte(values), got)
+	if err != nil {
+		t.Fatalf("Failed to diff values: %v", err)
+	}
+	for _, line := range []string{
+		"--- a/app/values.yaml\n",
+		"+++ b/app/values.yaml\n",
+		"-  registry: docker.io   # upstream registry\n",
+		"+  registry: registry.local:5000   # upstream registry\n",
+		"+zëta: {image: \"registry.local:5000/org/tool\", pullPolicy: Always}\n",
+	} {
+		if !strings.Contains(diff, line) {
+			t.Errorf("Expected diff to contain %q, got:\n%s", line, diff)
+		}
+	}
+
+	if diff, err := ValuesDiff("app", got, got); err != nil || diff != "" {
+		t.Errorf("Expected no diff for unchanged values, got %q, %v", diff, err)
+	}
+}
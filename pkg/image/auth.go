@@ -0,0 +1,81 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Keychain returns the keychain used to pull images: credentials from
+// authFile, a Docker config.json style file, take precedence over those from
+// `docker login`, credential helpers and Podman's auth.json
+func Keychain(authFile string) (authn.Keychain, error) {
+	if authFile == "" {
+		return authn.DefaultKeychain, nil
+	}
+
+	file, err := os.Open(authFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open registry credentials file: %w", err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing file: %v\n", err)
+		}
+	}()
+
+	cf, err := config.LoadFromReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse registry credentials file %s: %w", authFile, err)
+	}
+
+	return authn.NewMultiKeychain(&fileKeychain{config: cf}, authn.DefaultKeychain), nil
+}
+
+// fileKeychain resolves credentials from a loaded credentials file, looking
+// up the repository first and then the registry, like the default keychain
+type fileKeychain struct {
+	config *configfile.ConfigFile
+}
+
+// Resolve implements authn.Keychain
+func (k *fileKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	return k.ResolveContext(context.Background(), target)
+}
+
+// ResolveContext implements authn.ContextKeychain
+func (k *fileKeychain) ResolveContext(_ context.Context, target authn.Resource) (authn.Authenticator, error) {
+	var cfg, empty types.AuthConfig
+	for _, key := range []string{target.String(), target.RegistryStr()} {
+		if key == name.DefaultRegistry {
+			key = authn.DefaultAuthKey
+		}
+
+		var err error
+		if cfg, err = k.config.GetAuthConfig(key); err != nil {
+			return nil, err
+		}
+		// Not a credential, but set by GetAuthConfig
+		cfg.ServerAddress = ""
+		if cfg != empty {
+			break
+		}
+	}
+	if cfg == empty {
+		return authn.Anonymous, nil
+	}
+
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}), nil
+}
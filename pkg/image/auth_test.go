@@ -0,0 +1,65 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestKeychainAuthFile(t *testing.T) {
+	// Keep the default keychain away from the user's credentials
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	t.Setenv("REGISTRY_AUTH_FILE", "")
+	t.Setenv("XDG_RUNTIME_DIR", "")
+
+	authFile := filepath.Join(t.TempDir(), "auth.json")
+	config := `{"auths": {
+		"https://index.docker.io/v1/": {"username": "hub-user", "password": "hub-pass"},
+		"registry.example.com": {"auth": "dXNlcjpwYXNz"}
+	}}`
+	if err := os.WriteFile(authFile, []byte(config), 0600); err != nil {
+		t.Fatalf("Failed to write credentials file: %v", err)
+	}
+
+	keychain, err := Keychain(authFile)
+	if err != nil {
+		t.Fatalf("Failed to load keychain: %v", err)
+	}
+
+	tests := map[string]authn.AuthConfig{
+		"nginx":                         {Username: "hub-user", Password: "hub-pass"},
+		"registry.example.com/team/app": {Username: "user", Password: "pass"},
+		"ghcr.io/org/app":               {},
+	}
+	for repo, expected := range tests {
+		ref, err := name.NewRepository(repo)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", repo, err)
+		}
+		auth, err := keychain.Resolve(ref)
+		if err != nil {
+			t.Fatalf("%s: failed to resolve credentials: %v", repo, err)
+		}
+		if expected == (authn.AuthConfig{}) {
+			if auth != authn.Anonymous {
+				t.Errorf("%s: expected anonymous access", repo)
+			}
+			continue
+		}
+		cfg, err := auth.Authorization()
+		if err != nil {
+			t.Fatalf("%s: failed to get authorization: %v", repo, err)
+		}
+		if cfg.Username != expected.Username || cfg.Password != expected.Password {
+			t.Errorf("%s: expected %s/%s, got %s/%s", repo, expected.Username, expected.Password, cfg.Username, cfg.Password)
+		}
+	}
+
+	if _, err := Keychain(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected error for a missing credentials file, but got nil")
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
-	yaml "gopkg.in/yaml.v3"
 )
 
 // ImageInfo stores information about a container image
@@ -98,89 +97,6 @@ func LoadImage(imagePath string, registryHost string) error {
 	return nil
 }
 
-// ReplaceImageReferences updates image references in Helm values to use the local registry
-func ReplaceImageReferences(valuesFile string, registryHost string, imageMap map[string]string) error {
-	// Read the YAML file
-	data, err := os.ReadFile(valuesFile)
-	if err != nil {
-		return fmt.Errorf("failed to read values file: %w", err)
-	}
-
-	// Parse the YAML content
-	var values map[string]interface{}
-	if err := yaml.Unmarshal(data, &values); err != nil {
-		return fmt.Errorf("failed to parse YAML: %w", err)
-	}
-
-	// Process image references recursively
-	processValues(values, registryHost, imageMap)
-
-	// Write back the modified YAML
-	updatedData, err := yaml.Marshal(values)
-	if err != nil {
-		return fmt.Errorf("failed to marshal updated YAML: %w", err)
-	}
-
-	if err := os.WriteFile(valuesFile, updatedData, 0644); err != nil {
-		return fmt.Errorf("failed to write updated values file: %w", err)
-	}
-
-	return nil
-}
-
-// processValues recursively processes a values map to replace image references
-func processValues(values map[string]interface{}, registryHost string, imageMap map[string]string) {
-	// Common patterns for image references in Helm charts
-	imageKeys := []string{"repository", "image", "image.repository"}
-
-	for key, value := range values {
-		// Check if this is an image reference
-		for _, imgKey := range imageKeys {
-			if key == imgKey && value != nil {
-				if strValue, ok := value.(string); ok {
-					// Replace with the reference to the local registry
-					values[key] = replaceImageRef(strValue, registryHost, imageMap)
-				}
-			}
-		}
-
-		// Handle special case for image sections that have repository field
-		if key == "image" {
-			if imgMap, ok := value.(map[string]interface{}); ok {
-				if repo, ok := imgMap["repository"].(string); ok {
-					imgMap["repository"] = replaceImageRef(repo, registryHost, imageMap)
-				}
-			}
-		}
-
-		// Recursively process nested maps
-		if subMap, ok := value.(map[string]interface{}); ok {
-			processValues(subMap, registryHost, imageMap)
-		} else if subArray, ok := value.([]interface{}); ok {
-			// Process arrays that might contain maps
-			for i, item := range subArray {
-				if subMap, ok := item.(map[string]interface{}); ok {
-					processValues(subMap, registryHost, imageMap)
-					subArray[i] = subMap
-				}
-			}
-		}
-	}
-}
-
-// replaceImageRef replaces an image reference with one pointing to the local registry
-func replaceImageRef(imageRef, registryHost string, imageMap map[string]string) string {
-	// If we have a mapping for this exact image, use it
-	if newRef, ok := imageMap[imageRef]; ok {
-		return newRef
-	}
-
-	// Otherwise, try to construct a new reference based on the original
-	parts := strings.Split(imageRef, "/")
-	baseName := parts[len(parts)-1]
-	return fmt.Sprintf("%s/%s", registryHost, baseName)
-}
-
 // sanitizeFilename converts an image name to a safe filename
 func sanitizeFilename(imageName string) string {
 	// Replace invalid characters with underscores
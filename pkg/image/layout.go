@@ -0,0 +1,570 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/capsailer/capsailer-cli/pkg/cache"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+)
+
+// RefNameAnnotation is the OCI annotation holding the original image reference
+const RefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// Layout is an OCI image layout (blobs/sha256 plus index.json) that images can
+// be written to from several goroutines. Every blob is stored once, so layers
+// shared between images take up space only once.
+type Layout struct {
+	path layout.Path
+
+	mu        sync.Mutex // guards index.json, blobLocks and omitted
+	blobLocks map[string]*sync.Mutex
+
+	exclude map[string]map[string]bool // Layer blobs per repository that are not written, see ExcludeLayers
+	omitted map[string]bool            // Excluded layers that images referenced
+
+	cache     *cache.Cache // Persistent blob cache, see UseCache
+	cacheHits int          // Layers taken from the cache, guarded by mu
+}
+
+// CreateLayout creates an empty OCI image layout in dir
+func CreateLayout(dir string) (*Layout, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create layout directory: %w", err)
+	}
+
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCI layout: %w", err)
+	}
+
+	// Configs and manifests are written directly, so the blob directory must
+	// exist even when no layer blob is written
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	return &Layout{path: p, blobLocks: make(map[string]*sync.Mutex)}, nil
+}
+
+// OpenLayout opens an existing OCI image layout
+func OpenLayout(dir string) (*Layout, error) {
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open OCI layout: %w", err)
+	}
+
+	return &Layout{path: p, blobLocks: make(map[string]*sync.Mutex)}, nil
+}
+
+// Path returns the directory of the layout
+func (l *Layout) Path() string {
+	return string(l.path)
+}
+
+// ExcludeLayers makes the layout skip the layer blobs ("sha256:<hex>") that
+// other images of the same repository use, keyed by image reference. Manifests
+// still reference them, which is how delta bundles leave out layers a base
+// bundle already pushed. Registries only share layers within a repository, so
+// a layer is still written for images of other repositories.
+func (l *Layout) ExcludeLayers(layers map[string]map[string]bool) error {
+	l.exclude = make(map[string]map[string]bool)
+	l.omitted = make(map[string]bool)
+
+	for reference, blobs := range layers {
+		repo, err := repositoryOf(reference)
+		if err != nil {
+			return err
+		}
+		if l.exclude[repo] == nil {
+			l.exclude[repo] = make(map[string]bool)
+		}
+		for blob := range blobs {
+			l.exclude[repo][blob] = true
+		}
+	}
+
+	return nil
+}
+
+// UseCache makes the layout take layer blobs from a persistent cache, and
+// download missing ones into it first so later builds can reuse them
+func (l *Layout) UseCache(c *cache.Cache) {
+	l.cache = c
+}
+
+// CachedLayers returns how many layers were taken from the cache
+func (l *Layout) CachedLayers() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cacheHits
+}
+
+// OmittedLayers returns the excluded layers that written images reference
+// and that were not written for an image of another repository
+func (l *Layout) OmittedLayers() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	omitted := make([]string, 0, len(l.omitted))
+	for blob := range l.omitted {
+		hash, err := v1.NewHash(blob)
+		if err == nil {
+			if _, err := os.Stat(filepath.Join(l.Path(), blobPath(hash))); err == nil {
+				continue
+			}
+		}
+		omitted = append(omitted, blob)
+	}
+	sort.Strings(omitted)
+	return omitted
+}
+
+// AppendImage writes an image's blobs and records it in index.json under the
+// original reference. It returns the descriptor added to the index.
+func (l *Layout) AppendImage(img v1.Image, reference string) (v1.Descriptor, error) {
+	exclude, err := l.excludedFor(reference)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if err := l.writeImageBlobs(img, exclude); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	desc, err := descriptorFor(img)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc.Annotations = map[string]string{RefNameAnnotation: reference}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.path.AppendDescriptor(*desc); err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to add image to layout index: %w", err)
+	}
+
+	return *desc, nil
+}
+
+// AppendIndex writes an image index together with every image it references
+// and records it in index.json under the original reference
+func (l *Layout) AppendIndex(ii v1.ImageIndex, reference string) (v1.Descriptor, error) {
+	exclude, err := l.excludedFor(reference)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if err := l.writeIndexBlobs(ii, exclude); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	mediaType, err := ii.MediaType()
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to get media type: %w", err)
+	}
+	digest, err := ii.Digest()
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to get index digest: %w", err)
+	}
+	size, err := ii.Size()
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to get index size: %w", err)
+	}
+
+	desc := v1.Descriptor{
+		MediaType:   mediaType,
+		Digest:      digest,
+		Size:        size,
+		Annotations: map[string]string{RefNameAnnotation: reference},
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.path.AppendDescriptor(desc); err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to add image index to layout index: %w", err)
+	}
+
+	return desc, nil
+}
+
+// SortIndex orders index.json by reference so that layouts written by
+// parallel downloads do not depend on download order
+func (l *Layout) SortIndex() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ii, err := l.path.ImageIndex()
+	if err != nil {
+		return fmt.Errorf("failed to read layout index: %w", err)
+	}
+	indexManifest, err := ii.IndexManifest()
+	if err != nil {
+		return fmt.Errorf("failed to read layout index: %w", err)
+	}
+
+	sort.SliceStable(indexManifest.Manifests, func(i, j int) bool {
+		return indexManifest.Manifests[i].Annotations[RefNameAnnotation] < indexManifest.Manifests[j].Annotations[RefNameAnnotation]
+	})
+
+	data, err := json.MarshalIndent(indexManifest, "", "   ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal layout index: %w", err)
+	}
+	if err := l.path.WriteFile("index.json", data, 0644); err != nil {
+		return fmt.Errorf("failed to write layout index: %w", err)
+	}
+
+	return nil
+}
+
+// IsIndex reports whether the manifest with the given digest is an image index
+func (l *Layout) IsIndex(digest string) (bool, error) {
+	root, err := l.path.ImageIndex()
+	if err != nil {
+		return false, fmt.Errorf("failed to read layout index: %w", err)
+	}
+	indexManifest, err := root.IndexManifest()
+	if err != nil {
+		return false, fmt.Errorf("failed to read layout index: %w", err)
+	}
+
+	for _, desc := range indexManifest.Manifests {
+		if desc.Digest.String() == digest {
+			return desc.MediaType.IsIndex(), nil
+		}
+	}
+	return false, fmt.Errorf("manifest %s not found in layout", digest)
+}
+
+// Index returns the image index with the given digest
+func (l *Layout) Index(digest string) (v1.ImageIndex, error) {
+	hash, err := v1.NewHash(digest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest '%s': %w", digest, err)
+	}
+
+	ii, err := l.path.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read layout index: %w", err)
+	}
+
+	child, err := ii.ImageIndex(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image index %s from layout: %w", digest, err)
+	}
+
+	return child, nil
+}
+
+// PlatformImage returns the image with the given digest. For an image index it
+// returns the image for the given platform, or the first image if none matches.
+func (l *Layout) PlatformImage(digest string, platform v1.Platform) (v1.Image, error) {
+	isIndex, err := l.IsIndex(digest)
+	if err != nil {
+		return nil, err
+	}
+	if !isIndex {
+		return l.Image(digest)
+	}
+
+	ii, err := l.Index(digest)
+	if err != nil {
+		return nil, err
+	}
+	indexManifest, err := ii.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image index: %w", err)
+	}
+
+	var chosen *v1.Descriptor
+	for i, desc := range indexManifest.Manifests {
+		if !desc.MediaType.IsImage() {
+			continue
+		}
+		if desc.Platform != nil && desc.Platform.Satisfies(platform) {
+			chosen = &indexManifest.Manifests[i]
+			break
+		}
+		if chosen == nil {
+			chosen = &indexManifest.Manifests[i]
+		}
+	}
+	if chosen == nil {
+		return nil, fmt.Errorf("image index %s contains no images", digest)
+	}
+
+	return ii.Image(chosen.Digest)
+}
+
+// Image returns the image with the given manifest digest
+func (l *Layout) Image(digest string) (v1.Image, error) {
+	hash, err := v1.NewHash(digest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest '%s': %w", digest, err)
+	}
+
+	img, err := l.path.Image(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image %s from layout: %w", digest, err)
+	}
+
+	return img, nil
+}
+
+// excludedFor returns the excluded layers for the repository of reference
+func (l *Layout) excludedFor(reference string) (map[string]bool, error) {
+	if l.exclude == nil {
+		return nil, nil
+	}
+	repo, err := repositoryOf(reference)
+	if err != nil {
+		return nil, err
+	}
+	return l.exclude[repo], nil
+}
+
+// repositoryOf returns the fully qualified repository of an image reference
+func repositoryOf(reference string) (string, error) {
+	ref, err := name.ParseReference(reference)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference '%s': %w", reference, err)
+	}
+	return ref.Context().Name(), nil
+}
+
+// writeImageBlobs writes the layers, config and manifest of an image, except
+// for the excluded layers
+func (l *Layout) writeImageBlobs(img v1.Image, exclude map[string]bool) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("failed to get image layers: %w", err)
+	}
+
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return fmt.Errorf("failed to get layer digest: %w", err)
+		}
+
+		if exclude[digest.String()] {
+			l.mu.Lock()
+			l.omitted[digest.String()] = true
+			l.mu.Unlock()
+			continue
+		}
+
+		if err := l.writeBlobOnce(digest, func() error {
+			if l.cache != nil {
+				hit, err := l.cache.Fetch(digest.String(), filepath.Join(l.Path(), blobPath(digest)), layer.Compressed)
+				if hit {
+					l.mu.Lock()
+					l.cacheHits++
+					l.mu.Unlock()
+				}
+				return err
+			}
+			rc, err := layer.Compressed()
+			if err != nil {
+				return err
+			}
+			return l.path.WriteBlob(digest, rc)
+		}); err != nil {
+			return fmt.Errorf("failed to write layer %s: %w", digest, err)
+		}
+	}
+
+	configName, err := img.ConfigName()
+	if err != nil {
+		return fmt.Errorf("failed to get config digest: %w", err)
+	}
+	configData, err := img.RawConfigFile()
+	if err != nil {
+		return fmt.Errorf("failed to get config: %w", err)
+	}
+	if err := l.writeBlobOnce(configName, func() error {
+		return l.path.WriteFile(blobPath(configName), configData, 0644)
+	}); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return fmt.Errorf("failed to get image digest: %w", err)
+	}
+	manifest, err := img.RawManifest()
+	if err != nil {
+		return fmt.Errorf("failed to get manifest: %w", err)
+	}
+	if err := l.writeBlobOnce(digest, func() error {
+		return l.path.WriteFile(blobPath(digest), manifest, 0644)
+	}); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return nil
+}
+
+// writeIndexBlobs writes every image and nested index an index references,
+// followed by the index manifest itself
+func (l *Layout) writeIndexBlobs(ii v1.ImageIndex, exclude map[string]bool) error {
+	indexManifest, err := ii.IndexManifest()
+	if err != nil {
+		return fmt.Errorf("failed to read image index: %w", err)
+	}
+
+	for _, desc := range indexManifest.Manifests {
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := ii.ImageIndex(desc.Digest)
+			if err != nil {
+				return fmt.Errorf("failed to get image index %s: %w", desc.Digest, err)
+			}
+			if err := l.writeIndexBlobs(child, exclude); err != nil {
+				return err
+			}
+		case desc.MediaType.IsImage():
+			img, err := ii.Image(desc.Digest)
+			if err != nil {
+				return fmt.Errorf("failed to get image %s: %w", desc.Digest, err)
+			}
+			if err := l.writeImageBlobs(img, exclude); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported manifest type %s in image index", desc.MediaType)
+		}
+	}
+
+	digest, err := ii.Digest()
+	if err != nil {
+		return fmt.Errorf("failed to get index digest: %w", err)
+	}
+	manifest, err := ii.RawManifest()
+	if err != nil {
+		return fmt.Errorf("failed to get index manifest: %w", err)
+	}
+	return l.writeBlobOnce(digest, func() error {
+		return l.path.WriteFile(blobPath(digest), manifest, 0644)
+	})
+}
+
+// writeBlobOnce serializes writers of the same blob and skips blobs that are
+// already complete, so concurrent downloads never write one file twice
+func (l *Layout) writeBlobOnce(hash v1.Hash, write func() error) error {
+	l.mu.Lock()
+	lock, ok := l.blobLocks[hash.String()]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.blobLocks[hash.String()] = lock
+	}
+	l.mu.Unlock()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := os.Stat(filepath.Join(l.Path(), blobPath(hash))); err == nil {
+		return nil
+	}
+
+	return write()
+}
+
+// blobPath returns the path of a blob relative to the layout root
+func blobPath(hash v1.Hash) string {
+	return "blobs/" + hash.Algorithm + "/" + hash.Hex
+}
+
+// descriptorFor builds the index descriptor for an image
+func descriptorFor(img v1.Image) (*v1.Descriptor, error) {
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get media type: %w", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image digest: %w", err)
+	}
+	size, err := img.Size()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest size: %w", err)
+	}
+
+	return &v1.Descriptor{MediaType: mediaType, Digest: digest, Size: size}, nil
+}
+
+// StoredSize returns the number of bytes an image occupies in a layout:
+// its manifest, config and layers
+func StoredSize(img v1.Image) (int64, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get manifest: %w", err)
+	}
+	size, err := img.Size()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get manifest size: %w", err)
+	}
+
+	size += manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+
+	return size, nil
+}
+
+// StoredIndexSize returns the number of bytes an image index and all images it
+// references occupy in a layout. Layers shared between platforms count once.
+func StoredIndexSize(ii v1.ImageIndex) (int64, error) {
+	seen := make(map[v1.Hash]bool)
+	return storedIndexSize(ii, seen)
+}
+
+func storedIndexSize(ii v1.ImageIndex, seen map[v1.Hash]bool) (int64, error) {
+	indexManifest, err := ii.IndexManifest()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read image index: %w", err)
+	}
+	size, err := ii.Size()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get index size: %w", err)
+	}
+
+	for _, desc := range indexManifest.Manifests {
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := ii.ImageIndex(desc.Digest)
+			if err != nil {
+				return 0, fmt.Errorf("failed to get image index %s: %w", desc.Digest, err)
+			}
+			childSize, err := storedIndexSize(child, seen)
+			if err != nil {
+				return 0, err
+			}
+			size += childSize
+		case desc.MediaType.IsImage():
+			img, err := ii.Image(desc.Digest)
+			if err != nil {
+				return 0, fmt.Errorf("failed to get image %s: %w", desc.Digest, err)
+			}
+			manifest, err := img.Manifest()
+			if err != nil {
+				return 0, fmt.Errorf("failed to get manifest: %w", err)
+			}
+			size += desc.Size
+			for _, blob := range append([]v1.Descriptor{manifest.Config}, manifest.Layers...) {
+				if !seen[blob.Digest] {
+					seen[blob.Digest] = true
+					size += blob.Size
+				}
+			}
+		}
+	}
+
+	return size, nil
+}
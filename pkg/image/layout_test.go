@@ -0,0 +1,166 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestLayoutSharesLayers(t *testing.T) {
+	base, err := random.Layer(1024, "application/vnd.oci.image.layer.v1.tar+gzip")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	images := make([]v1.Image, 3)
+	for i := range images {
+		img, err := random.Image(512, 1)
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		if images[i], err = mutate.AppendLayers(img, base); err != nil {
+			t.Fatalf("Failed to add shared layer: %v", err)
+		}
+	}
+
+	dir := t.TempDir()
+	l, err := CreateLayout(dir)
+	if err != nil {
+		t.Fatalf("Failed to create layout: %v", err)
+	}
+
+	// Images written concurrently still store the shared layer once
+	var wg sync.WaitGroup
+	errs := make([]error, len(images))
+	for i, img := range images {
+		wg.Add(1)
+		go func(i int, img v1.Image) {
+			defer wg.Done()
+			_, errs[i] = l.AppendImage(img, "example.com/app:"+string(rune('a'+i)))
+		}(i, img)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("Failed to append image: %v", err)
+		}
+	}
+
+	// One own layer, a config and a manifest per image, plus the shared layer
+	if blobs := countBlobs(t, dir); blobs != 3*3+1 {
+		t.Errorf("Expected %d blobs, got %d", 3*3+1, blobs)
+	}
+
+	// Appending an image again writes nothing new
+	if _, err := l.AppendImage(images[0], "example.com/app:again"); err != nil {
+		t.Fatalf("Failed to append image: %v", err)
+	}
+	if blobs := countBlobs(t, dir); blobs != 3*3+1 {
+		t.Errorf("Expected %d blobs after appending an image again, got %d", 3*3+1, blobs)
+	}
+
+	// Images read back from the layout are intact
+	digest, err := images[1].Digest()
+	if err != nil {
+		t.Fatalf("Failed to get digest: %v", err)
+	}
+	img, err := l.Image(digest.String())
+	if err != nil {
+		t.Fatalf("Failed to read image: %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil || len(layers) != 2 {
+		t.Fatalf("Expected 2 layers, got %d: %v", len(layers), err)
+	}
+}
+
+func TestLayoutAppendIndex(t *testing.T) {
+	shared, err := random.Layer(1024, "application/vnd.oci.image.layer.v1.tar+gzip")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	ii := testIndex(t, shared, "linux/amd64", "linux/arm64/v8")
+
+	dir := t.TempDir()
+	l, err := CreateLayout(dir)
+	if err != nil {
+		t.Fatalf("Failed to create layout: %v", err)
+	}
+	desc, err := l.AppendIndex(ii, "example.com/app:1.0")
+	if err != nil {
+		t.Fatalf("Failed to append index: %v", err)
+	}
+	if desc.Annotations[RefNameAnnotation] != "example.com/app:1.0" {
+		t.Errorf("Expected the reference to be recorded, got %v", desc.Annotations)
+	}
+
+	// Two images of one own layer, a config and a manifest, the shared
+	// layer and the index manifest
+	if blobs := countBlobs(t, dir); blobs != 2*3+2 {
+		t.Errorf("Expected %d blobs, got %d", 2*3+2, blobs)
+	}
+
+	isIndex, err := l.IsIndex(desc.Digest.String())
+	if err != nil || !isIndex {
+		t.Errorf("Expected %s to be an index: %v", desc.Digest, err)
+	}
+	img, err := l.PlatformImage(desc.Digest.String(), v1.Platform{OS: "linux", Architecture: "arm64"})
+	if err != nil {
+		t.Fatalf("Failed to read platform image: %v", err)
+	}
+	config, err := img.ConfigFile()
+	if err != nil || config.Architecture != "arm64" {
+		t.Errorf("Expected the arm64 image, got %v: %v", config, err)
+	}
+}
+
+// testIndex returns an image index with an image for each platform, every
+// image having its own layer and the shared one
+func testIndex(t *testing.T, shared v1.Layer, platforms ...string) v1.ImageIndex {
+	t.Helper()
+
+	var ii v1.ImageIndex = empty.Index
+	for _, value := range platforms {
+		platform, err := v1.ParsePlatform(value)
+		if err != nil {
+			t.Fatalf("Failed to parse platform: %v", err)
+		}
+		img, err := random.Image(512, 1)
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		if img, err = mutate.AppendLayers(img, shared); err != nil {
+			t.Fatalf("Failed to add shared layer: %v", err)
+		}
+		config, err := img.ConfigFile()
+		if err != nil {
+			t.Fatalf("Failed to read config: %v", err)
+		}
+		config = config.DeepCopy()
+		config.OS, config.Architecture, config.Variant = platform.OS, platform.Architecture, platform.Variant
+		if img, err = mutate.ConfigFile(img, config); err != nil {
+			t.Fatalf("Failed to set platform: %v", err)
+		}
+		ii = mutate.AppendManifests(ii, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: platform},
+		})
+	}
+	return ii
+}
+
+// countBlobs returns the number of blobs in a layout
+func countBlobs(t *testing.T, dir string) int {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	if err != nil {
+		t.Fatalf("Failed to read blobs: %v", err)
+	}
+	return len(entries)
+}
@@ -0,0 +1,119 @@
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/capsailer/capsailer-cli/pkg/utils"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Mirrors maps image references to the locations they are pulled from
+type Mirrors struct {
+	rules []mirrorRule
+}
+
+// mirrorRule is a RegistryConfig with its prefix normalized, so docker.io
+// and index.docker.io match the same images
+type mirrorRule struct {
+	prefix  string
+	mirrors []string
+	rewrite string
+}
+
+// NewMirrors creates Mirrors from registry rules. When two rules have the
+// same prefix, the first one wins.
+func NewMirrors(registries []utils.RegistryConfig) (*Mirrors, error) {
+	m := &Mirrors{}
+	seen := make(map[string]bool)
+	for _, reg := range registries {
+		prefix, err := normalizePrefix(reg.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		if seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+
+		m.rules = append(m.rules, mirrorRule{
+			prefix:  prefix,
+			mirrors: reg.Mirrors,
+			rewrite: reg.Rewrite,
+		})
+	}
+
+	return m, nil
+}
+
+// Sources returns the references to pull an image from, in order: the
+// configured mirrors followed by the image itself, or only the rewritten
+// reference. The longest matching prefix applies.
+func (m *Mirrors) Sources(ref name.Reference) ([]name.Reference, error) {
+	repo := ref.Context().RegistryStr() + "/" + ref.Context().RepositoryStr()
+
+	var match *mirrorRule
+	for i, rule := range m.rules {
+		if repo != rule.prefix && !strings.HasPrefix(repo, rule.prefix+"/") {
+			continue
+		}
+		if match == nil || len(rule.prefix) > len(match.prefix) {
+			match = &m.rules[i]
+		}
+	}
+	if match == nil {
+		return []name.Reference{ref}, nil
+	}
+
+	rest := strings.TrimPrefix(repo, match.prefix)
+	if match.rewrite != "" {
+		rewritten, err := withRepository(ref, strings.TrimSuffix(match.rewrite, "/")+rest)
+		if err != nil {
+			return nil, err
+		}
+		return []name.Reference{rewritten}, nil
+	}
+
+	var sources []name.Reference
+	for _, mirror := range match.mirrors {
+		mirrored, err := withRepository(ref, strings.TrimSuffix(mirror, "/")+rest)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, mirrored)
+	}
+	return append(sources, ref), nil
+}
+
+// withRepository returns ref with its repository replaced, keeping the tag
+// or digest
+func withRepository(ref name.Reference, repo string) (name.Reference, error) {
+	var target string
+	if digest, ok := ref.(name.Digest); ok {
+		target = repo + "@" + digest.DigestStr()
+	} else {
+		target = repo + ":" + ref.Identifier()
+	}
+
+	newRef, err := name.ParseReference(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror reference '%s': %w", target, err)
+	}
+	return newRef, nil
+}
+
+// normalizePrefix resolves the registry part of a prefix the way image
+// references are resolved, for example docker.io to index.docker.io
+func normalizePrefix(prefix string) (string, error) {
+	prefix = strings.TrimSuffix(strings.TrimSpace(prefix), "/")
+	host, path, _ := strings.Cut(prefix, "/")
+
+	reg, err := name.NewRegistry(host)
+	if err != nil {
+		return "", fmt.Errorf("invalid registry prefix '%s': %w", prefix, err)
+	}
+	if path == "" {
+		return reg.RegistryStr(), nil
+	}
+	return reg.RegistryStr() + "/" + path, nil
+}
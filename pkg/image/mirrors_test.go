@@ -0,0 +1,69 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/capsailer/capsailer-cli/pkg/utils"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestMirrorsSources(t *testing.T) {
+	mirrors, err := NewMirrors([]utils.RegistryConfig{
+		{Prefix: "docker.io", Mirrors: []string{"cache.internal/dockerhub"}},
+		{Prefix: "quay.io/prometheus", Rewrite: "registry.internal/prom/"},
+		{Prefix: "quay.io", Mirrors: []string{"cache.internal/quay", "backup.internal/quay"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create mirrors: %v", err)
+	}
+
+	tests := map[string][]string{
+		"nginx:1.25": {
+			"cache.internal/dockerhub/library/nginx:1.25",
+			"index.docker.io/library/nginx:1.25",
+		},
+		"quay.io/prometheus/node-exporter:v1.8.0": {
+			"registry.internal/prom/node-exporter:v1.8.0",
+		},
+		"quay.io/jetstack/cert-manager-controller@sha256:0000000000000000000000000000000000000000000000000000000000000000": {
+			"cache.internal/quay/jetstack/cert-manager-controller@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			"backup.internal/quay/jetstack/cert-manager-controller@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			"quay.io/jetstack/cert-manager-controller@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		},
+		"quay.io/prometheus-community/tool:1": {
+			"cache.internal/quay/prometheus-community/tool:1",
+			"backup.internal/quay/prometheus-community/tool:1",
+			"quay.io/prometheus-community/tool:1",
+		},
+		"ghcr.io/org/app:2": {
+			"ghcr.io/org/app:2",
+		},
+	}
+
+	for image, expected := range tests {
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", image, err)
+		}
+		sources, err := mirrors.Sources(ref)
+		if err != nil {
+			t.Errorf("%s: failed to get sources: %v", image, err)
+			continue
+		}
+
+		var got []string
+		for _, source := range sources {
+			got = append(got, source.Name())
+		}
+		if len(got) != len(expected) {
+			t.Errorf("%s: expected sources %v, got %v", image, expected, got)
+			continue
+		}
+		for i := range expected {
+			if got[i] != expected[i] {
+				t.Errorf("%s: expected sources %v, got %v", image, expected, got)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package image
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// AllPlatforms is the platforms value that keeps every manifest of an image index
+const AllPlatforms = "all"
+
+// ParsePlatforms parses platform strings such as linux/amd64 or linux/arm/v7.
+// It reports all=true when the list contains "all".
+func ParsePlatforms(values []string) (platforms []v1.Platform, all bool, err error) {
+	for _, value := range values {
+		if strings.TrimSpace(value) == AllPlatforms {
+			return nil, true, nil
+		}
+
+		platform, err := v1.ParsePlatform(strings.TrimSpace(value))
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid platform '%s': %w", value, err)
+		}
+		if platform.OS == "" || platform.Architecture == "" {
+			return nil, false, fmt.Errorf("invalid platform '%s': expected os/arch[/variant]", value)
+		}
+		platforms = append(platforms, *platform)
+	}
+
+	return platforms, false, nil
+}
+
+// FilterIndex returns a copy of an image index that only contains the
+// manifests for the requested platforms. A requested platform without a
+// variant matches every variant, so linux/arm64 matches linux/arm64/v8.
+func FilterIndex(ii v1.ImageIndex, platforms []v1.Platform) (v1.ImageIndex, error) {
+	indexManifest, err := ii.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image index: %w", err)
+	}
+
+	wanted := func(desc v1.Descriptor) bool {
+		if desc.Platform == nil {
+			return false
+		}
+		for _, platform := range platforms {
+			if desc.Platform.Satisfies(platform) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var available []string
+	missing := make(map[string]bool)
+	for _, platform := range platforms {
+		missing[platform.String()] = true
+	}
+	for _, desc := range indexManifest.Manifests {
+		if desc.Platform == nil {
+			continue
+		}
+		available = append(available, desc.Platform.String())
+		for _, platform := range platforms {
+			if desc.Platform.Satisfies(platform) {
+				delete(missing, platform.String())
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		var names []string
+		for _, platform := range platforms {
+			if missing[platform.String()] {
+				names = append(names, platform.String())
+			}
+		}
+		return nil, fmt.Errorf("platforms %s not available (available: %s)", strings.Join(names, ", "), strings.Join(available, ", "))
+	}
+
+	return mutate.RemoveManifests(ii, func(desc v1.Descriptor) bool {
+		return !wanted(desc)
+	}), nil
+}
+
+// IndexPlatforms lists the platforms of the manifests in an image index
+func IndexPlatforms(ii v1.ImageIndex) ([]string, error) {
+	indexManifest, err := ii.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image index: %w", err)
+	}
+
+	var platforms []string
+	for _, desc := range indexManifest.Manifests {
+		if desc.Platform != nil && desc.Platform.OS != "unknown" {
+			platforms = append(platforms, desc.Platform.String())
+		}
+	}
+	return platforms, nil
+}
+
+// HostPlatform returns the linux platform matching the local architecture,
+// which is what a local docker daemon expects when loading an image
+func HostPlatform() v1.Platform {
+	return v1.Platform{OS: "linux", Architecture: runtime.GOARCH}
+}
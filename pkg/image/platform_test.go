@@ -0,0 +1,98 @@
+package image
+
+import (
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestParsePlatforms(t *testing.T) {
+	tests := []struct {
+		values  []string
+		want    []string
+		all     bool
+		wantErr bool
+	}{
+		{values: []string{"linux/amd64", " linux/arm/v7 "}, want: []string{"linux/amd64", "linux/arm/v7"}},
+		{values: []string{"linux/amd64", "all"}, all: true},
+		{values: nil},
+		{values: []string{"linux"}, wantErr: true},
+		{values: []string{""}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		platforms, all, err := ParsePlatforms(tt.values)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%v: expected an error", tt.values)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.values, err)
+			continue
+		}
+		if all != tt.all {
+			t.Errorf("%v: expected all=%v, got %v", tt.values, tt.all, all)
+		}
+		var got []string
+		for _, platform := range platforms {
+			got = append(got, platform.String())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%v: expected %v, got %v", tt.values, tt.want, got)
+		}
+	}
+}
+
+func TestFilterIndex(t *testing.T) {
+	shared, err := random.Layer(256, "application/vnd.oci.image.layer.v1.tar+gzip")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	ii := testIndex(t, shared, "linux/amd64", "linux/arm64/v8", "linux/arm/v7")
+
+	tests := []struct {
+		platforms []string
+		want      []string
+		wantErr   string
+	}{
+		// A platform without a variant matches every variant
+		{platforms: []string{"linux/arm64"}, want: []string{"linux/arm64/v8"}},
+		{platforms: []string{"linux/amd64", "linux/arm/v7"}, want: []string{"linux/amd64", "linux/arm/v7"}},
+		{platforms: []string{"linux/amd64", "windows/amd64"}, wantErr: "windows/amd64 not available"},
+		{platforms: []string{"linux/arm/v6"}, wantErr: "linux/arm/v6 not available"},
+	}
+
+	for _, tt := range tests {
+		var platforms []v1.Platform
+		for _, value := range tt.platforms {
+			platform, err := v1.ParsePlatform(value)
+			if err != nil {
+				t.Fatalf("Failed to parse platform: %v", err)
+			}
+			platforms = append(platforms, *platform)
+		}
+
+		filtered, err := FilterIndex(ii, platforms)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%v: expected error containing %q, got %v", tt.platforms, tt.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.platforms, err)
+			continue
+		}
+		got, err := IndexPlatforms(filtered)
+		if err != nil {
+			t.Fatalf("Failed to list platforms: %v", err)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%v: expected %v, got %v", tt.platforms, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/capsailer/capsailer-cli/pkg/utils"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Rewriter maps images to the references they are stored under in a private
+// registry. Push stores images there, and build and deploy point chart
+// values at them, so all of them use the same rules.
+type Rewriter struct {
+	registry string
+	flatten  bool
+	rules    []rewriteRule
+}
+
+// rewriteRule is an ImageRewriteRule with its prefix normalized like mirror
+// prefixes, or its regex compiled to match whole repositories
+type rewriteRule struct {
+	prefix string
+	regex  *regexp.Regexp
+	target string
+}
+
+// NewRewriter creates a Rewriter for a registry host, such as
+// registry.local:5000. Without rules, images keep their repository path.
+func NewRewriter(registry string, rewrite *utils.ImageRewrite) (*Rewriter, error) {
+	r := &Rewriter{registry: strings.TrimSuffix(registry, "/")}
+	if rewrite == nil {
+		return r, nil
+	}
+
+	r.flatten = rewrite.Layout == utils.LayoutFlatten
+	for _, rule := range rewrite.Rules {
+		compiled := rewriteRule{target: strings.Trim(rule.Target, "/")}
+		if rule.Regex != "" {
+			regex, err := regexp.Compile("^(?:" + rule.Regex + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid image rewrite regex '%s': %w", rule.Regex, err)
+			}
+			compiled.regex = regex
+		} else {
+			prefix, err := normalizePrefix(rule.Prefix)
+			if err != nil {
+				return nil, err
+			}
+			compiled.prefix = prefix
+		}
+		r.rules = append(r.rules, compiled)
+	}
+
+	return r, nil
+}
+
+// Registry returns the registry host images are rewritten to
+func (r *Rewriter) Registry() string {
+	return r.registry
+}
+
+// Reference returns the reference an image is stored under in the private
+// registry, keeping its tag or digest. Images without either get the latest
+// tag, as when they are pulled.
+func (r *Rewriter) Reference(imageRef string) (string, error) {
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference '%s': %w", imageRef, err)
+	}
+
+	repository, err := r.repository(ref.Context())
+	if err != nil {
+		return "", err
+	}
+
+	separator := ":"
+	if _, isDigest := ref.(name.Digest); isDigest {
+		separator = "@"
+	}
+	return repository + separator + ref.Identifier(), nil
+}
+
+// Image rewrites an image as written in chart values: a repository such as
+// bitnami/nginx, or a reference with a tag or digest, which is kept
+func (r *Rewriter) Image(image string) (string, error) {
+	lastPart := image[strings.LastIndex(image, "/")+1:]
+	if strings.ContainsAny(lastPart, ":@") {
+		return r.Reference(image)
+	}
+
+	repo, err := name.NewRepository(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image repository '%s': %w", image, err)
+	}
+	return r.repository(repo)
+}
+
+// repository returns the repository in the private registry for a source
+// repository: the target of the first matching rule, or else the layout's
+func (r *Rewriter) repository(repo name.Repository) (string, error) {
+	source := repo.RegistryStr() + "/" + repo.RepositoryStr()
+
+	path := ""
+	matched := false
+	for _, rule := range r.rules {
+		if rule.regex != nil {
+			// Regexes see Docker Hub as docker.io, as it is usually written
+			familiar := source
+			if repo.RegistryStr() == name.DefaultRegistry {
+				familiar = "docker.io/" + repo.RepositoryStr()
+			}
+			if match := rule.regex.FindStringSubmatchIndex(familiar); match != nil {
+				path = string(rule.regex.ExpandString(nil, rule.target, familiar, match))
+				matched = true
+				break
+			}
+		} else if source == rule.prefix || strings.HasPrefix(source, rule.prefix+"/") {
+			path = rule.target + strings.TrimPrefix(source, rule.prefix)
+			matched = true
+			break
+		}
+	}
+
+	if !matched {
+		path = repo.RepositoryStr()
+		if r.flatten {
+			path = path[strings.LastIndex(path, "/")+1:]
+		} else if repo.RegistryStr() == name.DefaultRegistry {
+			// Docker Hub official images keep their short name
+			path = strings.TrimPrefix(path, "library/")
+		}
+	}
+
+	target := r.registry + "/" + strings.Trim(path, "/")
+	if _, err := name.NewRepository(target); err != nil {
+		return "", fmt.Errorf("image %s is rewritten to an invalid repository '%s': %w", source, target, err)
+	}
+	return target, nil
+}
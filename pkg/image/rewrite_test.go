@@ -0,0 +1,62 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/capsailer/capsailer-cli/pkg/utils"
+)
+
+func TestRewriter(t *testing.T) {
+	rules := &utils.ImageRewrite{
+		Rules: []utils.ImageRewriteRule{
+			{Prefix: "docker.io/bitnami", Target: "vendor/bitnami"},
+			{Regex: `quay\.io/([^/]+)/(.+)`, Target: "quay/$1-$2"},
+			{Prefix: "quay.io", Target: "quay-other"},
+		},
+	}
+
+	tests := []struct {
+		layout string
+		image  string
+		want   string
+	}{
+		// Without a matching rule, the layout applies
+		{"", "nginx:1.25", "registry.local:5000/nginx:1.25"},
+		{"", "ghcr.io/org_a/app:1.0", "registry.local:5000/org_a/app:1.0"},
+		{"", "ghcr.io/org_b/app@sha256:0000000000000000000000000000000000000000000000000000000000000000", "registry.local:5000/org_b/app@sha256:0000000000000000000000000000000000000000000000000000000000000000"},
+		{utils.LayoutFlatten, "ghcr.io/org_a/app:1.0", "registry.local:5000/app:1.0"},
+
+		// Rules apply in order, to repositories with or without a tag
+		{"", "bitnami/nginx:1.25", "registry.local:5000/vendor/bitnami/nginx:1.25"},
+		{"", "docker.io/bitnami/nginx", "registry.local:5000/vendor/bitnami/nginx"},
+		{utils.LayoutFlatten, "quay.io/prometheus/node-exporter:v1.8.0", "registry.local:5000/quay/prometheus-node-exporter:v1.8.0"},
+		{"", "quay.io/coreos", "registry.local:5000/quay-other/coreos"},
+	}
+
+	for _, tt := range tests {
+		rewrite := *rules
+		rewrite.Layout = tt.layout
+		rewriter, err := NewRewriter("registry.local:5000", &rewrite)
+		if err != nil {
+			t.Fatalf("Failed to create rewriter: %v", err)
+		}
+
+		got, err := rewriter.Image(tt.image)
+		if err != nil {
+			t.Errorf("%s: failed to rewrite: %v", tt.image, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.image, tt.want, got)
+		}
+	}
+
+	// Push stores images without a tag under latest
+	rewriter, err := NewRewriter("registry.local:5000", rules)
+	if err != nil {
+		t.Fatalf("Failed to create rewriter: %v", err)
+	}
+	if got, err := rewriter.Reference("bitnami/nginx"); err != nil || got != "registry.local:5000/vendor/bitnami/nginx:latest" {
+		t.Errorf("Expected registry.local:5000/vendor/bitnami/nginx:latest, got %s, %v", got, err)
+	}
+}
@@ -0,0 +1,28 @@
+package image
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// TLSConfig returns the TLS client configuration for pushing to a registry:
+// the system's trusted CAs along with the PEM CA bundle, or no verification
+// at all when insecure
+func TLSConfig(caBundle []byte, insecure bool) (*tls.Config, error) {
+	if insecure {
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+	if len(caBundle) == 0 {
+		return &tls.Config{}, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caBundle) {
+		return nil, fmt.Errorf("no certificates found in registry CA bundle")
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
@@ -0,0 +1,49 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+)
+
+// Apply creates or updates objects with server-side apply, in the order
+// they are given, like `kubectl apply --server-side --force-conflicts`
+func (c *Client) Apply(ctx context.Context, objects ...runtime.Object) error {
+	for _, object := range objects {
+		obj, err := toUnstructured(object)
+		if err != nil {
+			return err
+		}
+
+		gvk := obj.GroupVersionKind()
+		objName := strings.ToLower(gvk.Kind) + "/" + obj.GetName()
+
+		mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			return fmt.Errorf("failed to find the resource for %s: %w", objName, err)
+		}
+
+		var resource dynamic.ResourceInterface
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			resource = c.dynamic.Resource(mapping.Resource).Namespace(obj.GetNamespace())
+		} else {
+			resource = c.dynamic.Resource(mapping.Resource)
+		}
+
+		if _, err := resource.Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{
+			FieldManager: FieldManager,
+			Force:        true,
+		}); err != nil {
+			return fmt.Errorf("failed to apply %s: %w", objName, err)
+		}
+
+		fmt.Printf("%s applied\n", objName)
+	}
+
+	return nil
+}
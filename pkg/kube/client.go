@@ -0,0 +1,59 @@
+package kube
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// FieldManager is the field manager capsailer applies objects as
+const FieldManager = "capsailer"
+
+// Client talks to a Kubernetes cluster through client-go, so that no
+// kubectl binary is needed
+type Client struct {
+	config    *rest.Config
+	clientset kubernetes.Interface
+	dynamic   dynamic.Interface
+	mapper    meta.RESTMapper
+
+	dialPod func(namespace, pod string) (httpstream.Dialer, error) // Replaces the SPDY dialer of port-forwards in tests
+}
+
+// NewClient creates a client for the cluster of a kubeconfig file. Without
+// a path, the kubeconfig is found like kubectl does, from $KUBECONFIG or
+// ~/.kube/config, falling back to the in-cluster configuration.
+func NewClient(kubeconfigPath string) (*Client, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfigPath
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	// Resources are discovered on first use, and only once
+	discovery := memory.NewMemCacheClient(clientset.Discovery())
+
+	return &Client{
+		config:    config,
+		clientset: clientset,
+		dynamic:   dynamicClient,
+		mapper:    restmapper.NewDeferredDiscoveryRESTMapper(discovery),
+	}, nil
+}
@@ -0,0 +1,321 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/portforward"
+)
+
+func TestApply(t *testing.T) {
+	objects := []runtime.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "capsailer-registry"}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "capsailer-registry"}},
+	}
+
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme.Scheme)
+	dynamicClient.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj := &unstructured.Unstructured{}
+		err := obj.UnmarshalJSON(action.(k8stesting.PatchAction).GetPatch())
+		return true, obj, err
+	})
+
+	client := &Client{dynamic: dynamicClient, mapper: mapper}
+	if err := client.Apply(context.Background(), objects...); err != nil {
+		t.Fatalf("Failed to apply objects: %v", err)
+	}
+
+	want := []struct {
+		resource  string
+		namespace string
+		name      string
+	}{
+		{"namespaces", "", "capsailer-registry"},
+		{"deployments", "capsailer-registry", "registry"},
+	}
+	actions := dynamicClient.Actions()
+	if len(actions) != len(want) {
+		t.Fatalf("Expected %d actions, got %d", len(want), len(actions))
+	}
+	for i, action := range actions {
+		patch, ok := action.(k8stesting.PatchAction)
+		if !ok || patch.GetPatchType() != types.ApplyPatchType {
+			t.Errorf("Expected an apply patch, got %v", action)
+			continue
+		}
+		if bytes.Contains(patch.GetPatch(), []byte("creationTimestamp")) || bytes.Contains(patch.GetPatch(), []byte("status")) {
+			t.Errorf("Expected no creation timestamp or status to be applied, got %s", patch.GetPatch())
+		}
+		if patch.GetResource().Resource != want[i].resource || patch.GetNamespace() != want[i].namespace || patch.GetName() != want[i].name {
+			t.Errorf("Expected %s %s/%s to be applied, got %s %s/%s", want[i].resource, want[i].namespace, want[i].name,
+				patch.GetResource().Resource, patch.GetNamespace(), patch.GetName())
+		}
+	}
+}
+
+func TestWaitForRollout(t *testing.T) {
+	replicas := int32(1)
+	clientset := fake.NewClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "capsailer-registry", Generation: 1},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status: appsv1.DeploymentStatus{
+			ObservedGeneration: 1,
+			Replicas:           1,
+			UpdatedReplicas:    1,
+			AvailableReplicas:  1,
+		},
+	})
+
+	client := &Client{clientset: clientset}
+	if err := client.WaitForRollout(context.Background(), "capsailer-registry", "registry"); err != nil {
+		t.Fatalf("Failed to wait for rollout: %v", err)
+	}
+
+	exists, err := client.DeploymentExists(context.Background(), "capsailer-registry", "chartmuseum")
+	if err != nil || exists {
+		t.Errorf("Expected chartmuseum not to exist, got %v, %v", exists, err)
+	}
+}
+
+func TestRolloutStatus(t *testing.T) {
+	replicas := int32(2)
+	tests := []struct {
+		status appsv1.DeploymentStatus
+		done   bool
+	}{
+		{appsv1.DeploymentStatus{ObservedGeneration: 0}, false},
+		{appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 1}, false},
+		{appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 3, UpdatedReplicas: 2}, false},
+		{appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 1}, false},
+		{appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2}, true},
+	}
+
+	for i, tt := range tests {
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "registry", Generation: 1},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			Status:     tt.status,
+		}
+		_, done, err := rolloutStatus(deployment)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+		if done != tt.done {
+			t.Errorf("%d: expected done to be %v", i, tt.done)
+		}
+	}
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry"},
+		Status: appsv1.DeploymentStatus{
+			Conditions: []appsv1.DeploymentCondition{
+				{Type: appsv1.DeploymentProgressing, Reason: "ProgressDeadlineExceeded"},
+			},
+		},
+	}
+	if _, _, err := rolloutStatus(deployment); err == nil {
+		t.Error("Expected an error for a deployment past its progress deadline")
+	}
+}
+
+func TestServiceLookups(t *testing.T) {
+	clientset := fake.NewClientset(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "chartmuseum", Namespace: "capsailer-registry"},
+			Spec: corev1.ServiceSpec{
+				ClusterIP: "10.96.0.12",
+				Selector:  map[string]string{"app": "chartmuseum"},
+				Ports:     []corev1.ServicePort{{Port: 8080, TargetPort: intstr.FromString("http")}},
+			},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "chartmuseum-old", Namespace: "capsailer-registry", Labels: map[string]string{"app": "chartmuseum"}},
+			Status:     corev1.PodStatus{Phase: corev1.PodFailed},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "chartmuseum-1", Namespace: "capsailer-registry", Labels: map[string]string{"app": "chartmuseum"}},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "chartmuseum", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 9090}}}},
+			},
+			Status: corev1.PodStatus{Phase: corev1.PodRunning},
+		},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+	)
+	client := &Client{clientset: clientset}
+	ctx := context.Background()
+
+	ip, err := client.ServiceClusterIP(ctx, "capsailer-registry", "chartmuseum")
+	if err != nil || ip != "10.96.0.12" {
+		t.Errorf("Expected cluster IP 10.96.0.12, got %q, %v", ip, err)
+	}
+	if _, err := client.ServiceClusterIP(ctx, "capsailer-registry", "registry"); err == nil {
+		t.Error("Expected an error for a missing service")
+	}
+
+	pod, port, err := client.servicePod(ctx, "capsailer-registry", "chartmuseum", 8080)
+	if err != nil || pod != "chartmuseum-1" || port != 9090 {
+		t.Errorf("Expected port 9090 of chartmuseum-1, got %d of %q, %v", port, pod, err)
+	}
+
+	nodes, err := client.NodeNames(ctx)
+	if err != nil || len(nodes) != 2 {
+		t.Errorf("Expected 2 nodes, got %v, %v", nodes, err)
+	}
+}
+
+func TestPortForwardService(t *testing.T) {
+	clientset := fake.NewClientset(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "capsailer-registry"},
+			Spec: corev1.ServiceSpec{
+				Selector: map[string]string{"app": "registry"},
+				Ports:    []corev1.ServicePort{{Port: 5000}},
+			},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "registry-1", Namespace: "capsailer-registry", Labels: map[string]string{"app": "registry"}},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		},
+	)
+	forward := func(ctx context.Context, dialer *stubDialer) (*PortForward, error) {
+		client := &Client{clientset: clientset, dialPod: func(namespace, pod string) (httpstream.Dialer, error) {
+			if pod != "registry-1" {
+				t.Errorf("Expected to dial registry-1, got %s", pod)
+			}
+			return dialer, nil
+		}}
+		return client.PortForwardService(ctx, "capsailer-registry", "registry", 5000)
+	}
+
+	// The forwarder exits before it is ready when the pod cannot be reached
+	_, err := forward(context.Background(), &stubDialer{err: errors.New("upgrade refused")})
+	if err == nil || !strings.Contains(err.Error(), "upgrade refused") {
+		t.Errorf("Expected the dial error, got: %v", err)
+	}
+	_, err = forward(context.Background(), &stubDialer{protocol: "unknown"})
+	if err == nil || !strings.Contains(err.Error(), "unable to negotiate protocol") {
+		t.Errorf("Expected a protocol error, got: %v", err)
+	}
+
+	// Close returns once forwarding stopped after the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := newStubConnection()
+	p, err := forward(ctx, &stubDialer{protocol: portforward.PortForwardProtocolV1Name, conn: conn})
+	if err != nil {
+		t.Fatalf("Failed to forward port: %v", err)
+	}
+	if p.LocalPort() == 0 || !strings.HasPrefix(p.Address(), "localhost:") {
+		t.Errorf("Expected a local port, got %s", p.Address())
+	}
+	cancel()
+	if err := closeWithin(t, p); err != nil {
+		t.Errorf("Expected a cancelled forward to close cleanly, got: %v", err)
+	}
+	if !conn.isClosed() {
+		t.Error("Expected the connection to the pod to be closed")
+	}
+
+	// A lost connection to the pod is reported by Close
+	conn = newStubConnection()
+	p, err = forward(context.Background(), &stubDialer{protocol: portforward.PortForwardProtocolV1Name, conn: conn})
+	if err != nil {
+		t.Fatalf("Failed to forward port: %v", err)
+	}
+	conn.Close()
+	if err := closeWithin(t, p); !errors.Is(err, portforward.ErrLostConnectionToPod) {
+		t.Errorf("Expected the lost connection to be reported, got: %v", err)
+	}
+}
+
+// closeWithin closes a port-forward, failing the test if it hangs
+func closeWithin(t *testing.T, p *PortForward) error {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() { done <- p.Close() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+		return nil
+	}
+}
+
+// stubDialer hands out a stub connection in place of an upgraded SPDY one
+type stubDialer struct {
+	conn     *stubConnection
+	protocol string
+	err      error
+}
+
+func (d *stubDialer) Dial(protocols ...string) (httpstream.Connection, string, error) {
+	if d.err != nil {
+		return nil, "", d.err
+	}
+	if d.conn == nil {
+		d.conn = newStubConnection()
+	}
+	return d.conn, d.protocol, nil
+}
+
+// stubConnection is a connection to a pod that never carries any streams
+type stubConnection struct {
+	closeOnce sync.Once
+	closed    chan bool
+}
+
+func newStubConnection() *stubConnection {
+	return &stubConnection{closed: make(chan bool)}
+}
+
+func (c *stubConnection) CreateStream(http.Header) (httpstream.Stream, error) {
+	return nil, errors.New("streams are not supported")
+}
+
+func (c *stubConnection) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *stubConnection) CloseChan() <-chan bool {
+	return c.closed
+}
+
+func (c *stubConnection) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *stubConnection) SetIdleTimeout(time.Duration) {}
+
+func (c *stubConnection) RemoveStreams(...httpstream.Stream) {}
@@ -0,0 +1,79 @@
+package kube
+
+import (
+	"bytes"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+// MarshalYAML renders objects as a multi-document YAML manifest, as
+// `kubectl apply -f` takes it
+func MarshalYAML(objects ...runtime.Object) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, object := range objects {
+		obj, err := toUnstructured(object)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s %s: %w", obj.GetKind(), obj.GetName(), err)
+		}
+		buf.WriteString("---\n")
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+// emptyFields are fields that typed objects always carry, even when unset
+var emptyFields = [][]string{
+	{"status"},
+	{"spec", "strategy"},
+	{"spec"},
+}
+
+// toUnstructured converts a typed object to the form applied to the
+// cluster: with its apiVersion and kind, and without the empty fields and
+// creation timestamps that typed objects always carry
+func toUnstructured(object runtime.Object) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert object: %w", err)
+	}
+	obj := &unstructured.Unstructured{Object: content}
+
+	if obj.GetKind() == "" {
+		kinds, _, err := scheme.Scheme.ObjectKinds(object)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the kind of object: %w", err)
+		}
+		obj.SetGroupVersionKind(kinds[0])
+	}
+
+	for _, path := range emptyFields {
+		if value, found, _ := unstructured.NestedMap(obj.Object, path...); found && len(value) == 0 {
+			unstructured.RemoveNestedField(obj.Object, path...)
+		}
+	}
+	removeNullTimestamps(obj.Object)
+	return obj, nil
+}
+
+// removeNullTimestamps removes unset creationTimestamp fields, of the object
+// and of templates in it
+func removeNullTimestamps(content map[string]interface{}) {
+	for key, value := range content {
+		if key == "creationTimestamp" && value == nil {
+			delete(content, key)
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			removeNullTimestamps(nested)
+		}
+	}
+}
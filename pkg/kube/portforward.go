@@ -0,0 +1,175 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// PortForward is a tunnel from a local port to a pod of a Service
+type PortForward struct {
+	localPort int
+	cancel    context.CancelFunc
+	done      chan struct{}
+	err       error
+}
+
+// PortForwardService forwards a free port on localhost to a port of a
+// Service, through one of its running pods, like
+// `kubectl port-forward svc/<name> :<port>`. It returns once the tunnel
+// accepts connections, and forwarding stops when the context is cancelled
+// or the tunnel is closed.
+func (c *Client) PortForwardService(ctx context.Context, namespace, service string, servicePort int) (*PortForward, error) {
+	pod, targetPort, err := c.servicePod(ctx, namespace, service, servicePort)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := c.podDialer(namespace, pod)
+	if err != nil {
+		return nil, err
+	}
+
+	// A local port of 0 lets the system pick a free one
+	ctx, cancel := context.WithCancel(ctx)
+	readyCh := make(chan struct{})
+	ports := []string{fmt.Sprintf("0:%d", targetPort)}
+	forwarder, err := portforward.NewOnAddresses(dialer, []string{"localhost"}, ports, ctx.Done(), readyCh, io.Discard, os.Stderr)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create port-forward: %w", err)
+	}
+
+	p := &PortForward{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		p.err = forwarder.ForwardPorts()
+	}()
+
+	select {
+	case <-readyCh:
+	case <-p.done:
+		cancel()
+		return nil, fmt.Errorf("failed to forward port %d of pod %s: %w", targetPort, pod, p.err)
+	case <-ctx.Done():
+		cancel()
+		return nil, fmt.Errorf("failed to forward port %d of pod %s: %w", targetPort, pod, ctx.Err())
+	}
+
+	forwarded, err := forwarder.GetPorts()
+	if err != nil {
+		_ = p.Close()
+		return nil, fmt.Errorf("failed to get the forwarded port: %w", err)
+	}
+	p.localPort = int(forwarded[0].Local)
+
+	return p, nil
+}
+
+// podDialer opens the upgraded connection to the portforward subresource of a pod
+func (c *Client) podDialer(namespace, pod string) (httpstream.Dialer, error) {
+	if c.dialPod != nil {
+		return c.dialPod(namespace, pod)
+	}
+
+	url := c.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(pod).
+		SubResource("portforward").
+		URL()
+	transport, upgrader, err := spdy.RoundTripperFor(c.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create port-forward transport: %w", err)
+	}
+	return spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, url), nil
+}
+
+// LocalPort returns the port forwarded on localhost
+func (p *PortForward) LocalPort() int {
+	return p.localPort
+}
+
+// Address returns the host and port to connect to, such as localhost:41235
+func (p *PortForward) Address() string {
+	return fmt.Sprintf("localhost:%d", p.localPort)
+}
+
+// Close stops forwarding and returns once the local port is released. It
+// returns the error that ended forwarding early, such as a lost connection
+// to the pod.
+func (p *PortForward) Close() error {
+	p.cancel()
+	<-p.done
+	return p.err
+}
+
+// servicePod picks a running pod behind a Service, and the container port a
+// Service port sends traffic to
+func (c *Client) servicePod(ctx context.Context, namespace, service string, servicePort int) (string, int, error) {
+	svc, err := c.clientset.CoreV1().Services(namespace).Get(ctx, service, metav1.GetOptions{})
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to get %s service: %w", service, err)
+	}
+	if len(svc.Spec.Selector) == 0 {
+		return "", 0, fmt.Errorf("%s service has no pod selector", service)
+	}
+
+	targetPort := intstr.FromInt(servicePort)
+	found := false
+	for _, port := range svc.Spec.Ports {
+		if int(port.Port) == servicePort {
+			// Without a target port, traffic goes to the same port
+			if port.TargetPort.Type == intstr.String || port.TargetPort.IntValue() != 0 {
+				targetPort = port.TargetPort
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		return "", 0, fmt.Errorf("%s service has no port %d", service, servicePort)
+	}
+
+	selector := labels.SelectorFromSet(svc.Spec.Selector).String()
+	pods, err := c.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to list pods of %s service: %w", service, err)
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if targetPort.Type == intstr.Int {
+			return pod.Name, targetPort.IntValue(), nil
+		}
+		if port, ok := namedContainerPort(&pod, targetPort.StrVal); ok {
+			return pod.Name, port, nil
+		}
+	}
+
+	return "", 0, fmt.Errorf("no running pod found for %s service in namespace %s", service, namespace)
+}
+
+// namedContainerPort resolves a named port of a pod's containers
+func namedContainerPort(pod *corev1.Pod, portName string) (int, bool) {
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Name == portName {
+				return int(port.ContainerPort), true
+			}
+		}
+	}
+	return 0, false
+}
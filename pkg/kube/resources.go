@@ -0,0 +1,121 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// rolloutPollInterval is how often WaitForRollout checks a Deployment
+var rolloutPollInterval = 2 * time.Second
+
+// DeploymentExists reports whether a Deployment exists
+func (c *Client) DeploymentExists(ctx context.Context, namespace, name string) (bool, error) {
+	_, err := c.clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get deployment %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// WaitForRollout waits until every replica of a Deployment runs its latest
+// revision, like `kubectl rollout status`. It fails when the Deployment
+// exceeds its progress deadline.
+func (c *Client) WaitForRollout(ctx context.Context, namespace, name string) error {
+	lastStatus := ""
+	return wait.PollUntilContextCancel(ctx, rolloutPollInterval, true, func(ctx context.Context) (bool, error) {
+		deployment, err := c.clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to get deployment %s: %w", name, err)
+		}
+
+		status, done, err := rolloutStatus(deployment)
+		if err != nil {
+			return false, err
+		}
+		if status != lastStatus {
+			fmt.Println(status)
+			lastStatus = status
+		}
+		return done, nil
+	})
+}
+
+// rolloutStatus describes the rollout of a Deployment and whether it is
+// complete, with the same rules as kubectl
+func rolloutStatus(deployment *appsv1.Deployment) (string, bool, error) {
+	name := deployment.Name
+	if deployment.Generation > deployment.Status.ObservedGeneration {
+		return fmt.Sprintf("Waiting for deployment %q spec update to be observed...", name), false, nil
+	}
+
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			return "", false, fmt.Errorf("deployment %q exceeded its progress deadline", name)
+		}
+	}
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	switch {
+	case status.UpdatedReplicas < replicas:
+		return fmt.Sprintf("Waiting for deployment %q rollout to finish: %d out of %d new replicas have been updated...", name, status.UpdatedReplicas, replicas), false, nil
+	case status.Replicas > status.UpdatedReplicas:
+		return fmt.Sprintf("Waiting for deployment %q rollout to finish: %d old replicas are pending termination...", name, status.Replicas-status.UpdatedReplicas), false, nil
+	case status.AvailableReplicas < status.UpdatedReplicas:
+		return fmt.Sprintf("Waiting for deployment %q rollout to finish: %d of %d updated replicas are available...", name, status.AvailableReplicas, status.UpdatedReplicas), false, nil
+	}
+	return fmt.Sprintf("deployment %q successfully rolled out", name), true, nil
+}
+
+// ServiceClusterIP returns the cluster IP of a Service
+func (c *Client) ServiceClusterIP(ctx context.Context, namespace, name string) (string, error) {
+	service, err := c.clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", fmt.Errorf("%s service not found in namespace %s", name, namespace)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s service: %w", name, err)
+	}
+	if service.Spec.ClusterIP == "" || service.Spec.ClusterIP == "None" {
+		return "", fmt.Errorf("%s service in namespace %s has no cluster IP", name, namespace)
+	}
+	return service.Spec.ClusterIP, nil
+}
+
+// NodeNames returns the names of the nodes of the cluster
+func (c *Client) NodeNames(ctx context.Context) ([]string, error) {
+	nodes, err := c.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cluster nodes: %w", err)
+	}
+
+	names := make([]string, 0, len(nodes.Items))
+	for _, node := range nodes.Items {
+		names = append(names, node.Name)
+	}
+	return names, nil
+}
+
+// Secret returns the data of a Secret, and whether it exists
+func (c *Client) Secret(ctx context.Context, namespace, name string) (map[string][]byte, bool, error) {
+	secret, err := c.clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get secret %s: %w", name, err)
+	}
+	return secret.Data, true, nil
+}
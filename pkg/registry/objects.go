@@ -0,0 +1,331 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// component is the registry or ChartMuseum, as deployed in the cluster
+type component struct {
+	name      string
+	image     string
+	port      int32
+	mountPath string
+	env       []corev1.EnvVar
+	tls       *TLSCertificate
+	replicas  int32
+}
+
+// registryComponent returns the Docker registry component. It is the only
+// component that scales, since its replicas can share a storage volume.
+func registryComponent(opts RegistryOptions) component {
+	c := component{
+		name:      "registry",
+		image:     opts.RegistryImage,
+		port:      5000,
+		mountPath: "/var/lib/registry",
+		env: []corev1.EnvVar{
+			{Name: "REGISTRY_STORAGE_DELETE_ENABLED", Value: "true"},
+		},
+		replicas: max(opts.Replicas, 1),
+	}
+	if opts.TLS {
+		c.tls = opts.TLSCertificate
+		c.env = append(c.env,
+			corev1.EnvVar{Name: "REGISTRY_HTTP_TLS_CERTIFICATE", Value: tlsMountPath + "/" + corev1.TLSCertKey},
+			corev1.EnvVar{Name: "REGISTRY_HTTP_TLS_KEY", Value: tlsMountPath + "/" + corev1.TLSPrivateKeyKey},
+		)
+	}
+	return c
+}
+
+// chartMuseumComponent returns the ChartMuseum component. It runs a single
+// replica, since every replica keeps its own chart index.
+func chartMuseumComponent(opts RegistryOptions) component {
+	return component{
+		name:      "chartmuseum",
+		image:     opts.ChartMuseumImage,
+		port:      8080,
+		mountPath: "/storage",
+		env: []corev1.EnvVar{
+			{Name: "DEBUG", Value: "false"},
+			{Name: "STORAGE", Value: "local"},
+			{Name: "STORAGE_LOCAL_ROOTDIR", Value: "/storage"},
+			{Name: "ALLOW_OVERWRITE", Value: "true"},
+			{Name: "DISABLE_API", Value: "false"},
+		},
+		replicas: 1,
+	}
+}
+
+// Objects returns the Kubernetes objects of the registry and ChartMuseum,
+// in the order they are applied
+func Objects(opts RegistryOptions) ([]runtime.Object, error) {
+	// Replicas with their own emptyDir would each hold different images
+	if opts.Replicas > 1 && !opts.PersistentPV {
+		return nil, fmt.Errorf("more than one registry replica needs persistent storage shared between the replicas")
+	}
+
+	objects := []runtime.Object{
+		&corev1.Namespace{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+			ObjectMeta: metav1.ObjectMeta{Name: opts.Namespace, Labels: opts.Labels},
+		},
+	}
+
+	if opts.TLS {
+		if opts.TLSCertificate == nil {
+			return nil, fmt.Errorf("the registry has TLS enabled but no certificate")
+		}
+		for _, secret := range tlsSecrets(opts) {
+			objects = append(objects, secret)
+		}
+	}
+
+	for _, c := range []component{registryComponent(opts), chartMuseumComponent(opts)} {
+		componentObjects, err := c.objects(opts)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, componentObjects...)
+	}
+
+	return objects, nil
+}
+
+// ChartMuseumObjects returns the Kubernetes objects of ChartMuseum alone,
+// for namespaces that only have a registry
+func ChartMuseumObjects(opts RegistryOptions) ([]runtime.Object, error) {
+	return chartMuseumComponent(opts).objects(opts)
+}
+
+// objects returns the storage, Deployment and Service of a component
+func (c component) objects(opts RegistryOptions) ([]runtime.Object, error) {
+	var objects []runtime.Object
+
+	volume := corev1.Volume{Name: c.name + "-data"}
+	if opts.PersistentPV {
+		pvc, err := c.persistentVolumeClaim(opts)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, pvc)
+		volume.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{ClaimName: pvc.Name}
+	} else {
+		volume.EmptyDir = &corev1.EmptyDirVolumeSource{}
+	}
+
+	objects = append(objects, c.deployment(opts, volume), c.service(opts))
+	return objects, nil
+}
+
+// persistentVolumeClaim returns the claim for a component's data. Replicas
+// share the claim, so it must be ReadWriteMany when there are several.
+func (c component) persistentVolumeClaim(opts RegistryOptions) (*corev1.PersistentVolumeClaim, error) {
+	size, err := resource.ParseQuantity(opts.StorageSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage size '%s': %w", opts.StorageSize, err)
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+		ObjectMeta: c.objectMeta(opts),
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{c.accessMode()},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+			},
+		},
+	}
+	pvc.Name = c.name + "-data"
+	if opts.StorageClass != "" {
+		pvc.Spec.StorageClassName = &opts.StorageClass
+	}
+	return pvc, nil
+}
+
+// accessMode returns the access mode of a component's claim
+func (c component) accessMode() corev1.PersistentVolumeAccessMode {
+	if c.replicas > 1 {
+		return corev1.ReadWriteMany
+	}
+	return corev1.ReadWriteOnce
+}
+
+// deployment returns the Deployment of a component
+func (c component) deployment(opts RegistryOptions, volume corev1.Volume) *appsv1.Deployment {
+	replicas := c.replicas
+
+	deployment := &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: c.objectMeta(opts),
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: c.selector()},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: c.labels(opts)},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:  c.name,
+							Image: c.image,
+							Ports: []corev1.ContainerPort{
+								{ContainerPort: c.port},
+							},
+							Env:       c.env,
+							Resources: opts.Resources,
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: volume.Name, MountPath: c.mountPath},
+							},
+						},
+					},
+					Volumes:         []corev1.Volume{volume},
+					NodeSelector:    opts.NodeSelector,
+					Tolerations:     opts.Tolerations,
+					SecurityContext: opts.SecurityContext,
+				},
+			},
+		},
+	}
+
+	// A ReadWriteOnce claim can't be attached to the old and the new pod of a
+	// rolling update on different nodes
+	if volume.PersistentVolumeClaim != nil && c.accessMode() == corev1.ReadWriteOnce {
+		deployment.Spec.Strategy = appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}
+	}
+
+	// The serving certificate is mounted from its Secret, and the pods
+	// restart when it changes
+	if c.tls != nil {
+		template := &deployment.Spec.Template
+		template.Annotations = map[string]string{certificateHashAnnotation: certificateHash(c.tls)}
+		template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+			Name: "tls",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: TLSSecretName},
+			},
+		})
+		container := &template.Spec.Containers[0]
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      "tls",
+			MountPath: tlsMountPath,
+			ReadOnly:  true,
+		})
+	}
+
+	return deployment
+}
+
+// service returns the Service of a component. With several replicas a
+// client stays on one of them, since each registry replica signs the state
+// of uploads in progress with a secret of its own.
+func (c component) service(opts RegistryOptions) *corev1.Service {
+	service := &corev1.Service{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: c.objectMeta(opts),
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeClusterIP,
+			Selector: c.selector(),
+			Ports: []corev1.ServicePort{
+				{Port: c.port, TargetPort: intstr.FromInt32(c.port)},
+			},
+		},
+	}
+	if c.replicas > 1 {
+		service.Spec.SessionAffinity = corev1.ServiceAffinityClientIP
+	}
+	return service
+}
+
+// objectMeta returns the name, namespace and labels of a component's objects
+func (c component) objectMeta(opts RegistryOptions) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      c.name,
+		Namespace: opts.Namespace,
+		Labels:    c.labels(opts),
+	}
+}
+
+// selector returns the labels that select a component's pods
+func (c component) selector() map[string]string {
+	return map[string]string{"app": c.name}
+}
+
+// labels returns the user's labels with the component's selector, which
+// they cannot override
+func (c component) labels(opts RegistryOptions) map[string]string {
+	labels := make(map[string]string, len(opts.Labels)+1)
+	for key, value := range opts.Labels {
+		labels[key] = value
+	}
+	for key, value := range c.selector() {
+		labels[key] = value
+	}
+	return labels
+}
+
+// ParseResources parses resource requests and limits given as names and
+// quantities, such as cpu=100m and memory=256Mi
+func ParseResources(requests, limits map[string]string) (corev1.ResourceRequirements, error) {
+	var resources corev1.ResourceRequirements
+	var err error
+	if resources.Requests, err = parseResourceList(requests); err != nil {
+		return resources, fmt.Errorf("invalid resource requests: %w", err)
+	}
+	if resources.Limits, err = parseResourceList(limits); err != nil {
+		return resources, fmt.Errorf("invalid resource limits: %w", err)
+	}
+	return resources, nil
+}
+
+// parseResourceList parses quantities of resources
+func parseResourceList(quantities map[string]string) (corev1.ResourceList, error) {
+	if len(quantities) == 0 {
+		return nil, nil
+	}
+
+	list := make(corev1.ResourceList, len(quantities))
+	for name, value := range quantities {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s=%s: %w", name, value, err)
+		}
+		list[corev1.ResourceName(name)] = quantity
+	}
+	return list, nil
+}
+
+// ParseToleration parses a toleration written like a taint,
+// key[=value][:effect]. Without a value, any value of the key is tolerated;
+// without an effect, every effect is.
+func ParseToleration(spec string) (corev1.Toleration, error) {
+	toleration := corev1.Toleration{Operator: corev1.TolerationOpExists}
+
+	keyValue, effect, hasEffect := strings.Cut(spec, ":")
+	if hasEffect {
+		switch corev1.TaintEffect(effect) {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+			toleration.Effect = corev1.TaintEffect(effect)
+		default:
+			return toleration, fmt.Errorf("invalid toleration '%s': unknown effect '%s'", spec, effect)
+		}
+	}
+
+	key, value, hasValue := strings.Cut(keyValue, "=")
+	if key == "" {
+		return toleration, fmt.Errorf("invalid toleration '%s': missing key", spec)
+	}
+	toleration.Key = key
+	if hasValue {
+		toleration.Operator = corev1.TolerationOpEqual
+		toleration.Value = value
+	}
+	return toleration, nil
+}
@@ -0,0 +1,128 @@
+package registry
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestObjects(t *testing.T) {
+	opts := DefaultRegistryOptions()
+	opts.StorageClass = "fast"
+	opts.Replicas = 2
+	opts.Labels = map[string]string{"team": "platform", "app": "other"}
+	opts.NodeSelector = map[string]string{"disktype": "ssd"}
+
+	objects, err := Objects(opts)
+	if err != nil {
+		t.Fatalf("Failed to create objects: %v", err)
+	}
+
+	// Namespace, then a claim, Deployment and Service for each component
+	if len(objects) != 7 {
+		t.Fatalf("Expected 7 objects, got %d", len(objects))
+	}
+
+	pvc, ok := objects[1].(*corev1.PersistentVolumeClaim)
+	if !ok {
+		t.Fatalf("Expected a PersistentVolumeClaim, got %T", objects[1])
+	}
+	if pvc.Name != "registry-data" || pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName != "fast" {
+		t.Errorf("Expected registry-data with storage class fast, got %s", pvc.Name)
+	}
+	if size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; size.String() != "10Gi" {
+		t.Errorf("Expected a 10Gi claim, got %s", size.String())
+	}
+	// Registry replicas share their claim
+	if modes := pvc.Spec.AccessModes; len(modes) != 1 || modes[0] != corev1.ReadWriteMany {
+		t.Errorf("Expected a ReadWriteMany claim for several replicas, got %v", modes)
+	}
+
+	deployment, ok := objects[2].(*appsv1.Deployment)
+	if !ok {
+		t.Fatalf("Expected a Deployment, got %T", objects[2])
+	}
+	if *deployment.Spec.Replicas != 2 {
+		t.Errorf("Expected 2 replicas, got %d", *deployment.Spec.Replicas)
+	}
+	podLabels := deployment.Spec.Template.Labels
+	if podLabels["app"] != "registry" || podLabels["team"] != "platform" {
+		t.Errorf("Expected the app label to be kept along with the user's labels, got %v", podLabels)
+	}
+	if deployment.Spec.Template.Spec.NodeSelector["disktype"] != "ssd" {
+		t.Errorf("Expected the node selector to be set, got %v", deployment.Spec.Template.Spec.NodeSelector)
+	}
+	if service := objects[3].(*corev1.Service); service.Spec.SessionAffinity != corev1.ServiceAffinityClientIP {
+		t.Errorf("Expected clients to stay on one registry replica, got %s", service.Spec.SessionAffinity)
+	}
+
+	// ChartMuseum runs once on a ReadWriteOnce claim, so it is recreated
+	pvc = objects[4].(*corev1.PersistentVolumeClaim)
+	if modes := pvc.Spec.AccessModes; len(modes) != 1 || modes[0] != corev1.ReadWriteOnce {
+		t.Errorf("Expected a ReadWriteOnce claim for ChartMuseum, got %v", modes)
+	}
+	deployment = objects[5].(*appsv1.Deployment)
+	if *deployment.Spec.Replicas != 1 || deployment.Spec.Strategy.Type != appsv1.RecreateDeploymentStrategyType {
+		t.Errorf("Expected 1 ChartMuseum replica that is recreated, got %d with strategy %q", *deployment.Spec.Replicas, deployment.Spec.Strategy.Type)
+	}
+
+	opts.Replicas = 1
+	objects, err = Objects(opts)
+	if err != nil {
+		t.Fatalf("Failed to create objects: %v", err)
+	}
+	if deployment := objects[2].(*appsv1.Deployment); deployment.Spec.Strategy.Type != appsv1.RecreateDeploymentStrategyType {
+		t.Errorf("Expected a single registry replica to be recreated, got strategy %q", deployment.Spec.Strategy.Type)
+	}
+
+	// Replicas without shared storage would each hold different images
+	opts.PersistentPV = false
+	opts.Replicas = 2
+	if _, err := Objects(opts); err == nil {
+		t.Error("Expected several replicas without persistent storage to be refused")
+	}
+
+	objects, err = ChartMuseumObjects(opts)
+	if err != nil {
+		t.Fatalf("Failed to create objects: %v", err)
+	}
+	deployment = objects[0].(*appsv1.Deployment)
+	if volume := deployment.Spec.Template.Spec.Volumes[0]; volume.EmptyDir == nil {
+		t.Errorf("Expected an emptyDir volume without persistent storage, got %v", volume)
+	}
+	if deployment.Spec.Strategy.Type != "" {
+		t.Errorf("Expected the default strategy without a claim, got %q", deployment.Spec.Strategy.Type)
+	}
+}
+
+func TestParseToleration(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    corev1.Toleration
+		wantErr bool
+	}{
+		{"dedicated=infra:NoSchedule", corev1.Toleration{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "infra", Effect: corev1.TaintEffectNoSchedule}, false},
+		{"gpu:NoExecute", corev1.Toleration{Key: "gpu", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute}, false},
+		{"gpu", corev1.Toleration{Key: "gpu", Operator: corev1.TolerationOpExists}, false},
+		{"gpu:Sometimes", corev1.Toleration{}, true},
+		{"=infra", corev1.Toleration{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseToleration(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.spec, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package registry
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	"github.com/capsailer/capsailer-cli/pkg/kube"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// TLSSecretName is the Secret with the registry's serving certificate and
+	// the CA bundle that clients need to trust it
+	TLSSecretName = "registry-tls"
+
+	// CASecretName is the Secret with the CA that capsailer generated, kept
+	// to issue new serving certificates signed by the same CA
+	CASecretName = "registry-ca"
+
+	// CABundleKey is the key of the CA bundle in the TLS Secret
+	CABundleKey = "ca.crt"
+
+	// certificateHashAnnotation restarts the registry's pods when its
+	// serving certificate changes
+	certificateHashAnnotation = "capsailer.io/tls-certificate-hash"
+
+	tlsMountPath    = "/certs"
+	caValidity      = 10 * 365 * 24 * time.Hour
+	servingValidity = 2 * 365 * 24 * time.Hour
+	renewBefore     = 30 * 24 * time.Hour
+)
+
+// TLSCertificate is a PEM encoded serving certificate and key, with the CA
+// bundle that clients need to trust it. CAKey is only known for CAs that
+// capsailer generated, whose bundle is the CA certificate.
+type TLSCertificate struct {
+	Cert  []byte
+	Key   []byte
+	CA    []byte
+	CAKey []byte
+}
+
+// LoadTLSCertificate loads a user-provided serving certificate and key, and
+// optionally the CA bundle that signed it
+func LoadTLSCertificate(certFile, keyFile, caFile string) (*TLSCertificate, error) {
+	cert, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS certificate: %w", err)
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS key: %w", err)
+	}
+	if _, err := tls.X509KeyPair(cert, key); err != nil {
+		return nil, fmt.Errorf("invalid TLS certificate and key: %w", err)
+	}
+
+	certificate := &TLSCertificate{Cert: cert, Key: key}
+	if caFile != "" {
+		if certificate.CA, err = os.ReadFile(caFile); err != nil {
+			return nil, fmt.Errorf("failed to read TLS CA bundle: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(certificate.CA) {
+			return nil, fmt.Errorf("no certificates found in TLS CA bundle %s", caFile)
+		}
+	}
+	return certificate, nil
+}
+
+// TLSHosts returns the names the registry is reached by: its Service names,
+// localhost for port-forwards, and any extra hosts
+func TLSHosts(namespace string, extra []string) []string {
+	hosts := []string{
+		"registry",
+		"registry." + namespace,
+		"registry." + namespace + ".svc",
+		"registry." + namespace + ".svc.cluster.local",
+		"localhost",
+		"127.0.0.1",
+		"::1",
+	}
+	return append(hosts, extra...)
+}
+
+// PrepareTLS sets the serving certificate of a TLS registry that has none
+// yet. A valid certificate already in the cluster for all of its hosts is
+// kept; otherwise a new one is issued, by the CA already in the cluster if
+// there is one. Without a client, as for dry runs, a new CA is generated and
+// its key is discarded, so that printed objects never hold a CA key.
+func PrepareTLS(ctx context.Context, client *kube.Client, opts *RegistryOptions) error {
+	if !opts.TLS || opts.TLSCertificate != nil {
+		return nil
+	}
+	hosts := TLSHosts(opts.Namespace, opts.TLSHosts)
+
+	var caCert, caKey []byte
+	if client != nil {
+		data, found, err := client.Secret(ctx, opts.Namespace, TLSSecretName)
+		if err != nil {
+			return err
+		}
+		if found && certificateCovers(data[corev1.TLSCertKey], hosts) {
+			fmt.Printf("Using the TLS certificate in secret %s\n", TLSSecretName)
+			opts.TLSCertificate = &TLSCertificate{
+				Cert: data[corev1.TLSCertKey],
+				Key:  data[corev1.TLSPrivateKeyKey],
+				CA:   data[CABundleKey],
+			}
+			return nil
+		}
+
+		data, found, err = client.Secret(ctx, opts.Namespace, CASecretName)
+		if err != nil {
+			return err
+		}
+		if found {
+			fmt.Printf("Issuing a TLS certificate with the CA in secret %s\n", CASecretName)
+			caCert, caKey = data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey]
+		}
+	}
+
+	if caCert == nil {
+		var err error
+		if caCert, caKey, err = GenerateCA(); err != nil {
+			return err
+		}
+	}
+
+	certificate, err := IssueCertificate(caCert, caKey, hosts)
+	if err != nil {
+		return err
+	}
+	if client == nil {
+		certificate.CAKey = nil
+	}
+	opts.TLSCertificate = certificate
+	return nil
+}
+
+// certificateCovers reports whether a PEM certificate is valid for all the
+// hosts, and for a while yet
+func certificateCovers(certPEM []byte, hosts []string) bool {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || time.Now().Add(renewBefore).After(cert.NotAfter) {
+		return false
+	}
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// GenerateCA generates a self-signed CA, returning its PEM encoded
+// certificate and key
+func GenerateCA() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+
+	template, err := certificateTemplate("capsailer registry CA", caValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+// IssueCertificate issues a serving certificate for hosts, which are DNS
+// names or IP addresses, signed by a PEM encoded CA
+func IssueCertificate(caCert, caKey []byte, hosts []string) (*TLSCertificate, error) {
+	ca, err := tls.X509KeyPair(caCert, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry CA: %w", err)
+	}
+	caX509, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry CA: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate TLS key: %w", err)
+	}
+
+	template, err := certificateTemplate(hosts[0], servingValidity)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caX509, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS certificate: %w", err)
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TLSCertificate{
+		Cert:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:   keyPEM,
+		CA:    caCert,
+		CAKey: caKey,
+	}, nil
+}
+
+// certificateTemplate returns a template valid from now, with a random
+// serial number
+func certificateTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate serial number: %w", err)
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"capsailer"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+// encodeKey PEM encodes a private key
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// tlsSecrets returns the Secrets of a TLS registry
+func tlsSecrets(opts RegistryOptions) []*corev1.Secret {
+	certificate := opts.TLSCertificate
+	labels := registryComponent(opts).labels(opts)
+
+	tlsSecret := &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: TLSSecretName, Namespace: opts.Namespace, Labels: labels},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       certificate.Cert,
+			corev1.TLSPrivateKeyKey: certificate.Key,
+		},
+	}
+	if len(certificate.CA) > 0 {
+		tlsSecret.Data[CABundleKey] = certificate.CA
+	}
+	secrets := []*corev1.Secret{tlsSecret}
+
+	if len(certificate.CAKey) > 0 {
+		secrets = append(secrets, &corev1.Secret{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+			ObjectMeta: metav1.ObjectMeta{Name: CASecretName, Namespace: opts.Namespace, Labels: labels},
+			Type:       corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				corev1.TLSCertKey:       certificate.CA,
+				corev1.TLSPrivateKeyKey: certificate.CAKey,
+			},
+		})
+	}
+	return secrets
+}
+
+// certificateHash identifies a serving certificate
+func certificateHash(certificate *TLSCertificate) string {
+	sum := sha256.Sum256(certificate.Cert)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestIssueCertificate(t *testing.T) {
+	caCert, caKey, err := GenerateCA()
+	if err != nil {
+		t.Fatalf("Failed to generate CA: %v", err)
+	}
+	hosts := TLSHosts("capsailer-registry", []string{"registry.example.com", "10.0.0.5"})
+	certificate, err := IssueCertificate(caCert, caKey, hosts)
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+
+	block, _ := pem.Decode(certificate.Cert)
+	if block == nil {
+		t.Fatal("Expected a PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certificate.CA)
+	for _, host := range hosts {
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("Expected the certificate to verify for %s: %v", host, err)
+		}
+	}
+
+	if !certificateCovers(certificate.Cert, hosts) {
+		t.Error("Expected the certificate to cover its hosts")
+	}
+	if certificateCovers(certificate.Cert, append(hosts, "other.example.com")) {
+		t.Error("Expected the certificate not to cover other hosts")
+	}
+}
+
+func TestObjectsTLS(t *testing.T) {
+	opts := DefaultRegistryOptions()
+	opts.PersistentPV = false
+	opts.TLS = true
+	if _, err := Objects(opts); err == nil {
+		t.Error("Expected an error without a certificate")
+	}
+
+	caCert, caKey, err := GenerateCA()
+	if err != nil {
+		t.Fatalf("Failed to generate CA: %v", err)
+	}
+	if opts.TLSCertificate, err = IssueCertificate(caCert, caKey, TLSHosts(opts.Namespace, nil)); err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	objects, err := Objects(opts)
+	if err != nil {
+		t.Fatalf("Failed to create objects: %v", err)
+	}
+
+	// Namespace, the TLS and CA secrets, then a Deployment and Service for
+	// each component
+	if len(objects) != 7 {
+		t.Fatalf("Expected 7 objects, got %d", len(objects))
+	}
+	secret, ok := objects[1].(*corev1.Secret)
+	if !ok || secret.Name != TLSSecretName {
+		t.Fatalf("Expected the %s secret, got %T", TLSSecretName, objects[1])
+	}
+	if string(secret.Data[CABundleKey]) != string(caCert) {
+		t.Error("Expected the TLS secret to hold the CA bundle")
+	}
+	if secret, ok := objects[2].(*corev1.Secret); !ok || secret.Name != CASecretName {
+		t.Fatalf("Expected the %s secret, got %T", CASecretName, objects[2])
+	}
+
+	deployment, ok := objects[3].(*appsv1.Deployment)
+	if !ok {
+		t.Fatalf("Expected a Deployment, got %T", objects[3])
+	}
+	container := deployment.Spec.Template.Spec.Containers[0]
+	env := map[string]string{}
+	for _, e := range container.Env {
+		env[e.Name] = e.Value
+	}
+	if env["REGISTRY_HTTP_TLS_CERTIFICATE"] != "/certs/tls.crt" || env["REGISTRY_HTTP_TLS_KEY"] != "/certs/tls.key" {
+		t.Errorf("Expected the registry to serve the mounted certificate, got %v", env)
+	}
+	if len(container.VolumeMounts) != 2 || container.VolumeMounts[1].MountPath != "/certs" {
+		t.Errorf("Expected the certificate to be mounted at /certs, got %v", container.VolumeMounts)
+	}
+	if deployment.Spec.Template.Annotations[certificateHashAnnotation] == "" {
+		t.Error("Expected the pod template to carry the certificate hash")
+	}
+}
+
+func TestPrepareTLSWithoutCluster(t *testing.T) {
+	opts := DefaultRegistryOptions()
+	opts.TLS = true
+	if err := PrepareTLS(context.Background(), nil, &opts); err != nil {
+		t.Fatalf("Failed to prepare TLS: %v", err)
+	}
+	if len(opts.TLSCertificate.CA) == 0 || len(opts.TLSCertificate.CAKey) != 0 {
+		t.Fatal("Expected a CA bundle without the CA key")
+	}
+
+	// Dry runs print the objects, which must not hold the CA key
+	objects, err := Objects(opts)
+	if err != nil {
+		t.Fatalf("Failed to create objects: %v", err)
+	}
+	for _, object := range objects {
+		if secret, ok := object.(*corev1.Secret); ok && secret.Name == CASecretName {
+			t.Errorf("Expected no %s secret without the CA key", CASecretName)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Supported key algorithms
+const (
+	AlgorithmEd25519   = "ed25519"
+	AlgorithmECDSAP256 = "ecdsa-p256"
+)
+
+// EnvKeyPassword holds the password of an encrypted cosign private key, the
+// same variable cosign reads
+const EnvKeyPassword = "COSIGN_PASSWORD"
+
+// encryptedKey is the JSON document in the PEM block of an encrypted cosign
+// private key: a PKCS#8 key sealed with NaCl secretbox under an scrypt key
+type encryptedKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// GenerateKeyPair creates a new signing key pair and writes it as PEM files.
+// The private key is PKCS#8 encoded and the public key PKIX encoded, which is
+// the unencrypted format cosign reads with import-key-pair and --key.
+func GenerateKeyPair(algorithm, privateKeyPath, publicKeyPath string) error {
+	var privateKey crypto.Signer
+	var err error
+
+	switch algorithm {
+	case AlgorithmEd25519, "":
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	case AlgorithmECDSAP256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return fmt.Errorf("unsupported key algorithm '%s' (supported: %s, %s)", algorithm, AlgorithmEd25519, AlgorithmECDSAP256)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+	if err != nil {
+		return fmt.Errorf("failed to encode public key: %w", err)
+	}
+
+	if err := os.WriteFile(privateKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600); err != nil {
+		return fmt.Errorf("failed to write private key: %w", err)
+	}
+	if err := os.WriteFile(publicKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644); err != nil {
+		return fmt.Errorf("failed to write public key: %w", err)
+	}
+
+	return nil
+}
+
+// LoadPrivateKey reads an ed25519 or ECDSA private key from a PEM file. Keys
+// encrypted by cosign generate-key-pair are decrypted with the password in
+// $COSIGN_PASSWORD.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		return parsePKCS8(block.Bytes)
+	case "ENCRYPTED SIGSTORE PRIVATE KEY", "ENCRYPTED COSIGN PRIVATE KEY":
+		password, ok := os.LookupEnv(EnvKeyPassword)
+		if !ok {
+			return nil, fmt.Errorf("%s is encrypted, set %s to its password", path, EnvKeyPassword)
+		}
+		der, err := decryptKey(block.Bytes, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", path, err)
+		}
+		return parsePKCS8(der)
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse EC private key: %w", err)
+		}
+		return key, nil
+	default:
+		if strings.HasPrefix(block.Type, "ENCRYPTED") {
+			return nil, fmt.Errorf("encrypted private keys (%s) are not supported, provide an unencrypted PKCS#8 key or a cosign key", block.Type)
+		}
+		return nil, fmt.Errorf("unsupported PEM block type '%s' in %s", block.Type, path)
+	}
+}
+
+// parsePKCS8 parses a DER encoded PKCS#8 ed25519 or ECDSA private key
+func parsePKCS8(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T, use ed25519 or ECDSA", key)
+	}
+}
+
+// decryptKey opens the PEM contents of an encrypted cosign private key
+func decryptKey(data, password []byte) ([]byte, error) {
+	var encrypted encryptedKey
+	if err := json.Unmarshal(data, &encrypted); err != nil {
+		return nil, fmt.Errorf("failed to parse encrypted key: %w", err)
+	}
+	if encrypted.KDF.Name != "scrypt" || encrypted.Cipher.Name != "nacl/secretbox" {
+		return nil, fmt.Errorf("unsupported key encryption %s with %s", encrypted.KDF.Name, encrypted.Cipher.Name)
+	}
+	if len(encrypted.Cipher.Nonce) != 24 {
+		return nil, fmt.Errorf("invalid nonce length %d", len(encrypted.Cipher.Nonce))
+	}
+
+	params := encrypted.KDF.Params
+	derived, err := scrypt.Key(password, encrypted.KDF.Salt, params.N, params.R, params.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], derived)
+	copy(nonce[:], encrypted.Cipher.Nonce)
+
+	der, ok := secretbox.Open(nil, encrypted.Ciphertext, &nonce, &key)
+	if !ok {
+		return nil, fmt.Errorf("wrong password")
+	}
+	return der, nil
+}
+
+// LoadPublicKey reads an ed25519 or ECDSA public key from a PEM file
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("unsupported PEM block type '%s' in %s, expected PUBLIC KEY", block.Type, path)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T, use ed25519 or ECDSA", key)
+	}
+}
+
+// Sign signs data and returns a base64 encoded detached signature.
+// ed25519 keys sign the data directly; ECDSA keys sign its SHA-256 digest
+// with an ASN.1 encoded signature, matching cosign sign-blob.
+func Sign(signer crypto.Signer, data []byte) ([]byte, error) {
+	var signature []byte
+	var err error
+
+	switch key := signer.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, data)
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		signature, err = ecdsa.SignASN1(rand.Reader, key, digest[:])
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", signer)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign data: %w", err)
+	}
+
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(signature)))
+	base64.StdEncoding.Encode(encoded, signature)
+	return encoded, nil
+}
+
+// Verify checks a base64 encoded detached signature over data
+func Verify(publicKey crypto.PublicKey, data, encodedSignature []byte) error {
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encodedSignature)))
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %w", err)
+	}
+
+	switch key := publicKey.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, data, signature) {
+			return fmt.Errorf("signature does not match public key")
+		}
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return fmt.Errorf("signature does not match public key")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+
+	return nil
+}
+
+// SignFile signs the contents of a file and writes the signature to sigPath
+func SignFile(privateKeyPath, path, sigPath string) error {
+	signer, err := LoadPrivateKey(privateKeyPath)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file to sign: %w", err)
+	}
+
+	signature, err := Sign(signer, data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(sigPath, signature, 0644); err != nil {
+		return fmt.Errorf("failed to write signature: %w", err)
+	}
+
+	return nil
+}
+
+// readPEM reads the first PEM block from a file
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	return block, nil
+}
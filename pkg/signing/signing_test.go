@@ -0,0 +1,125 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmEd25519, AlgorithmECDSAP256} {
+		t.Run(algorithm, func(t *testing.T) {
+			dir := t.TempDir()
+			privateKeyPath := filepath.Join(dir, "capsailer.key")
+			publicKeyPath := filepath.Join(dir, "capsailer.pub")
+
+			if err := GenerateKeyPair(algorithm, privateKeyPath, publicKeyPath); err != nil {
+				t.Fatalf("Failed to generate key pair: %v", err)
+			}
+
+			dataPath := filepath.Join(dir, "index.json")
+			if err := os.WriteFile(dataPath, []byte(`{"version":1}`), 0644); err != nil {
+				t.Fatalf("Failed to write data: %v", err)
+			}
+
+			sigPath := dataPath + ".sig"
+			if err := SignFile(privateKeyPath, dataPath, sigPath); err != nil {
+				t.Fatalf("Failed to sign file: %v", err)
+			}
+
+			publicKey, err := LoadPublicKey(publicKeyPath)
+			if err != nil {
+				t.Fatalf("Failed to load public key: %v", err)
+			}
+			signature, err := os.ReadFile(sigPath)
+			if err != nil {
+				t.Fatalf("Failed to read signature: %v", err)
+			}
+
+			if err := Verify(publicKey, []byte(`{"version":1}`), signature); err != nil {
+				t.Errorf("Expected signature to verify, but got: %v", err)
+			}
+			if err := Verify(publicKey, []byte(`{"version":2}`), signature); err == nil {
+				t.Error("Expected error for tampered data, but got nil")
+			}
+		})
+	}
+}
+
+func TestLoadEncryptedPrivateKey(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	// Seal the key the way cosign generate-key-pair does, with a cheap scrypt cost
+	var encrypted encryptedKey
+	encrypted.KDF.Name = "scrypt"
+	encrypted.KDF.Params.N, encrypted.KDF.Params.R, encrypted.KDF.Params.P = 1024, 8, 1
+	encrypted.KDF.Salt = make([]byte, 32)
+	encrypted.Cipher.Name = "nacl/secretbox"
+	encrypted.Cipher.Nonce = make([]byte, 24)
+	rand.Read(encrypted.KDF.Salt)
+	rand.Read(encrypted.Cipher.Nonce)
+	derived, err := scrypt.Key([]byte("secret"), encrypted.KDF.Salt, 1024, 8, 1, 32)
+	if err != nil {
+		t.Fatalf("Failed to derive key: %v", err)
+	}
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], derived)
+	copy(nonce[:], encrypted.Cipher.Nonce)
+	encrypted.Ciphertext = secretbox.Seal(nil, der, &nonce, &key)
+
+	data, err := json.Marshal(encrypted)
+	if err != nil {
+		t.Fatalf("Failed to marshal encrypted key: %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "cosign.key")
+	block := &pem.Block{Type: "ENCRYPTED SIGSTORE PRIVATE KEY", Bytes: data}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	t.Run("right password", func(t *testing.T) {
+		t.Setenv(EnvKeyPassword, "secret")
+		signer, err := LoadPrivateKey(keyPath)
+		if err != nil {
+			t.Fatalf("Failed to load encrypted key: %v", err)
+		}
+		signature, err := Sign(signer, []byte("data"))
+		if err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		if err := Verify(publicKey, []byte("data"), signature); err != nil {
+			t.Errorf("Expected signature to verify, but got: %v", err)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		t.Setenv(EnvKeyPassword, "wrong")
+		if _, err := LoadPrivateKey(keyPath); err == nil {
+			t.Error("Expected error for wrong password, but got nil")
+		}
+	})
+
+	t.Run("no password", func(t *testing.T) {
+		t.Setenv(EnvKeyPassword, "")
+		os.Unsetenv(EnvKeyPassword)
+		if _, err := LoadPrivateKey(keyPath); err == nil {
+			t.Error("Expected error without a password, but got nil")
+		}
+	})
+}
@@ -7,10 +7,12 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 )
 
-// CreateTarGz creates a tar.gz archive from a source directory
-func CreateTarGz(sourceDir, outputPath string, tracker *ProgressTracker) error {
+// CreateTarGz creates a tar.gz archive from a source directory. Every entry gets
+// modTime and no owner, so the same files always produce the same archive.
+func CreateTarGz(sourceDir, outputPath string, modTime time.Time, tracker *ProgressTracker) error {
 	// Calculate total size first
 	var totalSize int64
 	err := filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
@@ -34,27 +36,19 @@ func CreateTarGz(sourceDir, outputPath string, tracker *ProgressTracker) error {
 	if err != nil {
 		return fmt.Errorf("failed to create output file: %w", err)
 	}
+	closed := false
 	defer func() {
+		if closed {
+			return
+		}
 		if err := file.Close(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error closing file: %v\n", err)
 		}
 	}()
 
-	// Create gzip writer
+	// Create gzip and tar writers
 	gw := gzip.NewWriter(file)
-	defer func() {
-		if err := gw.Close(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error closing gzip writer: %v\n", err)
-		}
-	}()
-
-	// Create tar writer
 	tw := tar.NewWriter(gw)
-	defer func() {
-		if err := tw.Close(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error closing tar writer: %v\n", err)
-		}
-	}()
 
 	// Walk through the source directory
 	err = filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
@@ -75,6 +69,13 @@ func CreateTarGz(sourceDir, outputPath string, tracker *ProgressTracker) error {
 		}
 		header.Name = relPath
 
+		// Drop host specific metadata
+		header.ModTime = modTime
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "", ""
+
 		// Write header
 		if err := tw.WriteHeader(header); err != nil {
 			return fmt.Errorf("failed to write tar header: %w", err)
@@ -107,6 +108,22 @@ func CreateTarGz(sourceDir, outputPath string, tracker *ProgressTracker) error {
 		return fmt.Errorf("failed to create archive: %w", err)
 	}
 
+	// Flush the writers in order and make sure the data reached the disk, so
+	// that a full disk fails instead of leaving a truncated archive
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish tar archive: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("failed to finish gzip stream: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	closed = true
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close output file: %w", err)
+	}
+
 	// Mark progress as complete
 	tracker.Finish("Creating bundle")
 
@@ -0,0 +1,39 @@
+//go:build linux
+
+package utils
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCreateTarGzReportsWriteErrors(t *testing.T) {
+	sourceDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sourceDir, "manifest.yaml"), []byte("images: []\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	// Limit file sizes like a nearly full disk. Only the gzip header fits, the
+	// compressed data is written when the writers are closed.
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatalf("Failed to get file size limit: %v", err)
+	}
+	signal.Ignore(syscall.SIGXFSZ)
+	defer signal.Reset(syscall.SIGXFSZ)
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &syscall.Rlimit{Cur: 32, Max: limit.Max}); err != nil {
+		t.Skipf("Cannot limit file sizes: %v", err)
+	}
+	err := CreateTarGz(sourceDir, filepath.Join(t.TempDir(), "bundle.tar.gz"), time.Unix(0, 0), NewProgressTracker())
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatalf("Failed to restore file size limit: %v", err)
+	}
+
+	if err == nil {
+		t.Error("Expected an error when the archive cannot be written completely")
+	}
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BundleIndexFile is the name of the index file at the root of a bundle
+const BundleIndexFile = "index.json"
+
+// BundleSignatureFile is the name of the detached signature over the bundle index
+const BundleSignatureFile = "index.json.sig"
+
+// BundleIndexVersion is the current version of the bundle index format.
+// Version 1 stored each image as a docker tarball; version 2 stores all
+// images in one OCI image layout; version 3 adds delta bundles.
+const BundleIndexVersion = 3
+
+// BundleIndex describes every artifact stored in a bundle
+type BundleIndex struct {
+	Version   int          `json:"version"`
+	CreatedAt time.Time    `json:"createdAt"`
+	Images    []ImageEntry `json:"images"`
+	Charts    []ChartEntry `json:"charts"`
+	Files     []FileEntry  `json:"files,omitempty"` // Checksums of every other file in the bundle
+	Delta     *DeltaInfo   `json:"delta,omitempty"` // Set when the bundle only holds changes against a base bundle
+}
+
+// ImageEntry records where an image in the bundle came from
+type ImageEntry struct {
+	Reference string   `json:"reference"`           // Original reference from the manifest
+	Digest    string   `json:"digest"`              // Resolved manifest digest
+	File      string   `json:"file"`                // OCI layout directory (or docker tarball in version 1), relative to the bundle root
+	Size      int64    `json:"size"`                // Size of the manifest, config and layers in bytes
+	Platforms []string `json:"platforms,omitempty"` // Platforms of a multi-architecture image
+}
+
+// ChartEntry records where a chart in the bundle came from
+type ChartEntry struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`              // Exact version of the bundled package
+	Constraint string `json:"constraint,omitempty"` // Version constraint the version was resolved from
+	Repo       string `json:"repo"`
+	Digest     string `json:"digest"`               // SHA-256 digest of the chart package
+	File       string `json:"file"`                 // Path relative to the bundle root
+	Size       int64  `json:"size"`                 // Size of the chart package in bytes
+	ValuesFile string `json:"valuesFile,omitempty"` // Bundled values file, relative to the bundle root
+	InBase     bool   `json:"inBase,omitempty"`     // Package left out of a delta bundle because the base has it
+}
+
+// FileEntry records the checksum of a single file in the bundle
+type FileEntry struct {
+	Path   string `json:"path"`   // Path relative to the bundle root, using forward slashes
+	Digest string `json:"digest"` // SHA-256 digest of the file contents
+	Size   int64  `json:"size"`   // Size of the file in bytes
+}
+
+// NewBundleIndex creates a new empty bundle index
+func NewBundleIndex() *BundleIndex {
+	return &BundleIndex{
+		Version:   BundleIndexVersion,
+		CreatedAt: time.Now().UTC(),
+		Images:    []ImageEntry{},
+		Charts:    []ChartEntry{},
+	}
+}
+
+// LoadBundleIndex reads the index file from the root of an unpacked bundle
+func LoadBundleIndex(bundleDir string) (*BundleIndex, error) {
+	data, err := os.ReadFile(filepath.Join(bundleDir, BundleIndexFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle index: %w", err)
+	}
+
+	index := &BundleIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("failed to parse bundle index: %w", err)
+	}
+
+	if index.Version > BundleIndexVersion {
+		return nil, fmt.Errorf("bundle index version %d is newer than supported version %d", index.Version, BundleIndexVersion)
+	}
+
+	return index, nil
+}
+
+// HasBundleIndex reports whether an unpacked bundle contains an index file.
+// Bundles built by older versions of Capsailer do not.
+func HasBundleIndex(bundleDir string) bool {
+	_, err := os.Stat(filepath.Join(bundleDir, BundleIndexFile))
+	return err == nil
+}
+
+// SaveBundleIndex writes the index file to the root of a bundle directory
+func SaveBundleIndex(index *BundleIndex, bundleDir string) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle index: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(bundleDir, BundleIndexFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write bundle index: %w", err)
+	}
+
+	return nil
+}
+
+// RecordFiles computes a checksum for every file below bundleDir except the
+// index itself and replaces the file list of the index with the result
+func (idx *BundleIndex) RecordFiles(bundleDir string) error {
+	var files []FileEntry
+	err := filepath.Walk(bundleDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(bundleDir, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		relPath = filepath.ToSlash(relPath)
+		if isBundleMetadataFile(relPath) {
+			return nil
+		}
+
+		digest, err := FileDigest(path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, FileEntry{Path: relPath, Digest: digest, Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record file checksums: %w", err)
+	}
+
+	idx.Files = files
+	return nil
+}
+
+// FindChart returns the index entry for a chart. An empty version matches any version.
+func (idx *BundleIndex) FindChart(name, version string) (*ChartEntry, bool) {
+	for i := range idx.Charts {
+		if idx.Charts[i].Name == name && (version == "" || idx.Charts[i].Version == version) {
+			return &idx.Charts[i], true
+		}
+	}
+	return nil, false
+}
+
+// IsDelta reports whether the bundle is a delta against a base bundle
+func (idx *BundleIndex) IsDelta() bool {
+	return idx.Delta != nil
+}
+
+// UsesImageLayout reports whether images are stored in an OCI image layout
+// rather than as one docker tarball per image
+func (idx *BundleIndex) UsesImageLayout() bool {
+	return idx.Version >= 2
+}
+
+// FindImage returns the index entry for an image reference
+func (idx *BundleIndex) FindImage(reference string) (*ImageEntry, bool) {
+	for i := range idx.Images {
+		if idx.Images[i].Reference == reference {
+			return &idx.Images[i], true
+		}
+	}
+	return nil, false
+}
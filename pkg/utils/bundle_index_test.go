@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBundleIndexSaveAndLoad(t *testing.T) {
+	bundleDir := t.TempDir()
+	index := NewBundleIndex()
+	index.Images = []ImageEntry{
+		{Reference: "localhost:5000/org/image:tag", Digest: "sha256:aaaa", File: "images", Size: 1024},
+		{Reference: "nginx@sha256:bbbb", Digest: "sha256:bbbb", File: "images", Platforms: []string{"linux/amd64", "linux/arm64"}},
+	}
+	index.Charts = []ChartEntry{
+		{Name: "app", Version: "1.2.0", Constraint: "~1.2", Repo: "oci://localhost:5000/charts", File: "charts/app-1.2.0.tgz", ValuesFile: "values/app-values.yaml"},
+		{Name: "db", Version: "16.2.0", Repo: "https://charts.example.com", InBase: true},
+	}
+	index.Files = []FileEntry{{Path: "manifest.yaml", Digest: "sha256:cccc", Size: 12}}
+	index.Delta = &DeltaInfo{BaseDigest: "sha256:dddd"}
+
+	if err := SaveBundleIndex(index, bundleDir); err != nil {
+		t.Fatalf("Failed to save bundle index: %v", err)
+	}
+	if !HasBundleIndex(bundleDir) {
+		t.Fatal("Expected the saved index to be found")
+	}
+	loaded, err := LoadBundleIndex(bundleDir)
+	if err != nil {
+		t.Fatalf("Failed to load bundle index: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, index) {
+		t.Errorf("Expected %+v, got %+v", index, loaded)
+	}
+	if !loaded.IsDelta() || !loaded.UsesImageLayout() {
+		t.Errorf("Expected a delta bundle with an image layout, got delta %v, layout %v", loaded.IsDelta(), loaded.UsesImageLayout())
+	}
+
+	// Indexes from a newer Capsailer may store things this version cannot read
+	index.Version = BundleIndexVersion + 1
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("Failed to marshal index: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(bundleDir, BundleIndexFile), data, 0644); err != nil {
+		t.Fatalf("Failed to write index: %v", err)
+	}
+	if _, err := LoadBundleIndex(bundleDir); err == nil || !strings.Contains(err.Error(), "newer than supported") {
+		t.Errorf("Expected a newer index to be refused, got: %v", err)
+	}
+}
+
+func TestBundleIndexFind(t *testing.T) {
+	index := NewBundleIndex()
+	index.Version = 1
+	index.Images = []ImageEntry{
+		{Reference: "nginx:1.25", File: "images/nginx_1.25.tar"},
+		{Reference: "localhost:5000/org/image:tag", File: "images/localhost_5000_org_image_tag.tar"},
+	}
+	index.Charts = []ChartEntry{
+		{Name: "app", Version: "1.0.0", File: "charts/app-1.0.0.tgz"},
+		{Name: "app", Version: "2.0.0", File: "charts/app-2.0.0.tgz"},
+	}
+
+	chartTests := []struct {
+		name, version string
+		wantFile      string
+	}{
+		{name: "app", version: "2.0.0", wantFile: "charts/app-2.0.0.tgz"},
+		{name: "app", version: "", wantFile: "charts/app-1.0.0.tgz"},
+		{name: "app", version: "3.0.0"},
+		{name: "db", version: ""},
+	}
+	for _, tt := range chartTests {
+		entry, ok := index.FindChart(tt.name, tt.version)
+		if ok != (tt.wantFile != "") {
+			t.Errorf("FindChart(%q, %q): expected found %v, got %v", tt.name, tt.version, tt.wantFile != "", ok)
+			continue
+		}
+		if ok && entry.File != tt.wantFile {
+			t.Errorf("FindChart(%q, %q): expected %s, got %s", tt.name, tt.version, tt.wantFile, entry.File)
+		}
+	}
+
+	// The reference maps to its file exactly, even with a registry port
+	if entry, ok := index.FindImage("localhost:5000/org/image:tag"); !ok || entry.File != "images/localhost_5000_org_image_tag.tar" {
+		t.Errorf("Expected the image with a registry port to map to its tarball, got %+v, %v", entry, ok)
+	}
+	if _, ok := index.FindImage("localhost/5000/org/image:tag"); ok {
+		t.Error("Expected a different reference with the same file name not to match")
+	}
+	if index.UsesImageLayout() {
+		t.Error("Expected a version 1 index to use docker tarballs")
+	}
+}
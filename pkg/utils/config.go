@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// EnvConfigFile is the environment variable that sets the config file path
+const EnvConfigFile = "CAPSAILER_CONFIG"
+
+// Config is the optional capsailer configuration file, for settings that
+// belong to the build machine rather than to a manifest
+type Config struct {
+	AuthFile   string           `yaml:"authFile,omitempty"`   // Docker config.json style registry credentials
+	Registries []RegistryConfig `yaml:"registries,omitempty"` // Mirror and rewrite rules for image pulls
+}
+
+// RegistryConfig redirects image pulls for a registry or repository prefix,
+// such as docker.io or quay.io/prometheus. Mirrors are tried in order before
+// the upstream registry; a rewrite replaces the prefix and the upstream is
+// never contacted. Images keep their original reference in the bundle.
+type RegistryConfig struct {
+	Prefix  string   `yaml:"prefix"`
+	Mirrors []string `yaml:"mirrors,omitempty"`
+	Rewrite string   `yaml:"rewrite,omitempty"`
+}
+
+// DefaultConfigPath returns the config file from CAPSAILER_CONFIG, or
+// capsailer/config.yaml in the user's config directory
+func DefaultConfigPath() string {
+	if path := os.Getenv(EnvConfigFile); path != "" {
+		return path
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "capsailer", "config.yaml")
+}
+
+// LoadConfig loads a config file. An empty path loads the default config
+// file, which may be missing.
+func LoadConfig(path string) (*Config, error) {
+	optional := path == ""
+	if optional {
+		path = DefaultConfigPath()
+	}
+
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if optional && os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if err := validateRegistries(cfg.Registries); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// validateRegistries checks mirror and rewrite rules
+func validateRegistries(registries []RegistryConfig) error {
+	seen := make(map[string]bool)
+	for i, reg := range registries {
+		prefix := strings.TrimSuffix(strings.TrimSpace(reg.Prefix), "/")
+		if prefix == "" {
+			return fmt.Errorf("registry rule at index %d has no prefix", i)
+		}
+		if seen[prefix] {
+			return fmt.Errorf("registry prefix '%s' is configured twice", prefix)
+		}
+		seen[prefix] = true
+
+		if (len(reg.Mirrors) > 0) == (reg.Rewrite != "") {
+			return fmt.Errorf("registry '%s' must set either mirrors or rewrite", prefix)
+		}
+		for _, mirror := range reg.Mirrors {
+			if strings.TrimSpace(mirror) == "" {
+				return fmt.Errorf("registry '%s' has an empty mirror", prefix)
+			}
+		}
+	}
+
+	return nil
+}
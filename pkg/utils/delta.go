@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// imageBlobsPrefix is where the OCI layout keeps blobs inside a bundle
+const imageBlobsPrefix = "images/blobs/"
+
+// maxManifestSize bounds the image blobs read as possible manifests, the
+// same limit registries apply to manifests
+const maxManifestSize = 4 << 20
+
+// DeltaInfo marks a bundle as a delta against a base bundle
+type DeltaInfo struct {
+	BaseDigest    string    `json:"baseDigest"`    // SHA-256 digest of the base bundle archive
+	BaseCreatedAt time.Time `json:"baseCreatedAt"` // Creation time from the base bundle index
+	OmittedBlobs  []string  `json:"omittedBlobs"`  // Layer blobs left out because the base provides them
+}
+
+// BaseBundle describes what a previous bundle already provides
+type BaseBundle struct {
+	Digest string                     // SHA-256 digest of the base archive
+	Index  *BundleIndex               // Index of the base bundle
+	Layers map[string]map[string]bool // Layer blobs ("sha256:<hex>") each base image reference uses
+}
+
+// LoadBaseBundle reads the index and image manifests of a bundle archive
+// without extracting it. Registries only share layers within a repository, so
+// the layers are recorded per image. Layers the base itself omitted as a delta
+// are still referenced by its manifests, so deltas can be chained.
+func LoadBaseBundle(archivePath string) (*BaseBundle, error) {
+	file, err := OpenBundle(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open base bundle: %w", err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing file: %v\n", err)
+		}
+	}()
+
+	archiveHasher := sha256.New()
+	archiveReader := io.TeeReader(file, archiveHasher)
+	gzr, err := gzip.NewReader(archiveReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer func() {
+		if err := gzr.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing gzip reader: %v\n", err)
+		}
+	}()
+
+	base := &BaseBundle{Layers: make(map[string]map[string]bool)}
+	var indexData []byte
+	manifests := make(map[string][]byte)
+
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("base bundle is unreadable or corrupted: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		relPath := path.Clean(filepath.ToSlash(header.Name))
+		if relPath == BundleIndexFile {
+			if indexData, err = io.ReadAll(tr); err != nil {
+				return nil, fmt.Errorf("failed to read base bundle index: %w", err)
+			}
+			continue
+		}
+
+		// Keep the small JSON blobs, compressed layers are not needed
+		if blob := strings.TrimPrefix(relPath, imageBlobsPrefix); blob != relPath && header.Size <= maxManifestSize {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read base bundle blob %s: %w", blob, err)
+			}
+			if len(data) > 0 && data[0] == '{' {
+				manifests[strings.Replace(blob, "/", ":", 1)] = data
+			}
+		}
+	}
+
+	// Drain any trailing data so the digest covers the whole file
+	if _, err := io.Copy(io.Discard, archiveReader); err != nil {
+		return nil, fmt.Errorf("failed to read base bundle: %w", err)
+	}
+	base.Digest = "sha256:" + hex.EncodeToString(archiveHasher.Sum(nil))
+
+	if indexData == nil {
+		return nil, fmt.Errorf("base bundle has no %s, rebuild it with this version of capsailer", BundleIndexFile)
+	}
+	base.Index = &BundleIndex{}
+	if err := json.Unmarshal(indexData, base.Index); err != nil {
+		return nil, fmt.Errorf("failed to parse base bundle index: %w", err)
+	}
+	if !base.Index.UsesImageLayout() {
+		return nil, fmt.Errorf("base bundle uses index version %d without an OCI image layout, rebuild it with this version of capsailer", base.Index.Version)
+	}
+
+	for _, entry := range base.Index.Images {
+		layers := base.Layers[entry.Reference]
+		if layers == nil {
+			layers = make(map[string]bool)
+			base.Layers[entry.Reference] = layers
+		}
+		if err := collectLayers(manifests, entry.Digest, layers); err != nil {
+			return nil, fmt.Errorf("failed to read base bundle image %s: %w", entry.Reference, err)
+		}
+	}
+
+	return base, nil
+}
+
+// collectLayers adds the layers of an image manifest, or of every image an
+// image index references, to layers
+func collectLayers(manifests map[string][]byte, digest string, layers map[string]bool) error {
+	data, ok := manifests[digest]
+	if !ok {
+		return fmt.Errorf("manifest %s is not in the bundle", digest)
+	}
+
+	var manifest struct {
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+		Layers []struct {
+			Digest string `json:"digest"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("failed to parse manifest %s: %w", digest, err)
+	}
+
+	for _, layer := range manifest.Layers {
+		layers[layer.Digest] = true
+	}
+	for _, child := range manifest.Manifests {
+		if err := collectLayers(manifests, child.Digest, layers); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HasChart reports whether the base bundle, or a bundle it is a delta of,
+// contains an identical chart package
+func (b *BaseBundle) HasChart(name, version, digest string) bool {
+	entry, ok := b.Index.FindChart(name, version)
+	return ok && entry.Digest == digest
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// LockfileVersion is the current version of the lockfile format
+const LockfileVersion = 1
+
+// Lockfile pins every image and chart of a manifest to the digest that was
+// resolved when the lockfile was written
+type Lockfile struct {
+	Version     int           `yaml:"version"`
+	GeneratedAt time.Time     `yaml:"generatedAt"`
+	Images      []LockedImage `yaml:"images"`
+	Charts      []LockedChart `yaml:"charts"`
+}
+
+// LockedImage records the digest a registry served for an image reference
+type LockedImage struct {
+	Reference string `yaml:"reference"` // Reference as written in the manifest
+	Digest    string `yaml:"digest"`    // Manifest or image index digest served by the registry
+}
+
+// LockedChart records the digest of a downloaded chart package
+type LockedChart struct {
+	Name       string `yaml:"name"`
+	Version    string `yaml:"version"`              // Exact version, resolved from the constraint if any
+	Constraint string `yaml:"constraint,omitempty"` // Version constraint as written in the manifest
+	Repo       string `yaml:"repo"`
+	Digest     string `yaml:"digest"` // SHA-256 digest of the chart package as downloaded
+
+	Dependencies []LockedChart `yaml:"dependencies,omitempty"` // Subcharts vendored into the package
+}
+
+// NewLockfile creates a new empty lockfile
+func NewLockfile() *Lockfile {
+	return &Lockfile{
+		Version:     LockfileVersion,
+		GeneratedAt: time.Now().UTC().Truncate(time.Second),
+		Images:      []LockedImage{},
+		Charts:      []LockedChart{},
+	}
+}
+
+// LockfilePath returns the lockfile path for a manifest, for example
+// manifest.lock.yaml next to manifest.yaml
+func LockfilePath(manifestPath string) string {
+	ext := filepath.Ext(manifestPath)
+	return strings.TrimSuffix(manifestPath, ext) + ".lock" + ext
+}
+
+// LoadLockfile reads a lockfile
+func LoadLockfile(path string) (*Lockfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lockfile: %w", err)
+	}
+
+	lock := &Lockfile{}
+	if err := yaml.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lockfile: %w", err)
+	}
+
+	if lock.Version > LockfileVersion {
+		return nil, fmt.Errorf("lockfile version %d is newer than supported version %d", lock.Version, LockfileVersion)
+	}
+
+	return lock, nil
+}
+
+// SaveLockfile writes a lockfile
+func SaveLockfile(lock *Lockfile, path string) error {
+	data, err := yaml.Marshal(lock)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lockfile: %w", err)
+	}
+
+	data = append([]byte("# Generated by capsailer build. Do not edit.\n"), data...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write lockfile: %w", err)
+	}
+
+	return nil
+}
+
+// FindImage returns the locked digest for an image reference
+func (l *Lockfile) FindImage(reference string) (*LockedImage, bool) {
+	for i := range l.Images {
+		if l.Images[i].Reference == reference {
+			return &l.Images[i], true
+		}
+	}
+	return nil, false
+}
+
+// FindChart returns the locked digest for a chart, by the version or
+// constraint written in the manifest, or by the resolved version
+func (l *Lockfile) FindChart(name, version, repo string) (*LockedChart, bool) {
+	for i := range l.Charts {
+		chart := &l.Charts[i]
+		if chart.Name == name && chart.Repo == repo && (chart.Version == version || chart.Constraint == version) {
+			return chart, true
+		}
+	}
+	return nil, false
+}
+
+// CheckManifest reports manifest entries that have no lockfile entry, which
+// happens when the manifest was edited after the lockfile was written
+func (l *Lockfile) CheckManifest(manifest *Manifest) error {
+	var missing []string
+	for _, image := range manifest.Images {
+		if _, ok := l.FindImage(image.Name); !ok {
+			missing = append(missing, "image "+image.Name)
+		}
+	}
+	for _, chart := range manifest.Charts {
+		if _, ok := l.FindChart(chart.Name, chart.Version, chart.Repo); !ok {
+			missing = append(missing, fmt.Sprintf("chart %s-%s", chart.Name, chart.Version))
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("lockfile is out of date, no entry for: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLockfilePath(t *testing.T) {
+	tests := map[string]string{
+		"manifest.yaml":          "manifest.lock.yaml",
+		"deploy/apps.yml":        "deploy/apps.lock.yml",
+		"manifest":               "manifest.lock",
+		"/abs/path/prod.v2.yaml": "/abs/path/prod.v2.lock.yaml",
+	}
+	for manifest, expected := range tests {
+		if got := LockfilePath(manifest); got != expected {
+			t.Errorf("LockfilePath(%q) = %q, expected %q", manifest, got, expected)
+		}
+	}
+}
+
+func TestLockfileFindChart(t *testing.T) {
+	lock := NewLockfile()
+	lock.Charts = []LockedChart{
+		{Name: "nginx", Version: "15.1.4", Constraint: "~15.1", Repo: "https://charts.example.com", Digest: "sha256:aaa"},
+		{Name: "redis", Version: "18.0.0", Repo: "https://charts.example.com", Digest: "sha256:bbb"},
+	}
+
+	tests := []struct {
+		name, version, repo string
+		wantDigest          string
+	}{
+		// By the constraint in the manifest, or by the version it resolved to
+		{"nginx", "~15.1", "https://charts.example.com", "sha256:aaa"},
+		{"nginx", "15.1.4", "https://charts.example.com", "sha256:aaa"},
+		{"redis", "18.0.0", "https://charts.example.com", "sha256:bbb"},
+		// A changed constraint, version or repository is not locked
+		{"nginx", "^15.1", "https://charts.example.com", ""},
+		{"nginx", "15.1.5", "https://charts.example.com", ""},
+		{"redis", "18.0.0", "https://mirror.example.com", ""},
+		{"postgresql", "12.0.0", "https://charts.example.com", ""},
+	}
+
+	for _, tt := range tests {
+		locked, ok := lock.FindChart(tt.name, tt.version, tt.repo)
+		if tt.wantDigest == "" {
+			if ok {
+				t.Errorf("%s %s from %s: expected no entry, got %s", tt.name, tt.version, tt.repo, locked.Digest)
+			}
+			continue
+		}
+		if !ok || locked.Digest != tt.wantDigest {
+			t.Errorf("%s %s from %s: expected %s, got %v", tt.name, tt.version, tt.repo, tt.wantDigest, locked)
+		}
+	}
+}
+
+func TestLockfileCheckManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.lock.yaml")
+	lock := NewLockfile()
+	lock.Images = []LockedImage{{Reference: "nginx:1.25", Digest: "sha256:ccc"}}
+	lock.Charts = []LockedChart{{Name: "nginx", Version: "15.1.4", Constraint: "~15.1", Repo: "https://charts.example.com", Digest: "sha256:aaa"}}
+	if err := SaveLockfile(lock, path); err != nil {
+		t.Fatalf("Failed to save lockfile: %v", err)
+	}
+	lock, err := LoadLockfile(path)
+	if err != nil {
+		t.Fatalf("Failed to load lockfile: %v", err)
+	}
+
+	manifest := &Manifest{
+		Images: []Image{{Name: "nginx:1.25"}},
+		Charts: []Chart{{Name: "nginx", Version: "~15.1", Repo: "https://charts.example.com"}},
+	}
+	if err := lock.CheckManifest(manifest); err != nil {
+		t.Errorf("Expected the manifest to match the lockfile: %v", err)
+	}
+
+	// Entries added to the manifest after the lockfile was written are named
+	manifest.Images = append(manifest.Images, Image{Name: "redis:7"})
+	manifest.Charts = append(manifest.Charts, Chart{Name: "redis", Version: "18.0.0", Repo: "https://charts.example.com"})
+	err = lock.CheckManifest(manifest)
+	if err == nil {
+		t.Fatal("Expected an out of date lockfile")
+	}
+	for _, entry := range []string{"image redis:7", "chart redis-18.0.0"} {
+		if !strings.Contains(err.Error(), entry) {
+			t.Errorf("Expected %q in the error, got: %v", entry, err)
+		}
+	}
+	if strings.Contains(err.Error(), "nginx") {
+		t.Errorf("Expected locked entries not to be reported, got: %v", err)
+	}
+}
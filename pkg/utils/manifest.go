@@ -1,23 +1,185 @@
 package utils
 
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
 // Manifest represents the YAML configuration for Capsailer
 type Manifest struct {
-	Images []string `yaml:"images"`
-	Charts []Chart  `yaml:"charts"`
+	Platforms  []string         `yaml:"platforms,omitempty"`  // Default platforms for every image
+	Registries []RegistryConfig `yaml:"registries,omitempty"` // Mirror and rewrite rules for image pulls
+	Images     []Image          `yaml:"images"`
+	Charts     []Chart          `yaml:"charts"`
+
+	// Where images are stored in the private registry
+	ImageRewrite *ImageRewrite `yaml:"imageRewrite,omitempty"`
+}
+
+// Image rewrite layouts for images that no rule matches
+const (
+	LayoutPreserve = "preserve" // Keep the repository path, dropping the source registry
+	LayoutFlatten  = "flatten"  // Keep only the last path component
+)
+
+// ImageRewrite configures the repositories images are pushed to in the
+// private registry. Chart values are rewritten with the same rules, so they
+// point at the pushed images.
+type ImageRewrite struct {
+	Layout string             `yaml:"layout,omitempty"` // preserve (default) or flatten
+	Rules  []ImageRewriteRule `yaml:"rules,omitempty"`  // Tried in order; the first match applies
+}
+
+// ImageRewriteRule maps source repositories to a repository path in the
+// private registry. A prefix rule replaces the prefix with the target. A
+// regex rule matches the whole source repository, such as
+// docker.io/bitnami/nginx, and the target may use its groups as $1.
+type ImageRewriteRule struct {
+	Prefix string `yaml:"prefix,omitempty"`
+	Regex  string `yaml:"regex,omitempty"`
+	Target string `yaml:"target"`
+}
+
+// Image represents a container image in the manifest. It is written either as
+// a plain reference or as a mapping with a name and platforms.
+type Image struct {
+	Name      string   `yaml:"name"`
+	Platforms []string `yaml:"platforms,omitempty"` // Overrides the manifest platforms
 }
 
 // Chart represents a Helm chart and its configuration
 type Chart struct {
 	Name       string `yaml:"name"`
 	Repo       string `yaml:"repo"`
-	Version    string `yaml:"version"`
+	Version    string `yaml:"version"` // Exact version or constraint, such as ^1.2.0
 	ValuesFile string `yaml:"valuesFile,omitempty"`
+
+	// Credentials and TLS settings for private chart repositories
+	Auth                  *ChartAuth `yaml:"auth,omitempty"`
+	CAFile                string     `yaml:"caFile,omitempty"`
+	CertFile              string     `yaml:"certFile,omitempty"`
+	KeyFile               string     `yaml:"keyFile,omitempty"`
+	InsecureSkipTLSVerify bool       `yaml:"insecureSkipTLSVerify,omitempty"`
+}
+
+// ChartAuth holds the credentials for a chart repository: a username and
+// password for basic auth, or a bearer token. Secrets are read from
+// environment variables or files so that they never end up in the manifest,
+// or in bundles that include a copy of it.
+type ChartAuth struct {
+	Username     string `yaml:"username,omitempty"`
+	UsernameEnv  string `yaml:"usernameEnv,omitempty"`
+	PasswordEnv  string `yaml:"passwordEnv,omitempty"`
+	PasswordFile string `yaml:"passwordFile,omitempty"`
+	TokenEnv     string `yaml:"tokenEnv,omitempty"`
+	TokenFile    string `yaml:"tokenFile,omitempty"`
+
+	// Inline secrets are only decoded so that validation can reject them
+	Password string `yaml:"password,omitempty"`
+	Token    string `yaml:"token,omitempty"`
+}
+
+// ChartCredentials are the resolved secrets of a ChartAuth
+type ChartCredentials struct {
+	Username string
+	Password string
+	Token    string
 }
 
 // NewManifest creates a new empty manifest
 func NewManifest() *Manifest {
 	return &Manifest{
-		Images: []string{},
+		Images: []Image{},
 		Charts: []Chart{},
 	}
 }
+
+// ImageNames returns the references of all images in the manifest
+func (m *Manifest) ImageNames() []string {
+	names := make([]string, 0, len(m.Images))
+	for _, image := range m.Images {
+		names = append(names, image.Name)
+	}
+	return names
+}
+
+// ImagePlatforms returns the platforms to bundle for an image: its own list,
+// or the manifest default. An empty result means the registry default platform.
+func (m *Manifest) ImagePlatforms(image Image) []string {
+	if len(image.Platforms) > 0 {
+		return image.Platforms
+	}
+	return m.Platforms
+}
+
+// Credentials reads the username, password and token from their environment
+// variables and files
+func (a *ChartAuth) Credentials() (*ChartCredentials, error) {
+	creds := &ChartCredentials{Username: a.Username}
+
+	var err error
+	if a.UsernameEnv != "" {
+		if creds.Username, err = readSecret("username", a.UsernameEnv, ""); err != nil {
+			return nil, err
+		}
+	}
+	if a.PasswordEnv != "" || a.PasswordFile != "" {
+		if creds.Password, err = readSecret("password", a.PasswordEnv, a.PasswordFile); err != nil {
+			return nil, err
+		}
+	}
+	if a.TokenEnv != "" || a.TokenFile != "" {
+		if creds.Token, err = readSecret("token", a.TokenEnv, a.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return creds, nil
+}
+
+// readSecret reads a secret from an environment variable or a file. Trailing
+// newlines in files are dropped.
+func readSecret(kind, env, file string) (string, error) {
+	if env != "" {
+		value, ok := os.LookupEnv(env)
+		if !ok || value == "" {
+			return "", fmt.Errorf("environment variable %s for the chart repository %s is not set", env, kind)
+		}
+		return value, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read chart repository %s: %w", kind, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// UnmarshalYAML accepts both a plain image reference and a mapping
+func (i *Image) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		i.Name = node.Value
+		i.Platforms = nil
+		return nil
+	}
+
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: image must be a reference or a mapping with a name", node.Line)
+	}
+
+	type plain Image
+	return node.Decode((*plain)(i))
+}
+
+// MarshalYAML writes images without platforms as plain references
+func (i Image) MarshalYAML() (interface{}, error) {
+	if len(i.Platforms) == 0 {
+		return i.Name, nil
+	}
+
+	type plain Image
+	return plain(i), nil
+}
@@ -4,8 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 
+	"github.com/Masterminds/semver/v3"
 	yaml "gopkg.in/yaml.v3"
 )
 
@@ -28,17 +31,61 @@ func LoadManifest(filePath string) (*Manifest, error) {
 	return manifest, nil
 }
 
+// LoadBundleManifest loads the manifest stored in an unpacked bundle. Values
+// files are resolved to the copies the builder placed in the charts directory.
+func LoadBundleManifest(bundleDir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(bundleDir, "manifest.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle manifest: %w", err)
+	}
+
+	manifest := &Manifest{}
+	if err := yaml.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse bundle manifest YAML: %w", err)
+	}
+
+	for i := range manifest.Charts {
+		if manifest.Charts[i].ValuesFile != "" {
+			manifest.Charts[i].ValuesFile = filepath.Join(bundleDir, "charts", filepath.Base(manifest.Charts[i].ValuesFile))
+		}
+	}
+
+	if err := validateManifest(manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
 // validateManifest ensures the manifest contains valid entries
 func validateManifest(manifest *Manifest) error {
 	if len(manifest.Images) == 0 && len(manifest.Charts) == 0 {
 		return errors.New("manifest must contain at least one image or chart")
 	}
 
+	// Validate platforms
+	if err := validatePlatforms(manifest.Platforms); err != nil {
+		return fmt.Errorf("manifest platforms: %w", err)
+	}
+
+	// Validate registry mirrors and rewrites
+	if err := validateRegistries(manifest.Registries); err != nil {
+		return fmt.Errorf("manifest registries: %w", err)
+	}
+
+	// Validate image rewrite rules
+	if err := validateImageRewrite(manifest.ImageRewrite); err != nil {
+		return fmt.Errorf("manifest imageRewrite: %w", err)
+	}
+
 	// Validate images
 	for i, image := range manifest.Images {
-		if strings.TrimSpace(image) == "" {
+		if strings.TrimSpace(image.Name) == "" {
 			return fmt.Errorf("image at index %d is empty", i)
 		}
+		if err := validatePlatforms(image.Platforms); err != nil {
+			return fmt.Errorf("image '%s': %w", image.Name, err)
+		}
 		// TODO: More advanced image validation could be added here
 	}
 
@@ -53,11 +100,130 @@ func validateManifest(manifest *Manifest) error {
 		if strings.TrimSpace(chart.Version) == "" {
 			return fmt.Errorf("chart at index %d has no version", i)
 		}
+		if _, err := semver.NewConstraint(chart.Version); err != nil {
+			return fmt.Errorf("chart '%s' has an invalid version or constraint '%s': %w", chart.Name, chart.Version, err)
+		}
 		if chart.ValuesFile != "" {
 			if _, err := os.Stat(chart.ValuesFile); os.IsNotExist(err) {
 				return fmt.Errorf("values file '%s' for chart '%s' does not exist", chart.ValuesFile, chart.Name)
 			}
 		}
+		if err := validateChartAccess(chart); err != nil {
+			return fmt.Errorf("chart '%s': %w", chart.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateImageRewrite checks the layout and rules for image rewriting
+func validateImageRewrite(rewrite *ImageRewrite) error {
+	if rewrite == nil {
+		return nil
+	}
+
+	switch rewrite.Layout {
+	case "", LayoutPreserve, LayoutFlatten:
+	default:
+		return fmt.Errorf("unknown layout '%s', expected %s or %s", rewrite.Layout, LayoutPreserve, LayoutFlatten)
+	}
+
+	for i, rule := range rewrite.Rules {
+		if (rule.Prefix == "") == (rule.Regex == "") {
+			return fmt.Errorf("rule at index %d must set either prefix or regex", i)
+		}
+		if strings.TrimSpace(rule.Target) == "" {
+			return fmt.Errorf("rule at index %d has no target", i)
+		}
+		if rule.Regex != "" {
+			if _, err := regexp.Compile(rule.Regex); err != nil {
+				return fmt.Errorf("rule at index %d has an invalid regex: %w", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// LoadBundleImageRewrite returns the image rewrite rules of the manifest in
+// an unpacked bundle, or nil when it has none or the bundle has no manifest
+func LoadBundleImageRewrite(bundleDir string) (*ImageRewrite, error) {
+	data, err := os.ReadFile(filepath.Join(bundleDir, "manifest.yaml"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle manifest: %w", err)
+	}
+
+	manifest := &Manifest{}
+	if err := yaml.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse bundle manifest YAML: %w", err)
+	}
+	if err := validateImageRewrite(manifest.ImageRewrite); err != nil {
+		return nil, fmt.Errorf("bundle manifest imageRewrite: %w", err)
+	}
+
+	return manifest.ImageRewrite, nil
+}
+
+// validateChartAccess checks the credentials and TLS settings of a chart.
+// Secrets are only read at build time, so the referenced environment
+// variables and files do not need to exist yet.
+func validateChartAccess(chart Chart) error {
+	if (chart.CertFile == "") != (chart.KeyFile == "") {
+		return errors.New("certFile and keyFile must be set together")
+	}
+
+	auth := chart.Auth
+	if auth == nil {
+		return nil
+	}
+
+	if auth.Password != "" || auth.Token != "" {
+		return errors.New("inline secrets are not allowed in auth, use passwordEnv, passwordFile, tokenEnv or tokenFile")
+	}
+	if auth.Username != "" && auth.UsernameEnv != "" {
+		return errors.New("set only one of auth username and usernameEnv")
+	}
+	if auth.PasswordEnv != "" && auth.PasswordFile != "" {
+		return errors.New("set only one of auth passwordEnv and passwordFile")
+	}
+	if auth.TokenEnv != "" && auth.TokenFile != "" {
+		return errors.New("set only one of auth tokenEnv and tokenFile")
+	}
+
+	hasUser := auth.Username != "" || auth.UsernameEnv != ""
+	hasPassword := auth.PasswordEnv != "" || auth.PasswordFile != ""
+	hasToken := auth.TokenEnv != "" || auth.TokenFile != ""
+	switch {
+	case hasToken && (hasUser || hasPassword):
+		return errors.New("auth takes either a username and password or a token, not both")
+	case hasUser != hasPassword:
+		return errors.New("auth needs both a username and a password")
+	case !hasToken && !hasUser:
+		return errors.New("auth needs a username and password or a token")
+	case hasToken && strings.HasPrefix(chart.Repo, "oci://"):
+		return errors.New("oci:// repositories take a username and password, pass a token as the password")
+	}
+
+	return nil
+}
+
+// validatePlatforms checks that each platform is "all" or has the form os/arch[/variant]
+func validatePlatforms(platforms []string) error {
+	for _, platform := range platforms {
+		if platform == "all" {
+			if len(platforms) > 1 {
+				return errors.New("'all' cannot be combined with other platforms")
+			}
+			continue
+		}
+
+		parts := strings.Split(platform, "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid platform '%s', expected os/arch[/variant]", platform)
+		}
 	}
 
 	return nil
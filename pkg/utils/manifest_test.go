@@ -3,6 +3,7 @@ package utils
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -16,7 +17,7 @@ func TestValidateManifest(t *testing.T) {
 
 	// Test with a valid manifest
 	validManifest := &Manifest{
-		Images: []string{"nginx:latest"},
+		Images: []Image{{Name: "nginx:latest"}},
 		Charts: []Chart{
 			{
 				Name:    "test-chart",
@@ -29,6 +30,18 @@ func TestValidateManifest(t *testing.T) {
 	if err != nil {
 		t.Errorf("Expected no error for valid manifest, but got: %v", err)
 	}
+
+	// Test with version constraints
+	for version, valid := range map[string]bool{"~15.1": true, "^17.0.0": true, ">=1.2 <2": true, "latest": false} {
+		validManifest.Charts[0].Version = version
+		err = validateManifest(validManifest)
+		if valid && err != nil {
+			t.Errorf("Expected no error for version %q, but got: %v", version, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("Expected error for version %q, but got nil", version)
+		}
+	}
 }
 
 func TestLoadManifest(t *testing.T) {
@@ -72,10 +85,113 @@ charts:
 	if len(manifest.Charts) != 1 {
 		t.Errorf("Expected 1 chart, got %d", len(manifest.Charts))
 	}
-	if manifest.Images[0] != "nginx:latest" {
-		t.Errorf("Expected first image to be nginx:latest, got %s", manifest.Images[0])
+	if manifest.Images[0].Name != "nginx:latest" {
+		t.Errorf("Expected first image to be nginx:latest, got %s", manifest.Images[0].Name)
 	}
 	if manifest.Charts[0].Name != "test-chart" {
 		t.Errorf("Expected chart name to be test-chart, got %s", manifest.Charts[0].Name)
 	}
 }
+
+func TestLoadManifestPlatforms(t *testing.T) {
+	manifestContent := `
+platforms:
+  - linux/amd64
+  - linux/arm64
+images:
+  - nginx:latest
+  - name: alpine:3.19
+    platforms:
+      - all
+`
+	tempFile, err := os.CreateTemp("", "test-manifest-*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer func() {
+		if err := os.Remove(tempFile.Name()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing temp file: %v\n", err)
+		}
+	}()
+
+	if _, err := tempFile.Write([]byte(manifestContent)); err != nil {
+		t.Fatalf("Failed to write to temp file: %v", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		t.Fatalf("Failed to close temp file: %v", err)
+	}
+
+	manifest, err := LoadManifest(tempFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load manifest: %v", err)
+	}
+
+	if got := manifest.ImagePlatforms(manifest.Images[0]); len(got) != 2 || got[1] != "linux/arm64" {
+		t.Errorf("Expected nginx to use the manifest platforms, got %v", got)
+	}
+	if got := manifest.ImagePlatforms(manifest.Images[1]); len(got) != 1 || got[0] != "all" {
+		t.Errorf("Expected alpine to use its own platforms, got %v", got)
+	}
+
+	// Invalid platforms are rejected
+	invalid := &Manifest{Images: []Image{{Name: "nginx:latest", Platforms: []string{"amd64"}}}}
+	if err := validateManifest(invalid); err == nil {
+		t.Error("Expected error for invalid platform, but got nil")
+	}
+}
+
+func TestValidateChartAccess(t *testing.T) {
+	tests := map[string]struct {
+		chart   Chart
+		wantErr bool
+	}{
+		"no auth":          {chart: Chart{}},
+		"basic auth":       {chart: Chart{Auth: &ChartAuth{Username: "ci", PasswordEnv: "CHART_PASSWORD"}}},
+		"token file":       {chart: Chart{Auth: &ChartAuth{TokenFile: "token.txt"}}},
+		"client cert":      {chart: Chart{CertFile: "client.pem", KeyFile: "client.key"}},
+		"inline password":  {chart: Chart{Auth: &ChartAuth{Username: "ci", Password: "secret"}}, wantErr: true},
+		"missing password": {chart: Chart{Auth: &ChartAuth{Username: "ci"}}, wantErr: true},
+		"password and env": {chart: Chart{Auth: &ChartAuth{Username: "ci", PasswordEnv: "A", PasswordFile: "b"}}, wantErr: true},
+		"token and user":   {chart: Chart{Auth: &ChartAuth{Username: "ci", PasswordEnv: "A", TokenEnv: "B"}}, wantErr: true},
+		"cert without key": {chart: Chart{CertFile: "client.pem"}, wantErr: true},
+		"oci token":        {chart: Chart{Repo: "oci://registry.example.com/charts", Auth: &ChartAuth{TokenEnv: "B"}}, wantErr: true},
+	}
+
+	for name, tt := range tests {
+		err := validateChartAccess(tt.chart)
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: expected error, but got nil", name)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: expected no error, but got: %v", name, err)
+		}
+	}
+}
+
+func TestChartAuthCredentials(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+	t.Setenv("CAPSAILER_TEST_PASSWORD", "env-password")
+
+	creds, err := (&ChartAuth{Username: "ci", PasswordEnv: "CAPSAILER_TEST_PASSWORD"}).Credentials()
+	if err != nil {
+		t.Fatalf("Failed to resolve credentials: %v", err)
+	}
+	if creds.Username != "ci" || creds.Password != "env-password" {
+		t.Errorf("Unexpected credentials: %+v", creds)
+	}
+
+	creds, err = (&ChartAuth{TokenFile: tokenFile}).Credentials()
+	if err != nil {
+		t.Fatalf("Failed to resolve credentials: %v", err)
+	}
+	if creds.Token != "file-token" {
+		t.Errorf("Expected token 'file-token', got %q", creds.Token)
+	}
+
+	if _, err := (&ChartAuth{Username: "ci", PasswordEnv: "CAPSAILER_TEST_UNSET"}).Credentials(); err == nil {
+		t.Error("Expected error for an unset environment variable, but got nil")
+	}
+}
@@ -3,16 +3,20 @@ package utils
 import (
 	"archive/tar"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // UnpackOptions defines options for unpacking
 type UnpackOptions struct {
-	BundlePath string
-	OutputDir  string
+	BundlePath    string
+	OutputDir     string
+	Verify        bool   // Refuse to extract a bundle that fails checksum verification
+	PublicKeyPath string // Trusted public key the bundle signature must match
 }
 
 // Unpacker handles extracting capsailer bundles
@@ -39,20 +43,34 @@ func (u *Unpacker) Unpack() error {
 		return fmt.Errorf("bundle path is required")
 	}
 
-	// Check if bundle exists
-	if _, err := os.Stat(u.Options.BundlePath); os.IsNotExist(err) {
+	// Check if bundle exists, either as one file or as split volumes
+	if !BundleExists(u.Options.BundlePath) {
 		return fmt.Errorf("bundle file '%s' does not exist", u.Options.BundlePath)
 	}
 
+	// Files of an earlier bundle left in the directory would mix with this one
+	if entries, err := os.ReadDir(u.Options.OutputDir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("output directory '%s' is not empty, remove it or choose another directory", u.Options.OutputDir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read output directory: %w", err)
+	}
+
+	// Check the bundle before writing anything
+	if u.Options.Verify {
+		if err := u.verify(); err != nil {
+			return err
+		}
+	}
+
 	// Create output directory if it doesn't exist
 	if err := os.MkdirAll(u.Options.OutputDir, 0755); err != nil {
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	// Open the tar.gz file
-	file, err := os.Open(u.Options.BundlePath)
+	// Open the tar.gz file, reassembling split volumes
+	file, err := OpenBundle(u.Options.BundlePath)
 	if err != nil {
-		return fmt.Errorf("failed to open bundle: %w", err)
+		return err
 	}
 	defer func() {
 		if err := file.Close(); err != nil {
@@ -71,6 +89,12 @@ func (u *Unpacker) Unpack() error {
 		}
 	}()
 
+	// Entries must stay inside the output directory, even through links
+	root, err := filepath.EvalSymlinks(u.Options.OutputDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve output directory: %w", err)
+	}
+
 	// Create a tar reader
 	tr := tar.NewReader(gzr)
 
@@ -85,7 +109,10 @@ func (u *Unpacker) Unpack() error {
 		}
 
 		// Get the target path
-		target := filepath.Join(u.Options.OutputDir, header.Name)
+		target, err := extractPath(root, header.Name)
+		if err != nil {
+			return err
+		}
 
 		// Handle based on file type
 		switch header.Typeflag {
@@ -101,8 +128,11 @@ func (u *Unpacker) Unpack() error {
 				return fmt.Errorf("failed to create directory for file '%s': %w", target, err)
 			}
 
-			// Create file
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+			// Create file, replacing an earlier entry of the same name
+			if err := removeLink(target); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
 			if err != nil {
 				return fmt.Errorf("failed to create file '%s': %w", target, err)
 			}
@@ -120,7 +150,17 @@ func (u *Unpacker) Unpack() error {
 
 		case tar.TypeSymlink:
 			// Create symlink
-			if err := os.Symlink(header.Linkname, target); err != nil {
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create directory for link '%s': %w", target, err)
+			}
+			linkname, err := linkTarget(root, target, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := removeLink(target); err != nil {
+				return err
+			}
+			if err := os.Symlink(linkname, target); err != nil {
 				return fmt.Errorf("failed to create symlink '%s': %w", target, err)
 			}
 
@@ -133,3 +173,93 @@ func (u *Unpacker) Unpack() error {
 	fmt.Printf("Bundle extracted to '%s'\n", u.Options.OutputDir)
 	return nil
 }
+
+// extractPath returns where an archive entry is extracted below root, the
+// resolved output directory. Entries whose name, or a link among their
+// parent directories, leads outside of root are refused.
+func extractPath(root, name string) (string, error) {
+	target := filepath.Join(root, name)
+	if !isWithin(root, target) {
+		return "", fmt.Errorf("refusing to extract '%s': it is outside the output directory", name)
+	}
+	if target == root {
+		return target, nil
+	}
+
+	// Parent directories created so far may be links, resolve them
+	parent := filepath.Dir(target)
+	for {
+		resolved, err := filepath.EvalSymlinks(parent)
+		if err == nil {
+			if !isWithin(root, resolved) {
+				return "", fmt.Errorf("refusing to extract '%s': it is outside the output directory", name)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to resolve '%s': %w", parent, err)
+		}
+		parent = filepath.Dir(parent)
+	}
+	return target, nil
+}
+
+// linkTarget returns the cleaned target of a link extracted to target, whose
+// directory exists. Absolute targets, and targets outside of root, are
+// refused.
+func linkTarget(root, target, linkname string) (string, error) {
+	linkname = filepath.Clean(linkname)
+
+	parent, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve '%s': %w", filepath.Dir(target), err)
+	}
+	if filepath.IsAbs(linkname) || !isWithin(root, filepath.Join(parent, linkname)) {
+		return "", fmt.Errorf("refusing to extract link '%s' to '%s': it is outside the output directory", target, linkname)
+	}
+	return linkname, nil
+}
+
+// removeLink removes a link at path, so that an entry replaces it instead of
+// writing through it
+func removeLink(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to replace link '%s': %w", path, err)
+	}
+	return nil
+}
+
+// isWithin reports whether path is root or below it
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// verify checks the bundle checksums and signature. Older bundles without
+// checksums are allowed unless a signature is required.
+func (u *Unpacker) verify() error {
+	fmt.Println("Verifying bundle checksums...")
+	result, err := VerifyBundle(u.Options.BundlePath, VerifyOptions{PublicKeyPath: u.Options.PublicKeyPath})
+	if errors.Is(err, ErrBundleNotVerifiable) && u.Options.PublicKeyPath == "" {
+		fmt.Printf("Warning: %v, skipping verification\n", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !result.OK() {
+		result.Print(os.Stdout)
+		return result.Err()
+	}
+
+	fmt.Printf("Bundle verified: %d files match their checksums\n", result.FilesChecked)
+	if result.SignatureValid {
+		fmt.Println("Bundle signature is valid")
+	}
+	return nil
+}
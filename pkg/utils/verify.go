@@ -0,0 +1,385 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/capsailer/capsailer-cli/pkg/signing"
+)
+
+// ChecksumSuffix is appended to a bundle path to name its archive checksum file
+const ChecksumSuffix = ".sha256"
+
+// ErrBundleNotVerifiable is returned for bundles that carry no checksums
+// because they were built by an older version of Capsailer
+var ErrBundleNotVerifiable = errors.New("bundle has no checksums, it was built by an older version of Capsailer")
+
+// isBundleMetadataFile reports whether a bundle path holds metadata that is
+// not itself covered by the file checksums in the index
+func isBundleMetadataFile(relPath string) bool {
+	return relPath == BundleIndexFile || relPath == BundleSignatureFile
+}
+
+// VerifyOptions defines options for verifying a bundle
+type VerifyOptions struct {
+	PublicKeyPath string // Trusted public key; when set the bundle must carry a valid signature
+}
+
+// VerifyResult describes the outcome of verifying a bundle
+type VerifyResult struct {
+	ArchiveDigest   string   // SHA-256 of the archive, empty for directories
+	ArchiveChecked  bool     // Whether a recorded archive checksum was compared
+	ArchiveMismatch bool     // Whether the archive checksum did not match
+	FilesChecked    int      // Number of files compared against the index
+	Missing         []string // Files listed in the index but absent from the bundle
+	Extra           []string // Files present in the bundle but not listed in the index
+	Corrupted       []string // Files whose contents do not match the index
+	Signed          bool     // Whether the bundle carries a signature over its index
+	SignatureValid  bool     // Whether the signature was checked and matched the trusted key
+	SignatureError  string   // Why the signature check failed, empty if it passed or was not requested
+}
+
+// OK reports whether the bundle passed verification
+func (r *VerifyResult) OK() bool {
+	return !r.ArchiveMismatch && r.SignatureError == "" && len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Corrupted) == 0
+}
+
+// Err returns an error summarizing a failed verification, or nil
+func (r *VerifyResult) Err() error {
+	if r.OK() {
+		return nil
+	}
+
+	var problems []string
+	if r.ArchiveMismatch {
+		problems = append(problems, "archive checksum mismatch")
+	}
+	if r.SignatureError != "" {
+		problems = append(problems, "signature check failed")
+	}
+	if len(r.Missing) > 0 {
+		problems = append(problems, fmt.Sprintf("%d missing", len(r.Missing)))
+	}
+	if len(r.Extra) > 0 {
+		problems = append(problems, fmt.Sprintf("%d extra", len(r.Extra)))
+	}
+	if len(r.Corrupted) > 0 {
+		problems = append(problems, fmt.Sprintf("%d corrupted", len(r.Corrupted)))
+	}
+
+	return fmt.Errorf("bundle verification failed: %s", strings.Join(problems, ", "))
+}
+
+// Print writes a human readable report of the verification
+func (r *VerifyResult) Print(w io.Writer) {
+	if r.ArchiveDigest != "" {
+		switch {
+		case r.ArchiveMismatch:
+			fmt.Fprintf(w, "CORRUPTED archive (sha256:%s does not match %s)\n", r.ArchiveDigest, ChecksumSuffix)
+		case r.ArchiveChecked:
+			fmt.Fprintf(w, "OK        archive sha256:%s\n", r.ArchiveDigest)
+		default:
+			fmt.Fprintf(w, "Archive sha256:%s (no %s file found to compare against)\n", r.ArchiveDigest, ChecksumSuffix)
+		}
+	}
+	switch {
+	case r.SignatureError != "":
+		fmt.Fprintf(w, "INVALID   signature: %s\n", r.SignatureError)
+	case r.SignatureValid:
+		fmt.Fprintf(w, "OK        signature over %s\n", BundleIndexFile)
+	case r.Signed:
+		fmt.Fprintf(w, "Bundle is signed (no public key given to check the signature)\n")
+	}
+	for _, p := range r.Missing {
+		fmt.Fprintf(w, "MISSING   %s\n", p)
+	}
+	for _, p := range r.Extra {
+		fmt.Fprintf(w, "EXTRA     %s\n", p)
+	}
+	for _, p := range r.Corrupted {
+		fmt.Fprintf(w, "CORRUPTED %s\n", p)
+	}
+	fmt.Fprintf(w, "Checked %d files\n", r.FilesChecked)
+}
+
+// WriteArchiveChecksum computes the SHA-256 of an archive and writes it next to
+// the archive in sha256sum format
+func WriteArchiveChecksum(archivePath string) (string, error) {
+	digest, err := FileDigest(archivePath)
+	if err != nil {
+		return "", err
+	}
+
+	hexDigest := strings.TrimPrefix(digest, "sha256:")
+	line := fmt.Sprintf("%s  %s\n", hexDigest, filepath.Base(archivePath))
+	if err := os.WriteFile(archivePath+ChecksumSuffix, []byte(line), 0644); err != nil {
+		return "", fmt.Errorf("failed to write archive checksum: %w", err)
+	}
+
+	return hexDigest, nil
+}
+
+// readArchiveChecksum reads the expected archive checksum written by
+// WriteArchiveChecksum. It returns an empty string if there is none.
+func readArchiveChecksum(archivePath string) (string, error) {
+	file, err := os.Open(archivePath + ChecksumSuffix)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to open archive checksum: %w", err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing file: %v\n", err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return "", fmt.Errorf("archive checksum file %s is empty", archivePath+ChecksumSuffix)
+	}
+	fields := strings.Fields(scanner.Text())
+	if len(fields) == 0 {
+		return "", fmt.Errorf("archive checksum file %s is malformed", archivePath+ChecksumSuffix)
+	}
+
+	return strings.ToLower(fields[0]), nil
+}
+
+// VerifyBundle checks a bundle archive or unpacked bundle directory against the
+// checksums recorded in its index, and checks the index signature when a
+// public key is given. It works fully offline.
+func VerifyBundle(bundlePath string, opts VerifyOptions) (*VerifyResult, error) {
+	// Split bundles are verified through their reassembled archive
+	bundlePath, split := ResolveBundle(bundlePath)
+	isDir := false
+	if !split {
+		info, err := os.Stat(bundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to access bundle '%s': %w", bundlePath, err)
+		}
+		isDir = info.IsDir()
+	}
+
+	var result *VerifyResult
+	var indexData, sigData []byte
+	var err error
+	if isDir {
+		result, indexData, sigData, err = verifyBundleDir(bundlePath)
+	} else {
+		result, indexData, sigData, err = verifyBundleArchive(bundlePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Signed = sigData != nil
+	if opts.PublicKeyPath != "" {
+		if err := checkSignature(opts.PublicKeyPath, indexData, sigData); err != nil {
+			result.SignatureError = err.Error()
+		} else {
+			result.SignatureValid = true
+		}
+	}
+
+	return result, nil
+}
+
+// checkSignature verifies the detached signature over the bundle index
+func checkSignature(publicKeyPath string, indexData, sigData []byte) error {
+	if sigData == nil {
+		return fmt.Errorf("bundle is not signed")
+	}
+
+	publicKey, err := signing.LoadPublicKey(publicKeyPath)
+	if err != nil {
+		return err
+	}
+
+	return signing.Verify(publicKey, indexData, sigData)
+}
+
+// verifyBundleArchive streams through a tar.gz bundle without extracting it.
+// It returns the raw index and signature so the signature can be checked.
+func verifyBundleArchive(archivePath string) (*VerifyResult, []byte, []byte, error) {
+	result := &VerifyResult{}
+
+	expected, err := readArchiveChecksum(archivePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	file, err := OpenBundle(archivePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing file: %v\n", err)
+		}
+	}()
+
+	// Hash the compressed archive while reading it
+	archiveHasher := sha256.New()
+	archiveReader := io.TeeReader(file, archiveHasher)
+	gzr, err := gzip.NewReader(archiveReader)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer func() {
+		if err := gzr.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing gzip reader: %v\n", err)
+		}
+	}()
+
+	actual := make(map[string]FileEntry)
+	var special []string
+	var indexData, sigData []byte
+
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("bundle archive is unreadable or corrupted: %w", err)
+		}
+		relPath := path.Clean(filepath.ToSlash(header.Name))
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg {
+			special = append(special, relPath)
+			continue
+		}
+
+		switch relPath {
+		case BundleIndexFile:
+			if indexData, err = io.ReadAll(tr); err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to read bundle index: %w", err)
+			}
+			continue
+		case BundleSignatureFile:
+			if sigData, err = io.ReadAll(tr); err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to read bundle signature: %w", err)
+			}
+			continue
+		}
+
+		hasher := sha256.New()
+		size, err := io.Copy(hasher, tr)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("bundle archive is unreadable or corrupted at '%s': %w", relPath, err)
+		}
+		actual[relPath] = FileEntry{Path: relPath, Digest: "sha256:" + hex.EncodeToString(hasher.Sum(nil)), Size: size}
+	}
+
+	// Drain any trailing data so the archive hash covers the whole file
+	if _, err := io.Copy(io.Discard, archiveReader); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+	result.ArchiveDigest = hex.EncodeToString(archiveHasher.Sum(nil))
+	if expected != "" {
+		result.ArchiveChecked = true
+		result.ArchiveMismatch = expected != result.ArchiveDigest
+	}
+
+	index := &BundleIndex{}
+	if indexData != nil {
+		if err := json.Unmarshal(indexData, index); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to parse bundle index: %w", err)
+		}
+	}
+
+	// Links are never part of a bundle, and could point outside of it
+	result.Extra = append(result.Extra, special...)
+
+	// Without file checksums, the archive checksum is all there is to check
+	if len(index.Files) == 0 {
+		if !result.ArchiveChecked {
+			return nil, nil, nil, ErrBundleNotVerifiable
+		}
+		sort.Strings(result.Extra)
+		return result, indexData, sigData, nil
+	}
+
+	result, err = compareFiles(result, index, actual)
+	return result, indexData, sigData, err
+}
+
+// verifyBundleDir checks an unpacked bundle directory
+func verifyBundleDir(bundleDir string) (*VerifyResult, []byte, []byte, error) {
+	indexData, err := os.ReadFile(filepath.Join(bundleDir, BundleIndexFile))
+	if os.IsNotExist(err) {
+		return nil, nil, nil, ErrBundleNotVerifiable
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read bundle index: %w", err)
+	}
+
+	sigData, err := os.ReadFile(filepath.Join(bundleDir, BundleSignatureFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, nil, fmt.Errorf("failed to read bundle signature: %w", err)
+	}
+
+	index, err := LoadBundleIndex(bundleDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	actual := make(map[string]FileEntry)
+	current := &BundleIndex{}
+	if err := current.RecordFiles(bundleDir); err != nil {
+		return nil, nil, nil, err
+	}
+	for _, entry := range current.Files {
+		actual[entry.Path] = entry
+	}
+
+	result, err := compareFiles(&VerifyResult{}, index, actual)
+	return result, indexData, sigData, err
+}
+
+// compareFiles compares the files found in a bundle with those in its index
+func compareFiles(result *VerifyResult, index *BundleIndex, actual map[string]FileEntry) (*VerifyResult, error) {
+	if len(index.Files) == 0 {
+		return nil, ErrBundleNotVerifiable
+	}
+
+	listed := make(map[string]bool)
+	for _, want := range index.Files {
+		listed[want.Path] = true
+		got, ok := actual[want.Path]
+		if !ok {
+			result.Missing = append(result.Missing, want.Path)
+			continue
+		}
+		result.FilesChecked++
+		if got.Digest != want.Digest || got.Size != want.Size {
+			result.Corrupted = append(result.Corrupted, want.Path)
+		}
+	}
+
+	for p := range actual {
+		if !listed[p] {
+			result.Extra = append(result.Extra, p)
+		}
+	}
+	sort.Strings(result.Extra)
+
+	return result, nil
+}
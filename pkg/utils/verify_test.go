@@ -0,0 +1,353 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/capsailer/capsailer-cli/pkg/signing"
+)
+
+// archiveEntry is a file, a link when Link is set, or a directory when Name
+// ends in a slash, in a test archive
+type archiveEntry struct {
+	Name string
+	Body string
+	Link string
+}
+
+func TestVerifyBundle(t *testing.T) {
+	files := []archiveEntry{
+		{Name: "manifest.yaml", Body: "images: []\n"},
+		{Name: "charts/app-1.0.0.tgz", Body: "chart"},
+	}
+
+	tests := []struct {
+		name      string
+		entries   []archiveEntry
+		noIndex   bool
+		checksum  string // Archive checksum file contents: "" for none, "match" for the actual digest
+		missing   []string
+		extra     []string
+		corrupted []string
+		mismatch  bool
+		wantErr   error
+	}{
+		{name: "intact", entries: files, checksum: "match"},
+		{name: "missing", entries: files[:1], missing: []string{"charts/app-1.0.0.tgz"}},
+		{
+			name:    "extra",
+			entries: append([]archiveEntry{{Name: "charts/other.tgz", Body: "other"}}, files...),
+			extra:   []string{"charts/other.tgz"},
+		},
+		{
+			name:      "corrupted",
+			entries:   []archiveEntry{files[0], {Name: "charts/app-1.0.0.tgz", Body: "tampered"}},
+			corrupted: []string{"charts/app-1.0.0.tgz"},
+		},
+		{
+			name:    "symlink",
+			entries: append([]archiveEntry{{Name: "escape", Link: "/etc"}}, files...),
+			extra:   []string{"escape"},
+		},
+		{name: "archive mismatch", entries: files, checksum: strings.Repeat("0", 64), mismatch: true},
+		{name: "no index", entries: files, noIndex: true, wantErr: ErrBundleNotVerifiable},
+		{name: "no index with mismatch", entries: files, noIndex: true, checksum: strings.Repeat("0", 64), mismatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			archivePath := filepath.Join(dir, "bundle.tar.gz")
+
+			entries := append([]archiveEntry{}, tt.entries...)
+			if !tt.noIndex {
+				entries = append(entries, archiveEntry{Name: BundleIndexFile, Body: testIndex(t, files)})
+			}
+			writeTestArchive(t, archivePath, entries)
+
+			switch tt.checksum {
+			case "":
+			case "match":
+				if _, err := WriteArchiveChecksum(archivePath); err != nil {
+					t.Fatalf("Failed to write archive checksum: %v", err)
+				}
+			default:
+				if err := os.WriteFile(archivePath+ChecksumSuffix, []byte(tt.checksum+"  bundle.tar.gz\n"), 0644); err != nil {
+					t.Fatalf("Failed to write archive checksum: %v", err)
+				}
+			}
+
+			result, err := VerifyBundle(archivePath, VerifyOptions{})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to verify bundle: %v", err)
+			}
+
+			if !reflect.DeepEqual(result.Missing, tt.missing) {
+				t.Errorf("Expected missing %v, got %v", tt.missing, result.Missing)
+			}
+			if !reflect.DeepEqual(result.Extra, tt.extra) {
+				t.Errorf("Expected extra %v, got %v", tt.extra, result.Extra)
+			}
+			if !reflect.DeepEqual(result.Corrupted, tt.corrupted) {
+				t.Errorf("Expected corrupted %v, got %v", tt.corrupted, result.Corrupted)
+			}
+			if result.ArchiveMismatch != tt.mismatch {
+				t.Errorf("Expected archive mismatch %v, got %v", tt.mismatch, result.ArchiveMismatch)
+			}
+			wantOK := tt.missing == nil && tt.extra == nil && tt.corrupted == nil && !tt.mismatch
+			if result.OK() != wantOK {
+				t.Errorf("Expected OK %v, got %v", wantOK, result.OK())
+			}
+		})
+	}
+}
+
+func TestUnpackRefusesEscapingEntries(t *testing.T) {
+	tests := map[string][]archiveEntry{
+		"absolute link":   {{Name: "charts", Link: "/tmp"}, {Name: "charts/app.tgz", Body: "chart"}},
+		"relative link":   {{Name: "charts", Link: "../.."}, {Name: "charts/app.tgz", Body: "chart"}},
+		"linked link":     {{Name: "self", Link: "."}, {Name: "self/up", Link: ".."}},
+		"parent in name":  {{Name: "../outside.txt", Body: "data"}},
+		"nested parent":   {{Name: "a/b/../../../outside.txt", Body: "data"}},
+		"link to sibling": {{Name: "images", Link: "../sibling"}},
+	}
+
+	for name, entries := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			archivePath := filepath.Join(dir, "bundle.tar.gz")
+			outputDir := filepath.Join(dir, "out", "bundle")
+			writeTestArchive(t, archivePath, entries)
+
+			unpacker := NewUnpacker(UnpackOptions{BundlePath: archivePath, OutputDir: outputDir})
+			if err := unpacker.Unpack(); err == nil || !strings.Contains(err.Error(), "outside the output directory") {
+				t.Fatalf("Expected the entry to be refused, got: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "out", "outside.txt")); !os.IsNotExist(err) {
+				t.Error("Expected nothing to be written outside the output directory")
+			}
+		})
+	}
+
+	// The bundle root and links within the bundle are kept
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "bundle.tar.gz")
+	writeTestArchive(t, archivePath, []archiveEntry{
+		{Name: "./"},
+		{Name: "charts/app.tgz", Body: "chart"},
+		{Name: "latest.tgz", Link: "charts/app.tgz"},
+	})
+	outputDir := filepath.Join(dir, "out")
+	if err := NewUnpacker(UnpackOptions{BundlePath: archivePath, OutputDir: outputDir}).Unpack(); err != nil {
+		t.Fatalf("Failed to unpack bundle: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(outputDir, "latest.tgz")); err != nil || string(data) != "chart" {
+		t.Errorf("Expected the link to the chart to be extracted, got %q, %v", data, err)
+	}
+}
+
+func TestUnpackReplacesEntries(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "bundle.tar.gz")
+	writeTestArchive(t, archivePath, []archiveEntry{
+		{Name: "manifest.yaml", Body: "images: [nginx:1.25]\n"},
+		{Name: "manifest.yaml", Body: "images: []\n"},
+		{Name: "latest", Link: "manifest.yaml"},
+		{Name: "latest", Link: "other.yaml"},
+		{Name: "other.yaml", Body: "other"},
+	})
+
+	// A later entry of the same name wins, without stale bytes
+	outputDir := filepath.Join(dir, "out")
+	if err := NewUnpacker(UnpackOptions{BundlePath: archivePath, OutputDir: outputDir}).Unpack(); err != nil {
+		t.Fatalf("Failed to unpack bundle: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(outputDir, "manifest.yaml")); err != nil || string(data) != "images: []\n" {
+		t.Errorf("Expected the last manifest.yaml entry, got %q, %v", data, err)
+	}
+	if link, err := os.Readlink(filepath.Join(outputDir, "latest")); err != nil || link != "other.yaml" {
+		t.Errorf("Expected the last link entry, got %q, %v", link, err)
+	}
+
+	// Files of an earlier bundle would mix with the new one
+	err := NewUnpacker(UnpackOptions{BundlePath: archivePath, OutputDir: outputDir}).Unpack()
+	if err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("Expected a non-empty output directory to be refused, got: %v", err)
+	}
+}
+
+func TestSignedBundleRequiresTrustedSignature(t *testing.T) {
+	keyDir := t.TempDir()
+	trustedKey := filepath.Join(keyDir, "trusted.key")
+	trustedPub := filepath.Join(keyDir, "trusted.pub")
+	otherKey := filepath.Join(keyDir, "other.key")
+	if err := signing.GenerateKeyPair(signing.AlgorithmEd25519, trustedKey, trustedPub); err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	if err := signing.GenerateKeyPair(signing.AlgorithmEd25519, otherKey, filepath.Join(keyDir, "other.pub")); err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	files := []archiveEntry{
+		{Name: "manifest.yaml", Body: "images: []\n"},
+		{Name: "charts/app-1.0.0.tgz", Body: "chart"},
+	}
+	tampered := []archiveEntry{files[0], {Name: "charts/app-1.0.0.tgz", Body: "tampered"}}
+	index := testIndex(t, files)
+	tamperedIndex := testIndex(t, tampered)
+
+	tests := []struct {
+		name    string
+		files   []archiveEntry
+		index   string // Index shipped in the bundle
+		signed  string // Index the signature was made over
+		key     string // Private key that signed, empty for an unsigned bundle
+		wantErr bool
+	}{
+		{name: "trusted", files: files, index: index, signed: index, key: trustedKey},
+		{name: "unsigned", files: files, index: index, wantErr: true},
+		{name: "wrong key", files: files, index: index, signed: index, key: otherKey, wantErr: true},
+		// The index was rewritten to match a tampered chart after signing
+		{name: "modified index", files: tampered, index: tamperedIndex, signed: index, key: trustedKey, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			entries := append([]archiveEntry{}, tt.files...)
+			entries = append(entries, archiveEntry{Name: BundleIndexFile, Body: tt.index})
+			if tt.key != "" {
+				entries = append(entries, archiveEntry{Name: BundleSignatureFile, Body: testSignature(t, tt.key, tt.signed)})
+			}
+			archivePath := filepath.Join(dir, "bundle.tar.gz")
+			writeTestArchive(t, archivePath, entries)
+
+			// verify, on the archive
+			result, err := VerifyBundle(archivePath, VerifyOptions{PublicKeyPath: trustedPub})
+			if err != nil {
+				t.Fatalf("Failed to verify bundle: %v", err)
+			}
+			if result.OK() == tt.wantErr || result.SignatureValid == tt.wantErr {
+				t.Errorf("Expected verify to fail %v, got OK %v: %s", tt.wantErr, result.OK(), result.SignatureError)
+			}
+
+			// unpack, and push or deploy of an archive, which unpack it first
+			err = NewUnpacker(UnpackOptions{
+				BundlePath:    archivePath,
+				OutputDir:     filepath.Join(dir, "verified"),
+				Verify:        true,
+				PublicKeyPath: trustedPub,
+			}).Unpack()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected unpack to fail %v, got: %v", tt.wantErr, err)
+			}
+
+			// verify and push of an unpacked bundle directory
+			unpackedDir := filepath.Join(dir, "unpacked")
+			if err := NewUnpacker(UnpackOptions{BundlePath: archivePath, OutputDir: unpackedDir}).Unpack(); err != nil {
+				t.Fatalf("Failed to unpack bundle: %v", err)
+			}
+			result, err = VerifyBundle(unpackedDir, VerifyOptions{PublicKeyPath: trustedPub})
+			if err != nil {
+				t.Fatalf("Failed to verify bundle directory: %v", err)
+			}
+			if result.OK() == tt.wantErr {
+				t.Errorf("Expected directory verify to fail %v, got OK %v: %s", tt.wantErr, result.OK(), result.SignatureError)
+			}
+		})
+	}
+}
+
+// testSignature signs data with the private key and returns the signature file contents
+func testSignature(t *testing.T, privateKeyPath, data string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, BundleIndexFile)
+	if err := os.WriteFile(dataPath, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	sigPath := filepath.Join(dir, BundleSignatureFile)
+	if err := signing.SignFile(privateKeyPath, dataPath, sigPath); err != nil {
+		t.Fatalf("Failed to sign file: %v", err)
+	}
+	sig, err := os.ReadFile(sigPath)
+	if err != nil {
+		t.Fatalf("Failed to read signature: %v", err)
+	}
+	return string(sig)
+}
+
+// testIndex returns a bundle index recording the checksums of files
+func testIndex(t *testing.T, files []archiveEntry) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(file.Body), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	index := NewBundleIndex()
+	if err := index.RecordFiles(dir); err != nil {
+		t.Fatalf("Failed to record files: %v", err)
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("Failed to marshal index: %v", err)
+	}
+	return string(data)
+}
+
+// writeTestArchive writes a tar.gz archive with the entries, in order
+func writeTestArchive(t *testing.T, archivePath string, entries []archiveEntry) {
+	t.Helper()
+
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+	defer file.Close()
+	gw := gzip.NewWriter(file)
+	tw := tar.NewWriter(gw)
+
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.Name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.Body))}
+		if entry.Link != "" {
+			header = &tar.Header{Name: entry.Name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.Link}
+		} else if strings.HasSuffix(entry.Name, "/") {
+			header = &tar.Header{Name: entry.Name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatalf("Failed to write header: %v", err)
+		}
+		if _, err := tw.Write([]byte(entry.Body)); err != nil {
+			t.Fatalf("Failed to write entry: %v", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Failed to close gzip writer: %v", err)
+	}
+}
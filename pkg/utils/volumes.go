@@ -0,0 +1,451 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VolumeHeaderSize is the size of the header at the start of every volume
+const VolumeHeaderSize = 512
+
+// volumeMagic starts every volume header
+const volumeMagic = "CAPSAILER-VOLUME 1\n"
+
+// maxVolumes is the largest volume count the three digit suffix allows
+const maxVolumes = 999
+
+var volumeSuffix = regexp.MustCompile(`\.(\d{3})$`)
+
+// VolumeHeader describes one volume of a split bundle. The archive digest
+// identifies the set, so volumes of different bundles are never mixed.
+type VolumeHeader struct {
+	Archive       string `json:"archive"`       // File name of the original archive
+	ArchiveDigest string `json:"archiveDigest"` // SHA-256 digest of the original archive
+	ArchiveSize   int64  `json:"archiveSize"`   // Size of the original archive in bytes
+	Volume        int    `json:"volume"`        // Number of this volume, starting at 1
+	Volumes       int    `json:"volumes"`       // Number of volumes in the set
+	Offset        int64  `json:"offset"`        // Offset of this volume's data in the archive
+	Size          int64  `json:"size"`          // Bytes of archive data in this volume
+	Digest        string `json:"digest"`        // SHA-256 digest of this volume's data
+}
+
+// ParseSize parses a size such as 4G, 700M, 512Ki or 1048576. K, M, G and T
+// are decimal units; Ki, Mi, Gi and Ti are binary units.
+func ParseSize(value string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+		{"K", 1000}, {"M", 1000 * 1000}, {"G", 1000 * 1000 * 1000}, {"T", 1000 * 1000 * 1000 * 1000},
+	}
+
+	trimmed := strings.TrimSuffix(strings.TrimSpace(value), "B")
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(trimmed, unit.suffix) {
+			trimmed = strings.TrimSuffix(trimmed, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	number, err := strconv.ParseInt(trimmed, 10, 64)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("invalid size '%s', use a number with an optional unit such as 4G, 700M or 512Mi", value)
+	}
+
+	return number * multiplier, nil
+}
+
+// VolumePath returns the file name of a volume, for example bundle.tar.gz.001
+func VolumePath(archivePath string, volume int) string {
+	return fmt.Sprintf("%s.%03d", archivePath, volume)
+}
+
+// SplitFile splits an archive into numbered volumes of at most volumeSize
+// bytes, each starting with a header describing the set, and removes the
+// original archive. It returns the volume paths in order.
+func SplitFile(archivePath string, volumeSize int64) ([]string, error) {
+	if volumeSize <= VolumeHeaderSize {
+		return nil, fmt.Errorf("split size must be larger than the %d byte volume header", VolumeHeaderSize)
+	}
+	payloadSize := volumeSize - VolumeHeaderSize
+
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access archive: %w", err)
+	}
+	archiveDigest, err := FileDigest(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	count := int((info.Size() + payloadSize - 1) / payloadSize)
+	if count == 0 {
+		count = 1
+	}
+	if count > maxVolumes {
+		return nil, fmt.Errorf("split size is too small: the bundle would need %d volumes, at most %d are supported", count, maxVolumes)
+	}
+
+	// Remove volumes left over from an earlier split of the same name
+	stale, err := filepath.Glob(globEscape(archivePath) + ".[0-9][0-9][0-9]")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes: %w", err)
+	}
+	for _, path := range stale {
+		if _, err := readVolumeHeader(path); err == nil {
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("failed to remove old volume: %w", err)
+			}
+		}
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing file: %v\n", err)
+		}
+	}()
+
+	var paths []string
+	for volume := 1; volume <= count; volume++ {
+		offset := int64(volume-1) * payloadSize
+		size := payloadSize
+		if remaining := info.Size() - offset; remaining < size {
+			size = remaining
+		}
+
+		// Hash this volume's data first so the header can carry its digest
+		section := io.NewSectionReader(file, offset, size)
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, section); err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		header := VolumeHeader{
+			Archive:       filepath.Base(archivePath),
+			ArchiveDigest: archiveDigest,
+			ArchiveSize:   info.Size(),
+			Volume:        volume,
+			Volumes:       count,
+			Offset:        offset,
+			Size:          size,
+			Digest:        "sha256:" + hex.EncodeToString(hasher.Sum(nil)),
+		}
+
+		volumePath := VolumePath(archivePath, volume)
+		if err := writeVolume(volumePath, header, io.NewSectionReader(file, offset, size)); err != nil {
+			return nil, err
+		}
+		paths = append(paths, volumePath)
+	}
+
+	if err := os.Remove(archivePath); err != nil {
+		return nil, fmt.Errorf("failed to remove unsplit archive: %w", err)
+	}
+
+	return paths, nil
+}
+
+// writeVolume writes a volume header followed by the volume data
+func writeVolume(volumePath string, header VolumeHeader, data io.Reader) error {
+	headerBytes, err := encodeVolumeHeader(header)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(volumePath)
+	if err != nil {
+		return fmt.Errorf("failed to create volume: %w", err)
+	}
+	if _, err := out.Write(headerBytes); err != nil {
+		_ = out.Close()
+		return fmt.Errorf("failed to write volume header: %w", err)
+	}
+	if _, err := io.Copy(out, data); err != nil {
+		_ = out.Close()
+		return fmt.Errorf("failed to write volume: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close volume: %w", err)
+	}
+
+	return nil
+}
+
+// encodeVolumeHeader renders a header padded to VolumeHeaderSize bytes
+func encodeVolumeHeader(header VolumeHeader) ([]byte, error) {
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal volume header: %w", err)
+	}
+
+	encoded := append([]byte(volumeMagic), data...)
+	encoded = append(encoded, '\n')
+	if len(encoded) > VolumeHeaderSize {
+		return nil, fmt.Errorf("volume header is larger than %d bytes", VolumeHeaderSize)
+	}
+
+	return append(encoded, make([]byte, VolumeHeaderSize-len(encoded))...), nil
+}
+
+// readVolumeHeader reads and parses the header at the start of a volume
+func readVolumeHeader(volumePath string) (*VolumeHeader, error) {
+	file, err := os.Open(volumePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing file: %v\n", err)
+		}
+	}()
+
+	buf := make([]byte, VolumeHeaderSize)
+	if _, err := io.ReadFull(file, buf); err != nil {
+		return nil, fmt.Errorf("%s is too short to be a bundle volume", volumePath)
+	}
+	if !bytes.HasPrefix(buf, []byte(volumeMagic)) {
+		return nil, fmt.Errorf("%s is not a bundle volume", volumePath)
+	}
+
+	data := bytes.TrimRight(buf[len(volumeMagic):], "\x00\n")
+	header := &VolumeHeader{}
+	if err := json.Unmarshal(data, header); err != nil {
+		return nil, fmt.Errorf("failed to parse volume header of %s: %w", volumePath, err)
+	}
+
+	return header, nil
+}
+
+// ResolveBundle returns the archive path of a bundle and whether it is split
+// into volumes. Both the archive name (bundle.tar.gz) and any of its volume
+// names (bundle.tar.gz.001) are accepted.
+func ResolveBundle(bundlePath string) (string, bool) {
+	if match := volumeSuffix.FindStringSubmatch(bundlePath); match != nil {
+		if _, err := readVolumeHeader(bundlePath); err == nil {
+			return strings.TrimSuffix(bundlePath, match[0]), true
+		}
+	}
+
+	if _, err := os.Stat(bundlePath); err == nil {
+		return bundlePath, false
+	}
+
+	volumes, _ := filepath.Glob(globEscape(bundlePath) + ".[0-9][0-9][0-9]")
+	return bundlePath, len(volumes) > 0
+}
+
+// BundleExists reports whether a bundle archive, volume set or directory exists
+func BundleExists(bundlePath string) bool {
+	archivePath, split := ResolveBundle(bundlePath)
+	if split {
+		return true
+	}
+	_, err := os.Stat(archivePath)
+	return err == nil
+}
+
+// OpenBundle opens a bundle archive for reading. Split bundles are checked for
+// missing, foreign and out-of-order volumes before any data is returned, then
+// reassembled transparently while every volume is checked against its digest.
+func OpenBundle(bundlePath string) (io.ReadCloser, error) {
+	archivePath, split := ResolveBundle(bundlePath)
+	if !split {
+		file, err := os.Open(archivePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open bundle: %w", err)
+		}
+		return file, nil
+	}
+
+	volumes, err := checkVolumes(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &volumeReader{volumes: volumes, archiveHasher: sha256.New()}, nil
+}
+
+// volume is a volume file together with its parsed header
+type volume struct {
+	path   string
+	header *VolumeHeader
+}
+
+// checkVolumes finds every volume of a split bundle and makes sure the set is
+// complete, belongs together and is named in order
+func checkVolumes(archivePath string) ([]volume, error) {
+	paths, err := filepath.Glob(globEscape(archivePath) + ".[0-9][0-9][0-9]")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes: %w", err)
+	}
+	sort.Strings(paths)
+
+	found := make(map[int]volume)
+	var reference *VolumeHeader
+	var referencePath string
+	for _, path := range paths {
+		header, err := readVolumeHeader(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if reference == nil {
+			reference, referencePath = header, path
+		} else if header.ArchiveDigest != reference.ArchiveDigest {
+			return nil, fmt.Errorf("%s belongs to a different bundle (%s) than %s (%s)", path, header.ArchiveDigest, referencePath, reference.ArchiveDigest)
+		}
+
+		number, _ := strconv.Atoi(strings.TrimPrefix(filepath.Ext(path), "."))
+		if header.Volume != number {
+			return nil, fmt.Errorf("%s contains volume %d of %d, expected volume %d: the volumes are out of order or were renamed", path, header.Volume, header.Volumes, number)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to access volume: %w", err)
+		}
+		if info.Size() != VolumeHeaderSize+header.Size {
+			return nil, fmt.Errorf("volume %d of %d (%s) is truncated or damaged: expected %d bytes, found %d", header.Volume, header.Volumes, path, VolumeHeaderSize+header.Size, info.Size())
+		}
+
+		found[number] = volume{path: path, header: header}
+	}
+
+	if reference == nil {
+		return nil, fmt.Errorf("no volumes found for bundle %s", archivePath)
+	}
+
+	var missing []string
+	var volumes []volume
+	for number := 1; number <= reference.Volumes; number++ {
+		v, ok := found[number]
+		if !ok {
+			missing = append(missing, fmt.Sprintf("volume %d (%s)", number, filepath.Base(VolumePath(archivePath, number))))
+			continue
+		}
+		volumes = append(volumes, v)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("bundle %s is split into %d volumes, missing %s", archivePath, reference.Volumes, strings.Join(missing, ", "))
+	}
+
+	return volumes, nil
+}
+
+// volumeReader reads the data of a set of volumes as one archive
+type volumeReader struct {
+	volumes       []volume
+	current       int
+	file          *os.File
+	reader        io.Reader
+	read          int64
+	hasher        hash.Hash
+	archiveHasher hash.Hash
+}
+
+// Read implements io.Reader
+func (r *volumeReader) Read(p []byte) (int, error) {
+	for {
+		if r.file == nil {
+			if r.current >= len(r.volumes) {
+				return 0, r.checkArchive()
+			}
+			if err := r.openVolume(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.reader.Read(p)
+		r.read += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if err == io.EOF {
+			if err := r.closeVolume(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		return 0, err
+	}
+}
+
+// openVolume starts reading the data of the current volume
+func (r *volumeReader) openVolume() error {
+	v := r.volumes[r.current]
+	file, err := os.Open(v.path)
+	if err != nil {
+		return fmt.Errorf("failed to open volume %d: %w", v.header.Volume, err)
+	}
+	if _, err := file.Seek(VolumeHeaderSize, io.SeekStart); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to read volume %d: %w", v.header.Volume, err)
+	}
+
+	r.file = file
+	r.read = 0
+	r.hasher = sha256.New()
+	r.reader = io.TeeReader(io.LimitReader(file, v.header.Size), io.MultiWriter(r.hasher, r.archiveHasher))
+	return nil
+}
+
+// closeVolume checks the volume that was just read completely
+func (r *volumeReader) closeVolume() error {
+	v := r.volumes[r.current]
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("failed to close volume %d: %w", v.header.Volume, err)
+	}
+	r.file = nil
+	r.current++
+
+	if r.read != v.header.Size {
+		return fmt.Errorf("volume %d of %d (%s) is truncated", v.header.Volume, v.header.Volumes, v.path)
+	}
+	if digest := "sha256:" + hex.EncodeToString(r.hasher.Sum(nil)); digest != v.header.Digest {
+		return fmt.Errorf("volume %d of %d (%s) is corrupted: its data does not match the digest in its header", v.header.Volume, v.header.Volumes, v.path)
+	}
+	return nil
+}
+
+// checkArchive compares the reassembled archive with the digest in the headers
+func (r *volumeReader) checkArchive() error {
+	expected := r.volumes[0].header.ArchiveDigest
+	if digest := "sha256:" + hex.EncodeToString(r.archiveHasher.Sum(nil)); digest != expected {
+		return fmt.Errorf("reassembled bundle does not match its digest %s", expected)
+	}
+	return io.EOF
+}
+
+// Close implements io.Closer
+func (r *volumeReader) Close() error {
+	if r.file != nil {
+		err := r.file.Close()
+		r.file = nil
+		return err
+	}
+	return nil
+}
+
+// globEscape escapes glob metacharacters in a literal path
+func globEscape(path string) string {
+	replacer := strings.NewReplacer("*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+	return replacer.Replace(path)
+}
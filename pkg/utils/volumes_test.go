@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"1048576": 1048576,
+		"700M":    700 * 1000 * 1000,
+		"4G":      4 * 1000 * 1000 * 1000,
+		"4GB":     4 * 1000 * 1000 * 1000,
+		"512Mi":   512 << 20,
+		"2GiB":    2 << 30,
+	}
+	for value, expected := range tests {
+		size, err := ParseSize(value)
+		if err != nil {
+			t.Errorf("ParseSize(%q) failed: %v", value, err)
+			continue
+		}
+		if size != expected {
+			t.Errorf("ParseSize(%q) = %d, expected %d", value, size, expected)
+		}
+	}
+
+	for _, value := range []string{"", "G", "-1G", "4X", "0"} {
+		if _, err := ParseSize(value); err == nil {
+			t.Errorf("Expected error for size %q, but got nil", value)
+		}
+	}
+}
+
+func TestSplitFile(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "bundle.tar.gz")
+
+	data := make([]byte, 5000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Failed to generate data: %v", err)
+	}
+	if err := os.WriteFile(archivePath, data, 0644); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+
+	volumes, err := SplitFile(archivePath, 2048)
+	if err != nil {
+		t.Fatalf("Failed to split archive: %v", err)
+	}
+	if len(volumes) != 4 {
+		t.Fatalf("Expected 4 volumes, got %d", len(volumes))
+	}
+	if !BundleExists(archivePath) {
+		t.Error("Expected split bundle to exist")
+	}
+
+	// Any volume name resolves to the whole archive
+	reassembled := readBundle(t, volumes[2])
+	if !bytes.Equal(reassembled, data) {
+		t.Error("Reassembled archive does not match the original")
+	}
+
+	// Renamed volumes are reported as out of order
+	if err := os.Rename(volumes[1], filepath.Join(dir, "tmp")); err != nil {
+		t.Fatalf("Failed to rename volume: %v", err)
+	}
+	if err := os.Rename(volumes[2], volumes[1]); err != nil {
+		t.Fatalf("Failed to rename volume: %v", err)
+	}
+	if _, err := OpenBundle(archivePath); err == nil || !strings.Contains(err.Error(), "out of order") {
+		t.Errorf("Expected out of order error, got: %v", err)
+	}
+
+	// A missing volume is named
+	if err := os.Remove(volumes[1]); err != nil {
+		t.Fatalf("Failed to remove volume: %v", err)
+	}
+	if _, err := OpenBundle(archivePath); err == nil || !strings.Contains(err.Error(), "missing volume 2") {
+		t.Errorf("Expected missing volume error, got: %v", err)
+	}
+}
+
+func readBundle(t *testing.T, path string) []byte {
+	t.Helper()
+	reader, err := OpenBundle(path)
+	if err != nil {
+		t.Fatalf("Failed to open bundle: %v", err)
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			t.Errorf("Failed to close bundle: %v", err)
+		}
+	}()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read bundle: %v", err)
+	}
+	return data
+}